@@ -0,0 +1,69 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+// acceptMaxWait is the max time to wait for accepting a connection beyond the
+// accept rate if the action is "wait", it's closed if it must wait longer.
+const acceptMaxWait = time.Second
+
+var (
+	// acceptThrottle count the connections delayed or rejected by the
+	// accept rate limit, and "throttled" is 1 while a connection is delayed.
+	acceptThrottle = expvar.NewMap("accept_throttle")
+	throttled      = new(expvar.Int)
+)
+
+func init() {
+	acceptThrottle.Set("throttled", throttled)
+}
+
+// SetAcceptRate limit the rate of accepting the connections on the listener
+// to rate per second, the connections beyond it wait for up to acceptMaxWait
+// if action is "wait", or are closed at once if "reject", no limit if
+// rate <= 0.
+func (l *Local) SetAcceptRate(rate int, action string) error {
+	switch action {
+	case "wait", "reject":
+	default:
+		return fmt.Errorf("unknown accept_rate_action: %s", action)
+	}
+	if rate <= 0 {
+		l.acceptBucket = nil
+		return nil
+	}
+	l.acceptBucket = newTokenBucket(int64(rate))
+	l.acceptMaxWait = 0
+	if action == "wait" {
+		l.acceptMaxWait = acceptMaxWait
+	}
+	return nil
+}
+
+// throttleAccept wait before handling the accepted conn if it's beyond the
+// accept rate, returns false if conn is closed as it must wait too long.
+func (l *Local) throttleAccept(conn net.Conn) bool {
+	if l.acceptBucket == nil {
+		return true
+	}
+	wait, ok := l.acceptBucket.take(1, l.acceptMaxWait)
+	if !ok {
+		acceptThrottle.Add("rejected", 1)
+		dlog.Warnf("close the connection from %s beyond the accept rate", conn.RemoteAddr().String())
+		rejectConn(conn, "accept_rate")
+		return false
+	}
+	if wait > 0 {
+		acceptThrottle.Add("delayed", 1)
+		throttled.Set(1)
+		time.Sleep(wait)
+		throttled.Set(0)
+	}
+	return true
+}
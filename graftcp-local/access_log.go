@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+// accessRecord is a record of the access log, written in JSON per line.
+type accessRecord struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"` // "open", "interim" for the open connections, or "close"
+	Pid      string    `json:"pid"`
+	Src      string    `json:"src"`
+	Dest     string    `json:"dest"`
+	Host     string    `json:"host,omitempty"` // host name requested to the front-ends
+	Upstream string    `json:"upstream"`
+	Proxy    string    `json:"proxy,omitempty"`
+	Sent     int64     `json:"sent"`     // bytes sent to the destination so far
+	Received int64     `json:"received"` // bytes received from the destination so far
+	Duration string    `json:"duration"` // since the connection is accepted
+
+	// Timings of the setup phases, only in the access log
+	Lookup string `json:"lookup,omitempty"` // pid lookup
+	Dial   string `json:"dial,omitempty"`   // dial and handshake with the upstream
+}
+
+// accessLog write a record for each connection when it's closed, and the
+// interim records for the open connections every interval if it's not 0.
+type accessLog struct {
+	interval time.Duration
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+// connCounters count the bytes of a connection so far.
+type connCounters struct {
+	sent     int64 // accessed atomically
+	received int64 // accessed atomically
+}
+
+// SetAccessLog write the access log to the file path, with the interim
+// records of the open connections every interval, no interim records if 0.
+func (l *Local) SetAccessLog(path string, interval time.Duration) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	l.accessLog = &accessLog{interval: interval, f: f}
+	return nil
+}
+
+func (al *accessLog) write(r accessRecord) {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	if _, err := al.f.Write(append(b, '\n')); err != nil {
+		dlog.Errorf("write the access log err: %s", err.Error())
+	}
+}
+
+// record write the record r of event with the bytes counted by counters and
+// the duration since start.
+func (al *accessLog) record(event string, r accessRecord, counters *connCounters, start time.Time) {
+	if al == nil {
+		return
+	}
+	al.write(r.fill(event, counters, start))
+}
+
+// fill returns r of event with the bytes counted by counters and the
+// duration since start.
+func (r accessRecord) fill(event string, counters *connCounters, start time.Time) accessRecord {
+	r.Time, r.Event = time.Now(), event
+	r.Sent = atomic.LoadInt64(&counters.sent)
+	r.Received = atomic.LoadInt64(&counters.received)
+	r.Duration = time.Since(start).Round(time.Millisecond).String()
+	return r
+}
+
+// startInterim write the interim records of the connection every interval
+// until the returned function is called.
+func (al *accessLog) startInterim(r accessRecord, counters *connCounters, start time.Time) (stop func()) {
+	if al == nil || al.interval <= 0 {
+		return func() {}
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(al.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				al.record("interim", r, counters, start)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
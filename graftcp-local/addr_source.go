@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+const (
+	sourceMinBackoff = 100 * time.Millisecond
+	sourceMaxBackoff = 5 * time.Second
+)
+
+// AddrSource is a source of the address info sent by graftcp, the address
+// info is a line with format "dest_ipaddr:dest_port:pid".
+type AddrSource interface {
+	// Name returns the name of the source for logging and status.
+	Name() string
+	// Run read the address info and store it with StorePidAddr until the
+	// source can't be read any more, it's run again with backoff after it
+	// returns.
+	Run(m *readerMonitor)
+}
+
+type addrSourceRunner struct {
+	src     AddrSource
+	monitor readerMonitor
+}
+
+// AddAddrSource add src to the sources of the address info of l.
+func (l *Local) AddAddrSource(src AddrSource) {
+	r := &addrSourceRunner{src: src}
+	r.monitor.h.Name = src.Name()
+	l.sources = append(l.sources, r)
+}
+
+// UpdateProcessAddrInfo run all the sources of the address info of l, a
+// source will be restarted if it exits or panics.
+func (l *Local) UpdateProcessAddrInfo() {
+	for _, r := range l.sources {
+		go r.supervise()
+	}
+}
+
+// ReadersHealth returns the health of the sources of the address info.
+func (l *Local) ReadersHealth() []ReaderHealth {
+	hs := make([]ReaderHealth, 0, len(l.sources))
+	for _, r := range l.sources {
+		hs = append(hs, r.monitor.Health())
+	}
+	return hs
+}
+
+// supervise run the source again with backoff whenever it returns or panics,
+// the backoff is reset if it has read any address info, so graftcp and
+// graftcp-local can be restarted independently.
+func (r *addrSourceRunner) supervise() {
+	backoff := sourceMinBackoff
+	for {
+		records := r.monitor.Health().Records
+		r.monitor.setRunning(true)
+		func() {
+			defer func() {
+				if e := recover(); e != nil {
+					dlog.Criticalf("%s reader panic: %v", r.src.Name(), e)
+					r.monitor.setError(fmt.Sprintf("panic: %v", e))
+				}
+			}()
+			r.src.Run(&r.monitor)
+		}()
+		r.monitor.setRunning(false)
+		if r.monitor.Health().Records > records {
+			backoff = sourceMinBackoff
+		}
+		dlog.Noticef("%s reader exited, restart it in %v", r.src.Name(), backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > sourceMaxBackoff {
+			backoff = sourceMaxBackoff
+		}
+	}
+}
+
+// readProcessAddrInfo read the address info from r until an error occurs,
+// returns the number of lines read.
+func readProcessAddrInfo(r io.Reader, m *readerMonitor) (n int) {
+	br := bufio.NewReader(r)
+	for {
+		line, _, err := br.ReadLine()
+		if err != nil {
+			if err != io.EOF {
+				dlog.Errorf("r.ReadLine err: %s", err.Error())
+				m.setError(err.Error())
+			}
+			return
+		}
+		n++
+		m.read()
+		recorder.addrInfo(m.h.Name, string(line))
+		pid, addr, ok := parseProcessAddrInfo(string(line))
+		if !ok {
+			dlog.Errorf("r.ReadLine(): %s", string(line))
+			continue
+		}
+		// stored in the order received, as the addresses of a pid are
+		// taken in order
+		StorePidAddr(pid, addr)
+	}
+}
+
+// parseProcessAddrInfo parse the line with format "dest_ipaddr:dest_port:pid".
+func parseProcessAddrInfo(line string) (pid, addr string, ok bool) {
+	s := strings.Split(line, ":")
+	if len(s) < 3 {
+		return "", "", false
+	}
+	if len(s) > 3 { // IPv6
+		pid = s[len(s)-1]
+		destPort := s[len(s)-2]
+		destIP := line[:len(line)-2-len(pid)-len(destPort)]
+		addr = "[" + destIP + "]:" + destPort
+	} else { // IPv4
+		pid = s[2]
+		addr = s[0] + ":" + s[1]
+	}
+	return pid, addr, true
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// affinityCache remember the upstream of the last successful dial by the
+// destination address for ttl, so the connections to a destination reuse the
+// same upstream, e.g. to exploit the warmed connections and the caches of the
+// proxy.
+type affinityCache struct {
+	ttl time.Duration
+
+	mu        sync.Mutex
+	pins      map[string]affinityPin
+	nextSweep time.Time
+}
+
+type affinityPin struct {
+	mode    modeT // OnlySocks5Mode, OnlyHttpProxyMode or DirectMode
+	expires time.Time
+}
+
+// SetAffinityTTL pin the upstream of the auto and random modes by the
+// destination for ttl after a successful dial, no pinning if 0. The pin is
+// dropped if dialing with the pinned upstream fails.
+func (l *Local) SetAffinityTTL(ttl time.Duration) {
+	if ttl <= 0 {
+		l.affinity = nil
+		return
+	}
+	l.affinity = &affinityCache{ttl: ttl, pins: make(map[string]affinityPin)}
+}
+
+// pinnedChain returns chain with the mode pinned for the destination addr
+// tried first. The pin is ignored if chain can't dial with its upstream, e.g.
+// the primary down is not in the chain of primary_backup, or a rule selects
+// random for the destination pinned to direct.
+func (ac *affinityCache) pinnedChain(addr string, chain []modeT) []modeT {
+	if ac == nil {
+		return chain
+	}
+	ac.mu.Lock()
+	pin, ok := ac.pins[addr]
+	ac.mu.Unlock()
+	if !ok || time.Now().After(pin.expires) || !chainReaches(chain, pin.mode) {
+		return chain
+	}
+	pinned := []modeT{pin.mode}
+	for _, m := range chain {
+		if m != pin.mode {
+			pinned = append(pinned, m)
+		}
+	}
+	return pinned
+}
+
+// chainReaches reports whether chain dials with the upstream of mode, the
+// random mode dials with either proxy.
+func chainReaches(chain []modeT, mode modeT) bool {
+	for _, m := range chain {
+		if m == mode || m == RandomSelectMode && (mode == OnlySocks5Mode || mode == OnlyHttpProxyMode) {
+			return true
+		}
+	}
+	return false
+}
+
+// update pin the upstream of mode for the destination addr, or drop the pin
+// if the dial failed with ok false.
+func (ac *affinityCache) update(addr string, mode modeT, ok bool) {
+	if ac == nil {
+		return
+	}
+	now := time.Now()
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if !ok {
+		delete(ac.pins, addr)
+		return
+	}
+	if now.After(ac.nextSweep) {
+		for a, pin := range ac.pins {
+			if now.After(pin.expires) {
+				delete(ac.pins, a)
+			}
+		}
+		ac.nextSweep = now.Add(ac.ttl)
+	}
+	ac.pins[addr] = affinityPin{mode: mode, expires: now.Add(ac.ttl)}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestPinnedChain(t *testing.T) {
+	const addr = "192.0.2.1:443"
+	tests := []struct {
+		pin   modeT
+		chain []modeT
+		want  []modeT
+	}{
+		{DirectMode, []modeT{OnlySocks5Mode, OnlyHttpProxyMode, DirectMode}, []modeT{DirectMode, OnlySocks5Mode, OnlyHttpProxyMode}},
+		{OnlyHttpProxyMode, []modeT{OnlySocks5Mode, OnlyHttpProxyMode}, []modeT{OnlyHttpProxyMode, OnlySocks5Mode}},
+		{OnlySocks5Mode, []modeT{RandomSelectMode}, []modeT{OnlySocks5Mode, RandomSelectMode}},
+		// pinned under auto, but a rule selects random
+		{DirectMode, []modeT{RandomSelectMode}, []modeT{RandomSelectMode}},
+		// the primary is down, only the backup is in the chain
+		{OnlySocks5Mode, []modeT{OnlyHttpProxyMode}, []modeT{OnlyHttpProxyMode}},
+	}
+	for _, tt := range tests {
+		ac := &affinityCache{ttl: time.Minute, pins: make(map[string]affinityPin)}
+		ac.update(addr, tt.pin, true)
+		if got := ac.pinnedChain(addr, tt.chain); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("pinnedChain of %v pinned to %s = %v, want %v", tt.chain, tt.pin, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+// allowSet is the destinations allowed by the allowlist file.
+type allowSet struct {
+	nets  []*net.IPNet
+	hosts map[string]bool // the domains start with "." match the subdomains
+}
+
+// allowlistFile is the allowlist loaded from path, the set is swapped
+// atomically when the file changes.
+type allowlistFile struct {
+	path string
+	set  atomic.Value // *allowSet
+
+	mu      sync.Mutex // guard the reloads
+	modTime time.Time  // of the file loaded
+	size    int64
+}
+
+// SetAllowlist only allow connecting to the destinations listed in the file
+// path, one IP address, CIDR or host per line, and a host like
+// ".example.com" matches its subdomains. The file is checked every interval,
+// and loaded again if it changes, 0 not to check.
+func (l *Local) SetAllowlist(path string, interval time.Duration) error {
+	al := &allowlistFile{path: path}
+	if _, err := al.reload(); err != nil {
+		return err
+	}
+	l.allowlist = al
+	if interval > 0 {
+		go func() {
+			for range time.Tick(interval) {
+				l.ReloadAllowlist()
+			}
+		}()
+	}
+	return nil
+}
+
+// ReloadAllowlist load the allowlist file again if it changes, the old
+// allowlist is kept if it fails to load.
+func (l *Local) ReloadAllowlist() {
+	al := l.allowlist
+	if al == nil {
+		return
+	}
+	n, err := al.reload()
+	if err != nil {
+		dlog.Errorf("reload the allowlist %s err: %s, keep the old one", al.path, err.Error())
+		return
+	}
+	if n >= 0 {
+		dlog.Noticef("reloaded the allowlist %s, %d destinations", al.path, n)
+	}
+}
+
+// reload load the file if it changes since the last load, and returns the
+// number of the destinations loaded, or -1 if unchanged.
+func (al *allowlistFile) reload() (int, error) {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	fi, err := os.Stat(al.path)
+	if err != nil {
+		return 0, err
+	}
+	if fi.ModTime().Equal(al.modTime) && fi.Size() == al.size {
+		return -1, nil
+	}
+	data, err := ioutil.ReadFile(al.path)
+	if err != nil {
+		return 0, err
+	}
+	// not to load the bad file again until it changes
+	al.modTime, al.size = fi.ModTime(), fi.Size()
+	set, err := parseAllowlist(data)
+	if err != nil {
+		return 0, err
+	}
+	al.set.Store(set)
+	return len(set.nets) + len(set.hosts), nil
+}
+
+// parseAllowlist parse the destinations one per line, the empty lines and
+// those start with "#" are skipped.
+func parseAllowlist(data []byte) (*allowSet, error) {
+	set := &allowSet{hosts: make(map[string]bool)}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.Contains(line, "/") || net.ParseIP(line) != nil {
+			n, err := parseIPNet(line)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", lineno, err.Error())
+			}
+			set.nets = append(set.nets, n)
+			continue
+		}
+		set.hosts[strings.ToLower(line)] = true
+	}
+	return set, scanner.Err()
+}
+
+// allows reports whether the destination ip or host is allowed.
+func (set *allowSet) allows(ip net.IP, host string) bool {
+	for _, n := range set.nets {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "" {
+		return false
+	}
+	if set.hosts[host] {
+		return true
+	}
+	for h := host; ; {
+		i := strings.IndexByte(h, '.')
+		if i < 0 {
+			return false
+		}
+		if set.hosts[h[i:]] {
+			return true
+		}
+		h = h[i+1:]
+	}
+}
+
+// isDestAllowed reports whether the destination of info is on the allowlist,
+// all destinations are allowed if there is no allowlist.
+func (l *Local) isDestAllowed(info *ConnInfo) bool {
+	if l.allowlist == nil {
+		return true
+	}
+	return l.allowlist.set.Load().(*allowSet).allows(info.DestIP, info.Host)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/jedisct1/dlog"
+)
+
+// SetAsnDB load the MaxMind ASN database path, e.g. GeoLite2-ASN.mmdb, to
+// resolve the ASNs of the destinations for the asn matcher of the rules.
+func (l *Local) SetAsnDB(path string) error {
+	l.asnDBPath = path
+	return l.loadAsnDB()
+}
+
+// ReloadAsnDB load the ASN database again, e.g. updated, the new lookups use
+// the new one, and the old one is kept if it fails to load.
+func (l *Local) ReloadAsnDB() error {
+	if l.asnDBPath == "" {
+		return nil
+	}
+	if err := l.loadAsnDB(); err != nil {
+		dlog.Errorf("reload the ASN database %s err: %s, keep the old one", l.asnDBPath, err.Error())
+		return err
+	}
+	dlog.Noticef("reloaded the ASN database %s", l.asnDBPath)
+	return nil
+}
+
+func (l *Local) loadAsnDB() error {
+	db, err := openMmdb(l.asnDBPath)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(db.dbType, "ASN") {
+		dlog.Warnf("the database type of %s is %s, not an ASN database", l.asnDBPath, db.dbType)
+	}
+	l.asnDB.Store(db)
+	return nil
+}
+
+// lookupASN returns the ASN of ip, or 0 if unknown or no ASN database.
+func (l *Local) lookupASN(ip net.IP) uint32 {
+	db, _ := l.asnDB.Load().(*mmdbReader)
+	if db == nil || ip == nil {
+		return 0
+	}
+	v, err := db.lookup(ip)
+	if err != nil {
+		dlog.Errorf("look up the ASN of %s err: %s", ip.String(), err.Error())
+		return 0
+	}
+	record, _ := v.(map[string]interface{})
+	asn, _ := record["autonomous_system_number"].(uint64)
+	return uint32(asn)
+}
+
+// parseASN parse the ASN like "13335" or "AS13335".
+func parseASN(s string) (uint32, error) {
+	asn, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(s), "AS"), 10, 32)
+	if err != nil || asn == 0 {
+		return 0, fmt.Errorf("bad ASN: %s", s)
+	}
+	return uint32(asn), nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/jedisct1/dlog"
+)
+
+// boundDialer dial directly from the local IP address of ips of the family of
+// the destination, or the address chosen by the system if ips is empty. It's
+// the dialer to the proxy of an upstream, or the direct dialer.
+type boundDialer struct {
+	ips      []net.IP
+	forward  *fastOpenDialer
+	fastOpen bool      // dial with TCP Fast Open if enabled, the direct one only with tfo_direct
+	pool     *connPool // idle connections to the proxy, no pool if nil
+}
+
+func (d *boundDialer) Dial(network, addr string) (net.Conn, error) {
+	if d.pool != nil {
+		return d.pool.Dial(network, addr)
+	}
+	return d.dialFrom(network, addr, 0)
+}
+
+// unpooledDialer dial with the boundDialer d without its pool.
+type unpooledDialer struct {
+	d *boundDialer
+}
+
+func (u unpooledDialer) Dial(network, addr string) (net.Conn, error) {
+	return u.d.dialFrom(network, addr, 0)
+}
+
+// dialFrom dial addr from the local port port, any port if 0.
+func (d *boundDialer) dialFrom(network, addr string, port int) (net.Conn, error) {
+	ip := d.localIP(addr)
+	if ip == nil && port == 0 {
+		return d.forward.dialFrom(network, addr, nil, d.fastOpen)
+	}
+	return d.forward.dialFrom(network, addr, &net.TCPAddr{IP: ip, Port: port}, d.fastOpen)
+}
+
+// localIP returns the IP address of d.ips of the family of the destination
+// addr, or the first one if addr is not an IP address or none of the family
+// is there, so the dial fails instead of leaving from another link. It's nil
+// if d.ips is empty.
+func (d *boundDialer) localIP(addr string) net.IP {
+	if len(d.ips) == 0 {
+		return nil
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	if ip := net.ParseIP(host); ip != nil {
+		for _, local := range d.ips {
+			if (local.To4() == nil) == (ip.To4() == nil) {
+				return local
+			}
+		}
+	}
+	return d.ips[0]
+}
+
+// newForwards returns the dialers to the proxies and the direct dialer by
+// upstream name, all dial from the address chosen by the system.
+func newForwards(forward *fastOpenDialer) map[string]*boundDialer {
+	m := make(map[string]*boundDialer)
+	for _, name := range []string{"socks5", "http_proxy", "direct"} {
+		m[name] = &boundDialer{forward: forward, fastOpen: name != "direct"}
+	}
+	return m
+}
+
+// SetUpstreamBind dial the upstreams from the local addresses of binds, like
+// "socks5=192.168.1.2,http_proxy=eth1", the proxies of socks5 and http_proxy
+// are dialed from them, and so are the destinations of direct. An address is
+// an IP address or an interface name, whose first IPv4 and first IPv6
+// addresses are used by the family of the destinations, and they must be
+// bindable.
+func (l *Local) SetUpstreamBind(binds string) error {
+	for _, bind := range strings.Split(binds, ",") {
+		kv := strings.SplitN(bind, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("bad upstream_bind: %s", bind)
+		}
+		name := strings.TrimSpace(kv[0])
+		d, ok := l.forwards[name]
+		if !ok {
+			return fmt.Errorf("unknown upstream in upstream_bind: %s", name)
+		}
+		ips, err := parseBindAddr(strings.TrimSpace(kv[1]))
+		if err != nil {
+			return fmt.Errorf("bad address of %s in upstream_bind: %s", name, err.Error())
+		}
+		var names []string
+		for _, ip := range ips {
+			ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: ip})
+			if err != nil {
+				return fmt.Errorf("can't bind %s for %s: %s", ip, name, err.Error())
+			}
+			ln.Close()
+			names = append(names, ip.String())
+		}
+		d.ips = ips
+		dlog.Infof("dial %s from %s", name, strings.Join(names, ", "))
+	}
+	return nil
+}
+
+// parseBindAddr returns the IP addresses of s, an IP address, or an interface
+// name whose first IPv4 and first IPv6 addresses are returned. The IPv6
+// link-local addresses are skipped, as they can't be bound without the zone.
+func parseBindAddr(s string) ([]net.IP, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	iface, err := net.InterfaceByName(s)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var ip4, ip6 net.IP
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ipnet.IP.To4() != nil {
+			if ip4 == nil {
+				ip4 = ipnet.IP
+			}
+		} else if ip6 == nil && !ipnet.IP.IsLinkLocalUnicast() {
+			ip6 = ipnet.IP
+		}
+	}
+	var ips []net.IP
+	for _, ip := range []net.IP{ip4, ip6} {
+		if ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no address on %s", s)
+	}
+	return ips, nil
+}
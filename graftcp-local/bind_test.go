@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestBoundDialerLocalIP(t *testing.T) {
+	d := &boundDialer{ips: []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")}}
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"198.51.100.1:443", "192.0.2.1"},
+		{"[2001:db8::2]:443", "2001:db8::1"},
+		{"[::ffff:198.51.100.1]:443", "192.0.2.1"},
+		{"example.com:443", "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		if got := d.localIP(tt.addr); got.String() != tt.want {
+			t.Errorf("localIP(%s) = %s, want %s", tt.addr, got, tt.want)
+		}
+	}
+	d.ips = d.ips[:1]
+	if got := d.localIP("[2001:db8::2]:443"); got.String() != "192.0.2.1" {
+		t.Errorf("localIP without IPv6 = %s, want the IPv4 one to fail the dial", got)
+	}
+	if got := (&boundDialer{}).localIP("198.51.100.1:443"); got != nil {
+		t.Errorf("localIP of the unbound dialer = %s, want nil", got)
+	}
+}
+
+func TestUpstreamBindInterface(t *testing.T) {
+	l := newTestLocal()
+	if err := l.SetUpstreamBind("direct=lo"); err != nil {
+		t.Skipf("bind lo: %s", err)
+	}
+	for _, addr := range []string{"127.0.0.1:0", "[::1]:0"} {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Logf("listen %s: %s", addr, err)
+			continue
+		}
+		conn, err := l.forwards["direct"].Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Errorf("dial %s from lo err: %s", ln.Addr(), err)
+		} else {
+			conn.Close()
+		}
+		ln.Close()
+	}
+}
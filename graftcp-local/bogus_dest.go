@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// bogusDestClasses are the classes of the destinations which look bogus, e.g.
+// from the buggy apps.
+var bogusDestClasses = []struct {
+	name  string
+	match func(ip net.IP) bool
+}{
+	{"unspecified", net.IP.IsUnspecified},
+	{"multicast", net.IP.IsMulticast},
+	{"broadcast", func(ip net.IP) bool { return ip.Equal(net.IPv4bcast) }},
+	// 240.0.0.0/4 reserved for future use, except the broadcast address
+	{"reserved", func(ip net.IP) bool {
+		ip4 := ip.To4()
+		return ip4 != nil && ip4[0] >= 240 && !ip4.Equal(net.IPv4bcast)
+	}},
+}
+
+// SetRejectDestClasses reject the connections to the destinations of the
+// classes, a comma separated list of unspecified, multicast, broadcast and
+// reserved.
+func (l *Local) SetRejectDestClasses(classes string) error {
+	m := make(map[string]bool)
+	for _, name := range strings.Split(classes, ",") {
+		name = strings.TrimSpace(name)
+		found := false
+		for _, c := range bogusDestClasses {
+			if c.name == name {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown destination class: %s", name)
+		}
+		m[name] = true
+	}
+	l.rejectDestClasses = m
+	return nil
+}
+
+// bogusDestClass returns the class of ip to be rejected, or "" if it's not.
+func (l *Local) bogusDestClass(ip net.IP) string {
+	if len(l.rejectDestClasses) == 0 || ip == nil {
+		return ""
+	}
+	for _, c := range bogusDestClasses {
+		if l.rejectDestClasses[c.name] && c.match(ip) {
+			return c.name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+const rollingSlots = 60
+
+// rollingCounter sum the counts of the last window, with the granularity of
+// window/rollingSlots.
+type rollingCounter struct {
+	sync.Mutex
+	slot   time.Duration
+	counts [rollingSlots]int64
+	slots  [rollingSlots]int64 // slot number of the counts
+}
+
+func newRollingCounter(window time.Duration) *rollingCounter {
+	slot := window / rollingSlots
+	if slot <= 0 {
+		slot = 1
+	}
+	return &rollingCounter{slot: slot}
+}
+
+func (c *rollingCounter) add(now time.Time, n int64) {
+	s := now.UnixNano() / int64(c.slot)
+	i := s % rollingSlots
+	c.Lock()
+	if c.slots[i] != s {
+		c.slots[i] = s
+		c.counts[i] = 0
+	}
+	c.counts[i] += n
+	c.Unlock()
+}
+
+func (c *rollingCounter) sum(now time.Time) int64 {
+	s := now.UnixNano() / int64(c.slot)
+	var sum int64
+	c.Lock()
+	for i := range c.counts {
+		if c.slots[i] > s-rollingSlots {
+			sum += c.counts[i]
+		}
+	}
+	c.Unlock()
+	return sum
+}
+
+// Budget limit the connections and the bytes of all the connections in a
+// rolling time window. When the budget is exhausted, a warning is logged, and
+// the new connections are rejected if Reject is set.
+type Budget struct {
+	MaxConns int64 // 0 for no limit
+	MaxBytes int64 // 0 for no limit
+	Window   time.Duration
+	Reject   bool
+
+	conns    *rollingCounter
+	bytes    *rollingCounter
+	exceeded int32 // accessed atomically
+}
+
+// NewBudget returns a budget of the window, action is "warn" or "reject".
+func NewBudget(maxConns, maxBytes int64, window time.Duration, action string) (*Budget, error) {
+	if window <= 0 {
+		return nil, fmt.Errorf("bad budget window: %s", window)
+	}
+	b := &Budget{
+		MaxConns: maxConns,
+		MaxBytes: maxBytes,
+		Window:   window,
+		conns:    newRollingCounter(window),
+		bytes:    newRollingCounter(window),
+	}
+	switch action {
+	case "warn":
+	case "reject":
+		b.Reject = true
+	default:
+		return nil, fmt.Errorf("unknown budget action: %s", action)
+	}
+	go b.countBytes()
+	return b, nil
+}
+
+// countBytes count the bytes of all the connections into the budget every
+// second.
+func (b *Budget) countBytes() {
+	last := atomic.LoadInt64(&uploadMeter.total) + atomic.LoadInt64(&downloadMeter.total)
+	for now := range time.Tick(time.Second) {
+		total := atomic.LoadInt64(&uploadMeter.total) + atomic.LoadInt64(&downloadMeter.total)
+		b.bytes.add(now, total-last)
+		last = total
+	}
+}
+
+// Allow count a new connection, returns false if the budget is exhausted
+// and the connection should be rejected.
+func (b *Budget) Allow() bool {
+	now := time.Now()
+	conns, bytes := b.conns.sum(now), b.bytes.sum(now)
+	if (b.MaxConns > 0 && conns >= b.MaxConns) || (b.MaxBytes > 0 && bytes >= b.MaxBytes) {
+		if atomic.CompareAndSwapInt32(&b.exceeded, 0, 1) {
+			dlog.Warnf("budget exhausted: %d connections, %d bytes in the last %s", conns, bytes, b.Window)
+		}
+		if b.Reject {
+			return false
+		}
+	} else {
+		atomic.StoreInt32(&b.exceeded, 0)
+	}
+	b.conns.add(now, 1)
+	return true
+}
+
+// BudgetStatus is the status of the budget, the remaining is -1 if there is no
+// limit.
+type BudgetStatus struct {
+	Window         string `json:"window"`
+	Conns          int64  `json:"conns"`
+	Bytes          int64  `json:"bytes"`
+	ConnsRemaining int64  `json:"conns_remaining"`
+	BytesRemaining int64  `json:"bytes_remaining"`
+}
+
+// Status returns the status of b.
+func (b *Budget) Status() *BudgetStatus {
+	now := time.Now()
+	s := &BudgetStatus{
+		Window:         b.Window.String(),
+		Conns:          b.conns.sum(now),
+		Bytes:          b.bytes.sum(now),
+		ConnsRemaining: -1,
+		BytesRemaining: -1,
+	}
+	if b.MaxConns > 0 {
+		s.ConnsRemaining = remaining(b.MaxConns, s.Conns)
+	}
+	if b.MaxBytes > 0 {
+		s.BytesRemaining = remaining(b.MaxBytes, s.Bytes)
+	}
+	return s
+}
+
+func remaining(max, used int64) int64 {
+	if used >= max {
+		return 0
+	}
+	return max - used
+}
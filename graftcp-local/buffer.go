@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io"
+	"net"
+)
+
+const (
+	pipeBufMin       = 2 << 10  // initial size of the copy buffers
+	pipeBufMax       = 32 << 10 // as the buffer of io.Copy
+	pipeBufGrowAfter = 4        // consecutive full reads to double a buffer
+
+	// pipeSpliceChunk is the max bytes spliced by the kernel between the
+	// calls of counted, so the bytes are counted while the data flows.
+	pipeSpliceChunk = 64 << 10
+)
+
+// copyAdaptive copy from src to dst until EOF like io.Copy, and call counted
+// with the bytes written each time. The buffer starts small, and is doubled
+// up to pipeBufMax after pipeBufGrowAfter consecutive reads fill it. So the
+// many idle and low rate connections hold little memory, and the ones
+// sustaining high throughput get the large buffers. If src and dst are the
+// connections the kernel copies between by the ReadFrom of dst, e.g. splice(2)
+// of TCP, it's done so with no buffer instead.
+func copyAdaptive(dst io.Writer, src io.Reader, counted func(n int64)) (written int64, err error) {
+	if rf, ok := dst.(io.ReaderFrom); ok && isSpliceable(src) {
+		return copySplice(rf, src, counted)
+	}
+	buf := make([]byte, pipeBufMin)
+	full := 0
+	for {
+		nr, er := src.Read(buf)
+		if nr > 0 {
+			nw, ew := dst.Write(buf[:nr])
+			if nw > 0 {
+				written += int64(nw)
+				counted(int64(nw))
+			}
+			if ew != nil {
+				return written, ew
+			}
+			if nw != nr {
+				return written, io.ErrShortWrite
+			}
+		}
+		if er != nil {
+			if er != io.EOF {
+				err = er
+			}
+			return written, err
+		}
+		if nr < len(buf) || len(buf) >= pipeBufMax {
+			full = 0
+			continue
+		}
+		if full++; full >= pipeBufGrowAfter {
+			buf = make([]byte, 2*len(buf))
+			full = 0
+		}
+	}
+}
+
+// isSpliceable reports whether the kernel may copy from r without a buffer.
+func isSpliceable(r io.Reader) bool {
+	switch r.(type) {
+	case *net.TCPConn, *net.UnixConn:
+		return true
+	}
+	return false
+}
+
+// copySplice copy from src to dst by dst.ReadFrom in the chunks of
+// pipeSpliceChunk, which keeps its fast path, as it's taken for an
+// *io.LimitedReader of the connection too.
+func copySplice(dst io.ReaderFrom, src io.Reader, counted func(n int64)) (written int64, err error) {
+	for {
+		n, err := dst.ReadFrom(&io.LimitedReader{R: src, N: pipeSpliceChunk})
+		if n > 0 {
+			written += n
+			counted(n)
+		}
+		if err != nil || n < pipeSpliceChunk {
+			return written, err
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+// writerOnly hides the ReadFrom of ioutil.Discard, as a connection does.
+type writerOnly struct {
+	io.Writer
+}
+
+// benchmarkIdleConns report the heap held by the copies of 10k idle
+// connections, each has passed a byte and waits for more.
+func benchmarkIdleConns(b *testing.B, copyFn func(dst io.Writer, src io.Reader)) {
+	const n = 10000
+	for i := 0; i < b.N; i++ {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		var wg sync.WaitGroup
+		peers := make([]net.Conn, 0, n)
+		for j := 0; j < n; j++ {
+			src, peer := net.Pipe()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				copyFn(writerOnly{ioutil.Discard}, src)
+			}()
+			// returns once the copy has read it with its buffer
+			peer.Write([]byte{0})
+			peers = append(peers, peer)
+		}
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		b.ReportMetric(float64(after.HeapInuse-before.HeapInuse)/n, "heap-B/conn")
+		for _, peer := range peers {
+			peer.Close()
+		}
+		wg.Wait()
+	}
+}
+
+func BenchmarkIdleConnsAdaptive(b *testing.B) {
+	benchmarkIdleConns(b, func(dst io.Writer, src io.Reader) {
+		copyAdaptive(dst, src, func(int64) {})
+	})
+}
+
+func BenchmarkIdleConnsFixed(b *testing.B) {
+	benchmarkIdleConns(b, func(dst io.Writer, src io.Reader) {
+		io.CopyBuffer(dst, src, make([]byte, pipeBufMax))
+	})
+}
+
+func TestCopyAdaptive(t *testing.T) {
+	data := make([]byte, 1<<20)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	src, peer := net.Pipe()
+	go func() {
+		peer.Write(data)
+		peer.Close()
+	}()
+	var counted int64
+	var got writerBuffer
+	n, err := copyAdaptive(&got, src, func(n int64) { counted += n })
+	if err != nil || n != int64(len(data)) || counted != n {
+		t.Fatalf("copyAdaptive = %d, %v, counted %d, want %d", n, err, counted, len(data))
+	}
+	if string(got.b) != string(data) {
+		t.Error("copyAdaptive copied the data wrong")
+	}
+}
+
+func TestCopyAdaptiveSplice(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	const size = 3*pipeSpliceChunk + 100
+	go func() {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return
+		}
+		c.Write(make([]byte, size))
+		c.Close()
+	}()
+	src, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	dstLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dstLn.Close()
+	received := make(chan int64)
+	go func() {
+		c, err := dstLn.Accept()
+		if err != nil {
+			received <- -1
+			return
+		}
+		n, _ := io.Copy(ioutil.Discard, c)
+		c.Close()
+		received <- n
+	}()
+	dst, err := net.Dial("tcp", dstLn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var calls int
+	var counted int64
+	n, err := copyAdaptive(dst, src, func(n int64) {
+		calls++
+		counted += n
+	})
+	dst.Close()
+	if err != nil || n != size || counted != size {
+		t.Fatalf("copyAdaptive = %d, %v, counted %d, want %d", n, err, counted, size)
+	}
+	if calls < 4 {
+		t.Errorf("counted %d times, want at least one per chunk", calls)
+	}
+	if got := <-received; got != size {
+		t.Errorf("received %d, want %d", got, size)
+	}
+}
+
+// writerBuffer is a writer without ReadFrom, so copyAdaptive uses its buffer.
+type writerBuffer struct {
+	b []byte
+}
+
+func (w *writerBuffer) Write(p []byte) (int, error) {
+	w.b = append(w.b, p...)
+	return len(p), nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+// SetCapture capture the raw traffic of the connections to dests into the
+// files in dir, dests is in format like "203.0.113.0/24,example.com".
+func (l *Local) SetCapture(dests, dir string) error {
+	nets, err := parseDestList(dests)
+	if err != nil {
+		return fmt.Errorf("bad capture_dest: %s", err.Error())
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	l.captureNets, l.captureDir = nets, dir
+	return nil
+}
+
+var captureNameReplacer = strings.NewReplacer("[", "", "]", "", ":", "_")
+
+// openCapture create the capture files of the connection c for both
+// directions, named like "20060102T150405.000-<pid>-<dest>-up.raw", returns
+// nils if c is not captured.
+func (l *Local) openCapture(c *ConnInfo) (up, down *captureFile) {
+	if !ipInNets(c.DestIP, l.captureNets) {
+		return nil, nil
+	}
+	prefix := fmt.Sprintf("%s-%s-%s", time.Now().Format("20060102T150405.000"),
+		c.Pid, captureNameReplacer.Replace(c.DestAddr))
+	up, err := newCaptureFile(filepath.Join(l.captureDir, prefix+"-up.raw"))
+	if err != nil {
+		dlog.Errorf("create the capture file err: %s", err.Error())
+		return nil, nil
+	}
+	down, err = newCaptureFile(filepath.Join(l.captureDir, prefix+"-down.raw"))
+	if err != nil {
+		dlog.Errorf("create the capture file err: %s", err.Error())
+		up.Close()
+		return nil, nil
+	}
+	return up, down
+}
+
+// captureFile is the file capturing a direction of a connection, the errors
+// of writing are logged once and ignored, so the connection is not affected.
+type captureFile struct {
+	*os.File
+	failed bool
+}
+
+func newCaptureFile(path string) (*captureFile, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &captureFile{File: f}, nil
+}
+
+func (f *captureFile) Write(p []byte) (int, error) {
+	if !f.failed {
+		if _, err := f.File.Write(p); err != nil {
+			dlog.Errorf("write the capture file %s err: %s", f.Name(), err.Error())
+			f.failed = true
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"compress/flate"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/proxy"
+)
+
+// SetCompressUpstreams compress the connections to the upstreams, a comma
+// separated list of socks5 and http_proxy. The upstreams must decompress the
+// streams in the raw DEFLATE format (RFC 1951) after the proxy handshake, and
+// compress the streams back in the same format. The direct connections are
+// never compressed, as the destinations can't decompress them.
+func (l *Local) SetCompressUpstreams(upstreams string) error {
+	m := make(map[string]bool)
+	for _, name := range strings.Split(upstreams, ",") {
+		name = strings.TrimSpace(name)
+		if name == "direct" {
+			return fmt.Errorf("the direct connections can't be compressed")
+		}
+		if name != "socks5" && name != "http_proxy" {
+			return fmt.Errorf("unknown upstream to compress: %s", name)
+		}
+		m[name] = true
+	}
+	l.compressUpstreams = m
+	return nil
+}
+
+// compressedDialer compress the connections dialed by Dialer.
+type compressedDialer struct {
+	proxy.Dialer
+}
+
+func (d compressedDialer) Dial(network, addr string) (net.Conn, error) {
+	conn, err := d.Dialer.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	w, _ := flate.NewWriter(conn, flate.BestSpeed)
+	return &flateConn{Conn: conn, r: flate.NewReader(conn), w: w}, nil
+}
+
+// flateConn is a connection compressed in the raw DEFLATE format, the data
+// written is flushed at once to keep the latency.
+type flateConn struct {
+	net.Conn
+	r io.ReadCloser
+
+	wmu sync.Mutex
+	w   *flate.Writer
+}
+
+func (c *flateConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *flateConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	n, err := c.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, c.w.Flush()
+}
+
+func (c *flateConn) Close() error {
+	c.wmu.Lock()
+	c.w.Close()
+	c.wmu.Unlock()
+	c.r.Close()
+	return c.Conn.Close()
+}
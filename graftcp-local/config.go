@@ -8,54 +8,441 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/jedisct1/dlog"
 )
 
 type Config struct {
-	Listen          string // Listen address
-	Logfile         string // Write logs to file
-	Loglevel        int    // Log level (0-6)
-	PipePath        string // Pipe path for graftcp to send address info
-	Socks5          string // SOCKS5 address
-	Socks5Username  string // SOCKS5 proxy username
-	Socks5Password  string // SOCKS5 proxy password
-	HttpProxy       string // HTTP proxy address
-	UseSyslog       bool   // Use the system logger
-	SelectProxyMode string // Set the mode for select a proxy (auto, random, only_http_proxy, only_socks5)
+	Listen             string        // Listen address
+	ReusePort          bool          // Share the listen address with another graftcp-local with SO_REUSEPORT
+	Logfile            string        // Write logs to file
+	Loglevel           int           // Log level (0-6)
+	PipePath           string        // Pipe path for graftcp to send address info
+	FifoWait           time.Duration // Retry opening the pipe at startup until it passes
+	AddrInfoListen     string        // Listen address for graftcp to send address info
+	Socks5             string        // SOCKS5 address
+	Socks5Username     string        // SOCKS5 proxy username
+	Socks5Password     string        // SOCKS5 proxy password
+	Socks5UserTemplate string        // SOCKS5 proxy username template evaluated for each connection
+	HttpProxy          string        // HTTP proxy address
+	HttpProxyHeaders   []string      // Extra headers of the CONNECT request to the HTTP proxy
+	HttpProcessHeader  string        // Header of the CONNECT request to the HTTP proxy telling the process
+	UseSyslog          bool          // Use the system logger
+	SelectProxyMode    string        // Set the mode for select a proxy (auto, random, hash, only_http_proxy, only_socks5)
+	HashKey            string        // Key of the hash mode (pid, source)
+	HttpProxyPoolSize  int           // Keep up to the number of the idle connections to the HTTP proxy
+	HttpProxyPoolIdle  time.Duration // Close the idle connections to the HTTP proxy in the pool after it
+	WarmPool           string        // Keep the number of the idle connections to each upstream proxy
+	WarmPoolIdle       time.Duration // Close the idle connections to the upstream proxies in warm_pool after it
+	ProxyList          string        // URL or file of the proxy list used instead of socks5 and http_proxy
+	ProxyListInterval  time.Duration // Fetch the proxy list again every interval
+	ProxyProbe         string        // Probe the protocol spoken by the proxies, and what to do if mismatched
+	SelectModeIPv4     string        // Mode of the IPv4 destinations instead of select_proxy_mode
+	SelectModeIPv6     string        // Mode of the IPv6 destinations instead of select_proxy_mode
+	DscpModes          string        // Modes by the DSCP of the connections instead of the other default modes
+	Schedule           string        // Modes by the time of the day
+	ScheduleTimezone   string        // Time zone of the schedule
+	RandSeed           int64         // Seed of the random selection, 0 to seed with the current time
+	Failover           string        // Failover chain of the auto mode
+	PrimaryBackup      string        // Primary and backup upstream of the auto mode
+	HealthInterval     time.Duration // Interval of the health checks of the primary upstream
+	HealthWebhook      string        // URL to post the health transitions of the primary upstream to
+	DirectLocalPort    string        // Local port or port range for direct connections
+	UpstreamBind       string        // Local addresses to dial the upstreams from
+	UpstreamNetwork    string        // Networks to reach the proxies of the upstreams
+	UpstreamMaxConns   string        // Max concurrent connections of the upstreams
+	AllowPorts         string        // Only allow connecting to these destination ports
+	DenyPorts          string        // Deny connecting to these destination ports
+	Allowlist          string        // File of the destinations allowed to connect
+	AllowlistInterval  time.Duration // Check the allowlist file every interval
+	RejectDestClasses  string        // Reject the connections to the destinations of these classes
+	RuleFile           string        // Path to the rule file
+	AsnDB              string        // Path to the MaxMind ASN database for the asn matcher of the rules
+	PtrWait            time.Duration // Wait for the PTR lookup of the destination up to the duration
+	PtrCacheTTL        time.Duration // Cache the PTR names of the destinations for the duration
+	InboundSecret      string        // Shared secret the inbound connections must present
+	ProxyDestAction    string        // What to do with the connections to the socks5 or the HTTP proxy
+	HairpinPolicy      string        // Set how to handle the connections to the local host
+	DialTimeout        time.Duration // Timeout of dialing the destination
+	SetupTimeout       time.Duration // Timeout of the whole setup of a connection
+	DialRetry          int           // Retry times if dialing the destination fails
+	FailCacheTTL       time.Duration // Fail the connections to the destinations failed to dial within it fast
+	UploadRate         string        // Per connection rate limit from the app to the destination
+	DownloadRate       string        // Per connection rate limit from the destination to the app
+	TotalUploadRate    string        // Rate limit from the apps to the destinations shared by all connections
+	TotalDownloadRate  string        // Rate limit from the destinations to the apps shared by all connections
+	PidCheckInterval   time.Duration // Close the connection if its process exits, checking every interval
+	CompressUpstream   string        // Compress the connections to these upstreams
+	FastOpen           bool          // Dial the proxies with TCP Fast Open
+	FastOpenDirect     bool          // Dial the direct connections with TCP Fast Open too
+	OutboundDscp       string        // DSCP of the connections to the proxies and the direct connections
+	NoDelay            string        // Set TCP_NODELAY on both sides of the connection, "true" or "false"
+	KeepAliveIdle      time.Duration // Send the TCP keepalive probes only after the connection has been idle for the duration
+	Transparent        bool          // Dial directly from the source IP address of the connection with IP_TRANSPARENT
+	StrictProxy        bool          // Never fall back to direct, and pass the host names to the proxies
+	TeardownGrace      time.Duration // Wait for the other direction of the connection to finish until the grace period
+	ReadTimeout        string        // Read timeouts of the directions of the connections
+	WriteTimeout       string        // Write timeouts of the directions of the connections
+	BudgetConns        int           // Budget of the connections in the budget window
+	BudgetBytes        string        // Budget of the bytes in the budget window
+	BudgetWindow       time.Duration // Rolling time window of the budget
+	BudgetAction       string        // What to do when the budget is exhausted (warn, reject)
+	Socks5Listen       string        // Listen address of the SOCKS5 front-end
+	HttpProxyListen    string        // Listen address of the HTTP proxy front-end
+	DnsListen          string        // Listen address of the DNS forwarder over TCP
+	DnsUpstream        string        // Address of the DNS server the DNS forwarder forwards the queries to
+	HostCacheTTL       time.Duration // Remember the rules matched by the host name requested to the front-ends
+	Honeypot           string        // Address of the honeypot the connections of mode honeypot are redirected to
+	DirectFallbackDest string        // Only allow the connections to these destinations to fall back to direct
+	AffinityTTL        time.Duration // Pin the upstream of the auto and random modes by the destination
+	WeightRecovery     time.Duration // Half-life of the weights of the random mode to recover
+	ControlListen      string        // Listen address of the control server
+	ControlSocketMode  string        // Permissions of the Unix socket of the control server
+	MetricsPorts       string        // Destination ports counted on their own in the metrics
+	SyslogAddr         string        // Address of the syslog server, local if empty
+	SyslogFacility     string        // Facility of the logs sent to syslog
+	OtlpEndpoint       string        // OpenTelemetry OTLP/HTTP endpoint
+	NatsURL            string        // URL of the NATS server to publish the connection events
+	NatsSubject        string        // NATS subject of the connection events
+	PidAddrTTL         time.Duration // TTL of the address info sent by graftcp
+	PidAddrMax         int           // Max number of the address info sent by graftcp not used yet
+	DrainTimeout       time.Duration // Wait for the active connections to be closed until the timeout when stopping
+	AcceptRate         int           // Limit the rate of accepting the connections per second
+	AcceptRateAction   string        // What to do with the connections beyond the accept rate (wait, reject)
+	MaxPending         int           // Max number of the connections accepted but not dialed yet, the new ones are shed beyond it
+	StatsFile          string        // Write the stats of the upstreams in JSON format to the file when stopping
+	RecordFile         string        // Record the address info and the connection events to the file
+	AccessLog          string        // Write a record in JSON per line for each connection to the file
+	AccessLogInterval  time.Duration // Write the interim records of the open connections every interval
+	DebugDest          string        // Log the connections to these destinations in detail
+	CaptureDest        string        // Capture the traffic of the connections to these destinations
+	CaptureDir         string        // Directory of the capture files
 }
 
-var Cfg = &Config{Loglevel: -1}
+// config is the *Config loaded from the config file, replaced as a whole
+// when it's reloaded.
+var config atomic.Value
 
-func setCfg(key, val string) {
+// currentConfig returns the config loaded, or the unset one if none.
+func currentConfig() *Config {
+	if cfg, ok := config.Load().(*Config); ok {
+		return cfg
+	}
+	return newConfig()
+}
+
+// newConfig returns the config with the numbers and durations unset.
+func newConfig() *Config {
+	return &Config{Loglevel: -1, PidAddrTTL: -1, PidAddrMax: -1, DialTimeout: -1, DialRetry: -1, PidCheckInterval: -1,
+		BudgetConns: -1, BudgetWindow: -1, DrainTimeout: -1, AcceptRate: -1, MaxPending: -1, ProxyListInterval: -1,
+		KeepAliveIdle: -1, TeardownGrace: -1, HostCacheTTL: -1, AccessLogInterval: -1, AffinityTTL: -1,
+		HttpProxyPoolSize: -1, HttpProxyPoolIdle: -1, WarmPoolIdle: -1, WeightRecovery: -1, FailCacheTTL: -1,
+		FifoWait: -1, SetupTimeout: -1, AllowlistInterval: -1, PtrWait: -1, PtrCacheTTL: -1}
+}
+
+func setCfg(cfg *Config, key, val string) {
 	switch strings.ToLower(key) {
 	case "listen":
-		Cfg.Listen = val
+		cfg.Listen = val
+	case "reuseport":
+		cfg.ReusePort = strings.ToLower(val) == "true"
 	case "logfile":
-		Cfg.Logfile = val
+		cfg.Logfile = val
 	case "loglevel":
 		loglevel, err := strconv.Atoi(val)
 		if err == nil {
-			Cfg.Loglevel = loglevel
+			cfg.Loglevel = loglevel
 		}
 	case "pipepath":
-		Cfg.PipePath = val
+		cfg.PipePath = val
+	case "fifo_wait":
+		wait, err := time.ParseDuration(val)
+		if err == nil {
+			cfg.FifoWait = wait
+		}
+	case "addr_info_listen":
+		cfg.AddrInfoListen = val
 	case "socks5":
-		Cfg.Socks5 = val
+		cfg.Socks5 = val
 	case "socks5_username":
-		Cfg.Socks5Username = val
+		cfg.Socks5Username = val
 	case "socks5_password":
-		Cfg.Socks5Password = val
+		cfg.Socks5Password = val
+	case "socks5_username_template":
+		cfg.Socks5UserTemplate = val
 	case "http_proxy":
-		Cfg.HttpProxy = val
-	case "usesyslog":
+		cfg.HttpProxy = val
+	case "http_proxy_header":
+		cfg.HttpProxyHeaders = append(cfg.HttpProxyHeaders, val)
+	case "http_proxy_process_header":
+		cfg.HttpProcessHeader = val
+	case "http_proxy_pool_size":
+		size, err := strconv.Atoi(val)
+		if err == nil {
+			cfg.HttpProxyPoolSize = size
+		}
+	case "http_proxy_pool_idle":
+		idle, err := time.ParseDuration(val)
+		if err == nil {
+			cfg.HttpProxyPoolIdle = idle
+		}
+	case "warm_pool":
+		cfg.WarmPool = val
+	case "warm_pool_idle":
+		idle, err := time.ParseDuration(val)
+		if err == nil {
+			cfg.WarmPoolIdle = idle
+		}
+	case "usesyslog", "use_syslog":
 		if strings.ToLower(val) == "true" {
-			Cfg.UseSyslog = true
+			cfg.UseSyslog = true
 		} else {
-			Cfg.UseSyslog = false
+			cfg.UseSyslog = false
 		}
+	case "syslog_addr":
+		cfg.SyslogAddr = val
+	case "syslog_facility":
+		cfg.SyslogFacility = val
+	case "proxy_list":
+		cfg.ProxyList = val
+	case "proxy_list_interval":
+		interval, err := time.ParseDuration(val)
+		if err == nil {
+			cfg.ProxyListInterval = interval
+		}
+	case "proxy_probe":
+		cfg.ProxyProbe = val
 	case "select_proxy_mode":
-		Cfg.SelectProxyMode = val
+		cfg.SelectProxyMode = val
+	case "schedule":
+		cfg.Schedule = val
+	case "select_proxy_mode_ipv4":
+		cfg.SelectModeIPv4 = val
+	case "select_proxy_mode_ipv6":
+		cfg.SelectModeIPv6 = val
+	case "dscp_modes":
+		cfg.DscpModes = val
+	case "schedule_timezone":
+		cfg.ScheduleTimezone = val
+	case "rand_seed":
+		seed, err := strconv.ParseInt(val, 10, 64)
+		if err == nil {
+			cfg.RandSeed = seed
+		}
+	case "hash_key":
+		cfg.HashKey = val
+	case "failover":
+		cfg.Failover = val
+	case "primary_backup":
+		cfg.PrimaryBackup = val
+	case "health_check_interval":
+		interval, err := time.ParseDuration(val)
+		if err == nil {
+			cfg.HealthInterval = interval
+		}
+	case "health_webhook":
+		cfg.HealthWebhook = val
+	case "direct_local_port":
+		cfg.DirectLocalPort = val
+	case "upstream_bind":
+		cfg.UpstreamBind = val
+	case "upstream_network":
+		cfg.UpstreamNetwork = val
+	case "upstream_max_conns":
+		cfg.UpstreamMaxConns = val
+	case "allow_ports":
+		cfg.AllowPorts = val
+	case "deny_ports":
+		cfg.DenyPorts = val
+	case "allowlist":
+		cfg.Allowlist = val
+	case "allowlist_interval":
+		interval, err := time.ParseDuration(val)
+		if err == nil {
+			cfg.AllowlistInterval = interval
+		}
+	case "reject_dest_classes":
+		cfg.RejectDestClasses = val
+	case "rule_file":
+		cfg.RuleFile = val
+	case "asn_db":
+		cfg.AsnDB = val
+	case "ptr_wait":
+		wait, err := time.ParseDuration(val)
+		if err == nil {
+			cfg.PtrWait = wait
+		}
+	case "ptr_cache_ttl":
+		ttl, err := time.ParseDuration(val)
+		if err == nil {
+			cfg.PtrCacheTTL = ttl
+		}
+	case "dial_timeout":
+		timeout, err := time.ParseDuration(val)
+		if err == nil {
+			cfg.DialTimeout = timeout
+		}
+	case "setup_timeout":
+		timeout, err := time.ParseDuration(val)
+		if err == nil {
+			cfg.SetupTimeout = timeout
+		}
+	case "dial_retry":
+		retry, err := strconv.Atoi(val)
+		if err == nil {
+			cfg.DialRetry = retry
+		}
+	case "fail_cache_ttl":
+		ttl, err := time.ParseDuration(val)
+		if err == nil {
+			cfg.FailCacheTTL = ttl
+		}
+	case "upload_rate":
+		cfg.UploadRate = val
+	case "download_rate":
+		cfg.DownloadRate = val
+	case "total_upload_rate":
+		cfg.TotalUploadRate = val
+	case "total_download_rate":
+		cfg.TotalDownloadRate = val
+	case "pid_check_interval":
+		interval, err := time.ParseDuration(val)
+		if err == nil {
+			cfg.PidCheckInterval = interval
+		}
+	case "transparent":
+		cfg.Transparent = strings.ToLower(val) == "true"
+	case "strict_proxy":
+		cfg.StrictProxy = strings.ToLower(val) == "true"
+	case "compress_upstream":
+		cfg.CompressUpstream = val
+	case "tfo":
+		cfg.FastOpen = strings.ToLower(val) == "true"
+	case "tfo_direct":
+		cfg.FastOpenDirect = strings.ToLower(val) == "true"
+	case "outbound_dscp":
+		cfg.OutboundDscp = val
+	case "nodelay":
+		cfg.NoDelay = strings.ToLower(val)
+	case "teardown_grace":
+		grace, err := time.ParseDuration(val)
+		if err == nil {
+			cfg.TeardownGrace = grace
+		}
+	case "read_timeout":
+		cfg.ReadTimeout = val
+	case "write_timeout":
+		cfg.WriteTimeout = val
+	case "keepalive_idle":
+		idle, err := time.ParseDuration(val)
+		if err == nil {
+			cfg.KeepAliveIdle = idle
+		}
+	case "budget_conns":
+		conns, err := strconv.Atoi(val)
+		if err == nil {
+			cfg.BudgetConns = conns
+		}
+	case "accept_rate":
+		rate, err := strconv.Atoi(val)
+		if err == nil {
+			cfg.AcceptRate = rate
+		}
+	case "accept_rate_action":
+		cfg.AcceptRateAction = val
+	case "max_pending":
+		max, err := strconv.Atoi(val)
+		if err == nil {
+			cfg.MaxPending = max
+		}
+	case "budget_bytes":
+		cfg.BudgetBytes = val
+	case "budget_window":
+		window, err := time.ParseDuration(val)
+		if err == nil {
+			cfg.BudgetWindow = window
+		}
+	case "budget_action":
+		cfg.BudgetAction = val
+	case "inbound_secret":
+		cfg.InboundSecret = val
+	case "proxy_dest_action":
+		cfg.ProxyDestAction = val
+	case "hairpin_policy":
+		cfg.HairpinPolicy = val
+	case "socks5_listen":
+		cfg.Socks5Listen = val
+	case "http_proxy_listen":
+		cfg.HttpProxyListen = val
+	case "dns_listen":
+		cfg.DnsListen = val
+	case "dns_upstream":
+		cfg.DnsUpstream = val
+	case "host_cache_ttl":
+		ttl, err := time.ParseDuration(val)
+		if err == nil {
+			cfg.HostCacheTTL = ttl
+		}
+	case "honeypot":
+		cfg.Honeypot = val
+	case "direct_fallback_dest":
+		cfg.DirectFallbackDest = val
+	case "affinity_ttl":
+		ttl, err := time.ParseDuration(val)
+		if err == nil {
+			cfg.AffinityTTL = ttl
+		}
+	case "weight_recovery":
+		halfLife, err := time.ParseDuration(val)
+		if err == nil {
+			cfg.WeightRecovery = halfLife
+		}
+	case "control_listen":
+		cfg.ControlListen = val
+	case "control_socket_mode":
+		cfg.ControlSocketMode = val
+	case "metrics_ports":
+		cfg.MetricsPorts = val
+	case "otlp_endpoint":
+		cfg.OtlpEndpoint = val
+	case "nats_url":
+		cfg.NatsURL = val
+	case "nats_subject":
+		cfg.NatsSubject = val
+	case "drain_timeout":
+		timeout, err := time.ParseDuration(val)
+		if err == nil {
+			cfg.DrainTimeout = timeout
+		}
+	case "debug_dest":
+		cfg.DebugDest = val
+	case "capture_dest":
+		cfg.CaptureDest = val
+	case "capture_dir":
+		cfg.CaptureDir = val
+	case "stats_file":
+		cfg.StatsFile = val
+	case "record_file":
+		cfg.RecordFile = val
+	case "access_log":
+		cfg.AccessLog = val
+	case "access_log_interval":
+		interval, err := time.ParseDuration(val)
+		if err == nil {
+			cfg.AccessLogInterval = interval
+		}
+	case "pidaddr_ttl":
+		ttl, err := time.ParseDuration(val)
+		if err == nil {
+			cfg.PidAddrTTL = ttl
+		}
+	case "pidaddr_max":
+		max, err := strconv.Atoi(val)
+		if err == nil {
+			cfg.PidAddrMax = max
+		}
 	}
 }
 
@@ -80,6 +467,17 @@ func ParseConfigFile(path string, app *App) error {
 		}
 	}
 
+	if err := loadConfigFile(path); err != nil {
+		return err
+	}
+	app.configPath = path
+	overrideConfig(app)
+	return nil
+}
+
+// loadConfigFile load the config file at path into a new config, and
+// replace the current one with it, the current one is kept if it fails.
+func loadConfigFile(path string) error {
 	file, err := os.Open(path)
 	if err != nil {
 		dlog.Errorf("os.Open(%s) err: %s", path, err.Error())
@@ -87,54 +485,346 @@ func ParseConfigFile(path string, app *App) error {
 	}
 	defer file.Close()
 
+	cfg := newConfig()
 	reader := bufio.NewReader(file)
 	for {
 		line, err := reader.ReadString('\n')
 		if err != nil {
 			if err == io.EOF {
-				setCfg(parseLine(line))
+				key, val := parseLine(line)
+				setCfg(cfg, key, val)
 				break
 			}
 			dlog.Errorf("reader.ReadString('\\n') err: %s, path: %s", err.Error(), path)
 			return err
 		}
-		setCfg(parseLine(line))
+		key, val := parseLine(line)
+		setCfg(cfg, key, val)
 	}
-	overrideConfig(app)
+	config.Store(cfg)
 	return nil
 }
 
-func overrideConfig(app *App) {
+// flagsSet returns the names of the flags set on the command line.
+func flagsSet() map[string]bool {
 	flagset := make(map[string]bool)
 	flag.Visit(func(f *flag.Flag) { flagset[f.Name] = true })
-	if !flagset["listen"] && Cfg.Listen != "" {
-		app.ListenAddr = Cfg.Listen
+	return flagset
+}
+
+func overrideConfig(app *App) {
+	cfg := currentConfig()
+	flagset := flagsSet()
+	if !flagset["listen"] && cfg.Listen != "" {
+		app.ListenAddr = cfg.Listen
+	}
+	if !flagset["reuseport"] && cfg.ReusePort {
+		app.ReusePort = true
 	}
-	if !flagset["socks5"] && Cfg.Socks5 != "" {
-		app.Socks5Addr = Cfg.Socks5
+	if !flagset["socks5"] && cfg.Socks5 != "" {
+		app.Socks5Addr = cfg.Socks5
 	}
-	if !flagset["socks5_username"] && Cfg.Socks5Username != "" {
-		app.Socks5Username = Cfg.Socks5Username
+	if !flagset["socks5_username"] && cfg.Socks5Username != "" {
+		app.Socks5Username = cfg.Socks5Username
 	}
-	if !flagset["socks5_password"] && Cfg.Socks5Password != "" {
-		app.Socks5Password = Cfg.Socks5Password
+	if !flagset["socks5_password"] && cfg.Socks5Password != "" {
+		app.Socks5Password = cfg.Socks5Password
 	}
-	if !flagset["http_proxy"] && Cfg.HttpProxy != "" {
-		app.HttpProxyAddr = Cfg.HttpProxy
+	if !flagset["socks5_username_template"] && cfg.Socks5UserTemplate != "" {
+		app.Socks5UserTemplate = cfg.Socks5UserTemplate
 	}
-	if !flagset["pipepath"] && Cfg.PipePath != "" {
-		app.PipePath = Cfg.PipePath
+	if !flagset["http_proxy"] && cfg.HttpProxy != "" {
+		app.HttpProxyAddr = cfg.HttpProxy
 	}
-	if !flagset["logfile"] && Cfg.Logfile != "" {
-		dlog.UseLogFile(Cfg.Logfile)
+	if !flagset["http_proxy_header"] && len(cfg.HttpProxyHeaders) > 0 {
+		app.HttpProxyHeaders = cfg.HttpProxyHeaders
 	}
-	if !flagset["loglevel"] && Cfg.Loglevel >= 0 && Cfg.Loglevel <= 6 {
-		dlog.SetLogLevel(dlog.Severity(Cfg.Loglevel))
+	if !flagset["http_proxy_process_header"] && cfg.HttpProcessHeader != "" {
+		app.HttpProcessHeader = cfg.HttpProcessHeader
+	}
+	if !flagset["http_proxy_pool_size"] && cfg.HttpProxyPoolSize >= 0 {
+		app.HttpProxyPoolSize = cfg.HttpProxyPoolSize
+	}
+	if !flagset["http_proxy_pool_idle"] && cfg.HttpProxyPoolIdle >= 0 {
+		app.HttpProxyPoolIdle = cfg.HttpProxyPoolIdle
+	}
+	if !flagset["warm_pool"] && cfg.WarmPool != "" {
+		app.WarmPool = cfg.WarmPool
+	}
+	if !flagset["warm_pool_idle"] && cfg.WarmPoolIdle >= 0 {
+		app.WarmPoolIdle = cfg.WarmPoolIdle
+	}
+	if !flagset["pipepath"] && cfg.PipePath != "" {
+		app.PipePath = cfg.PipePath
+	}
+	if !flagset["fifo_wait"] && cfg.FifoWait >= 0 {
+		app.FifoWait = cfg.FifoWait
+	}
+	if !flagset["addr_info_listen"] && cfg.AddrInfoListen != "" {
+		app.AddrInfoListen = cfg.AddrInfoListen
+	}
+	if !flagset["logfile"] && cfg.Logfile != "" {
+		dlog.UseLogFile(cfg.Logfile)
+	}
+	if !flagset["loglevel"] && cfg.Loglevel >= 0 && cfg.Loglevel <= 6 {
+		dlog.SetLogLevel(dlog.Severity(cfg.Loglevel))
 	}
 	if !flagset["syslog"] {
-		dlog.UseSyslog(Cfg.UseSyslog)
+		dlog.UseSyslog(cfg.UseSyslog)
+	}
+	if !flagset["syslog_addr"] && cfg.SyslogAddr != "" {
+		app.SyslogAddr = cfg.SyslogAddr
+	}
+	if !flagset["syslog_facility"] && cfg.SyslogFacility != "" {
+		app.SyslogFacility = cfg.SyslogFacility
+	}
+	if !flagset["proxy_list"] && cfg.ProxyList != "" {
+		app.ProxyList = cfg.ProxyList
+	}
+	if !flagset["proxy_list_interval"] && cfg.ProxyListInterval >= 0 {
+		app.ProxyListInterval = cfg.ProxyListInterval
+	}
+	if !flagset["proxy_probe"] && cfg.ProxyProbe != "" {
+		app.ProxyProbe = cfg.ProxyProbe
+	}
+	if !flagset["select_proxy_mode"] && cfg.SelectProxyMode != "" {
+		selectProxyMode = cfg.SelectProxyMode
+	}
+	if !flagset["select_proxy_mode_ipv4"] && cfg.SelectModeIPv4 != "" {
+		app.SelectModeIPv4 = cfg.SelectModeIPv4
+	}
+	if !flagset["select_proxy_mode_ipv6"] && cfg.SelectModeIPv6 != "" {
+		app.SelectModeIPv6 = cfg.SelectModeIPv6
+	}
+	if !flagset["dscp_modes"] && cfg.DscpModes != "" {
+		app.DscpModes = cfg.DscpModes
+	}
+	if !flagset["schedule"] && cfg.Schedule != "" {
+		app.Schedule = cfg.Schedule
+	}
+	if !flagset["schedule_timezone"] && cfg.ScheduleTimezone != "" {
+		app.ScheduleTimezone = cfg.ScheduleTimezone
+	}
+	if !flagset["rand_seed"] && cfg.RandSeed != 0 {
+		app.RandSeed = cfg.RandSeed
+	}
+	if !flagset["hash_key"] && cfg.HashKey != "" {
+		app.HashKey = cfg.HashKey
+	}
+	if !flagset["failover"] && cfg.Failover != "" {
+		app.Failover = cfg.Failover
+	}
+	if !flagset["primary_backup"] && cfg.PrimaryBackup != "" {
+		app.PrimaryBackup = cfg.PrimaryBackup
+	}
+	if !flagset["health_check_interval"] && cfg.HealthInterval > 0 {
+		app.HealthInterval = cfg.HealthInterval
+	}
+	if !flagset["health_webhook"] && cfg.HealthWebhook != "" {
+		app.HealthWebhook = cfg.HealthWebhook
+	}
+	if !flagset["direct_local_port"] && cfg.DirectLocalPort != "" {
+		app.DirectLocalPort = cfg.DirectLocalPort
+	}
+	if !flagset["upstream_bind"] && cfg.UpstreamBind != "" {
+		app.UpstreamBind = cfg.UpstreamBind
+	}
+	if !flagset["upstream_network"] && cfg.UpstreamNetwork != "" {
+		app.UpstreamNetwork = cfg.UpstreamNetwork
+	}
+	if !flagset["upstream_max_conns"] && cfg.UpstreamMaxConns != "" {
+		app.UpstreamMaxConns = cfg.UpstreamMaxConns
+	}
+	if !flagset["allow_ports"] && cfg.AllowPorts != "" {
+		app.AllowPorts = cfg.AllowPorts
+	}
+	if !flagset["deny_ports"] && cfg.DenyPorts != "" {
+		app.DenyPorts = cfg.DenyPorts
+	}
+	if !flagset["allowlist"] && cfg.Allowlist != "" {
+		app.Allowlist = cfg.Allowlist
+	}
+	if !flagset["allowlist_interval"] && cfg.AllowlistInterval >= 0 {
+		app.AllowlistInterval = cfg.AllowlistInterval
+	}
+	if !flagset["reject_dest_classes"] && cfg.RejectDestClasses != "" {
+		app.RejectDestClasses = cfg.RejectDestClasses
+	}
+	if !flagset["rule_file"] && cfg.RuleFile != "" {
+		app.RuleFile = cfg.RuleFile
+	}
+	if !flagset["asn_db"] && cfg.AsnDB != "" {
+		app.AsnDB = cfg.AsnDB
+	}
+	if !flagset["ptr_wait"] && cfg.PtrWait >= 0 {
+		app.PtrWait = cfg.PtrWait
+	}
+	if !flagset["ptr_cache_ttl"] && cfg.PtrCacheTTL >= 0 {
+		app.PtrCacheTTL = cfg.PtrCacheTTL
+	}
+	if !flagset["dial_timeout"] && cfg.DialTimeout >= 0 {
+		app.DialTimeout = cfg.DialTimeout
+	}
+	if !flagset["setup_timeout"] && cfg.SetupTimeout >= 0 {
+		app.SetupTimeout = cfg.SetupTimeout
+	}
+	if !flagset["dial_retry"] && cfg.DialRetry >= 0 {
+		app.DialRetry = cfg.DialRetry
+	}
+	if !flagset["fail_cache_ttl"] && cfg.FailCacheTTL >= 0 {
+		app.FailCacheTTL = cfg.FailCacheTTL
+	}
+	if !flagset["upload_rate"] && cfg.UploadRate != "" {
+		app.UploadRate = cfg.UploadRate
+	}
+	if !flagset["download_rate"] && cfg.DownloadRate != "" {
+		app.DownloadRate = cfg.DownloadRate
+	}
+	if !flagset["total_upload_rate"] && cfg.TotalUploadRate != "" {
+		app.TotalUploadRate = cfg.TotalUploadRate
+	}
+	if !flagset["total_download_rate"] && cfg.TotalDownloadRate != "" {
+		app.TotalDownloadRate = cfg.TotalDownloadRate
+	}
+	if !flagset["pid_check_interval"] && cfg.PidCheckInterval >= 0 {
+		app.PidCheckInterval = cfg.PidCheckInterval
+	}
+	if !flagset["transparent"] && cfg.Transparent {
+		app.Transparent = true
+	}
+	if !flagset["strict_proxy"] && cfg.StrictProxy {
+		app.StrictProxy = true
+	}
+	if !flagset["compress_upstream"] && cfg.CompressUpstream != "" {
+		app.CompressUpstream = cfg.CompressUpstream
+	}
+	if !flagset["tfo"] && cfg.FastOpen {
+		app.FastOpen = true
+	}
+	if !flagset["tfo_direct"] && cfg.FastOpenDirect {
+		app.FastOpenDirect = true
+	}
+	if !flagset["outbound_dscp"] && cfg.OutboundDscp != "" {
+		app.OutboundDscp = cfg.OutboundDscp
+	}
+	if !flagset["nodelay"] && cfg.NoDelay != "" {
+		app.NoDelay = cfg.NoDelay == "true"
+	}
+	if !flagset["keepalive_idle"] && cfg.KeepAliveIdle >= 0 {
+		app.KeepAliveIdle = cfg.KeepAliveIdle
+	}
+	if !flagset["teardown_grace"] && cfg.TeardownGrace >= 0 {
+		app.TeardownGrace = cfg.TeardownGrace
+	}
+	if !flagset["read_timeout"] && cfg.ReadTimeout != "" {
+		app.ReadTimeout = cfg.ReadTimeout
+	}
+	if !flagset["write_timeout"] && cfg.WriteTimeout != "" {
+		app.WriteTimeout = cfg.WriteTimeout
+	}
+	if !flagset["budget_conns"] && cfg.BudgetConns >= 0 {
+		app.BudgetConns = cfg.BudgetConns
+	}
+	if !flagset["budget_bytes"] && cfg.BudgetBytes != "" {
+		app.BudgetBytes = cfg.BudgetBytes
+	}
+	if !flagset["budget_window"] && cfg.BudgetWindow >= 0 {
+		app.BudgetWindow = cfg.BudgetWindow
+	}
+	if !flagset["budget_action"] && cfg.BudgetAction != "" {
+		app.BudgetAction = cfg.BudgetAction
+	}
+	if !flagset["inbound_secret"] && cfg.InboundSecret != "" {
+		app.InboundSecret = cfg.InboundSecret
+	}
+	if !flagset["proxy_dest_action"] && cfg.ProxyDestAction != "" {
+		app.ProxyDestAction = cfg.ProxyDestAction
+	}
+	if !flagset["hairpin_policy"] && cfg.HairpinPolicy != "" {
+		app.HairpinPolicy = cfg.HairpinPolicy
+	}
+	if !flagset["socks5_listen"] && cfg.Socks5Listen != "" {
+		app.Socks5Listen = cfg.Socks5Listen
+	}
+	if !flagset["http_proxy_listen"] && cfg.HttpProxyListen != "" {
+		app.HttpProxyListen = cfg.HttpProxyListen
+	}
+	if !flagset["dns_listen"] && cfg.DnsListen != "" {
+		app.DnsListen = cfg.DnsListen
+	}
+	if !flagset["dns_upstream"] && cfg.DnsUpstream != "" {
+		app.DnsUpstream = cfg.DnsUpstream
+	}
+	if !flagset["host_cache_ttl"] && cfg.HostCacheTTL >= 0 {
+		app.HostCacheTTL = cfg.HostCacheTTL
+	}
+	if !flagset["honeypot"] && cfg.Honeypot != "" {
+		app.Honeypot = cfg.Honeypot
+	}
+	if !flagset["direct_fallback_dest"] && cfg.DirectFallbackDest != "" {
+		app.DirectFallbackDest = cfg.DirectFallbackDest
+	}
+	if !flagset["affinity_ttl"] && cfg.AffinityTTL >= 0 {
+		app.AffinityTTL = cfg.AffinityTTL
+	}
+	if !flagset["weight_recovery"] && cfg.WeightRecovery >= 0 {
+		app.WeightRecovery = cfg.WeightRecovery
+	}
+	if !flagset["control_listen"] && cfg.ControlListen != "" {
+		app.ControlListen = cfg.ControlListen
+	}
+	if !flagset["control_socket_mode"] && cfg.ControlSocketMode != "" {
+		app.ControlSocketMode = cfg.ControlSocketMode
+	}
+	if !flagset["metrics_ports"] && cfg.MetricsPorts != "" {
+		app.MetricsPorts = cfg.MetricsPorts
+	}
+	if !flagset["otlp_endpoint"] && cfg.OtlpEndpoint != "" {
+		app.OtlpEndpoint = cfg.OtlpEndpoint
+	}
+	if !flagset["nats_url"] && cfg.NatsURL != "" {
+		app.NatsURL = cfg.NatsURL
+	}
+	if !flagset["nats_subject"] && cfg.NatsSubject != "" {
+		app.NatsSubject = cfg.NatsSubject
+	}
+	if !flagset["pidaddr_ttl"] && cfg.PidAddrTTL >= 0 {
+		app.PidAddrTTL = cfg.PidAddrTTL
+	}
+	if !flagset["pidaddr_max"] && cfg.PidAddrMax >= 0 {
+		app.PidAddrMax = cfg.PidAddrMax
+	}
+	if !flagset["drain_timeout"] && cfg.DrainTimeout >= 0 {
+		app.DrainTimeout = cfg.DrainTimeout
+	}
+	if !flagset["accept_rate"] && cfg.AcceptRate >= 0 {
+		app.AcceptRate = cfg.AcceptRate
+	}
+	if !flagset["accept_rate_action"] && cfg.AcceptRateAction != "" {
+		app.AcceptRateAction = cfg.AcceptRateAction
+	}
+	if !flagset["max_pending"] && cfg.MaxPending >= 0 {
+		app.MaxPending = cfg.MaxPending
+	}
+	if !flagset["debug_dest"] && cfg.DebugDest != "" {
+		app.DebugDest = cfg.DebugDest
+	}
+	if !flagset["capture_dest"] && cfg.CaptureDest != "" {
+		app.CaptureDest = cfg.CaptureDest
+	}
+	if !flagset["capture_dir"] && cfg.CaptureDir != "" {
+		app.CaptureDir = cfg.CaptureDir
+	}
+	if !flagset["stats_file"] && cfg.StatsFile != "" {
+		app.StatsFile = cfg.StatsFile
+	}
+	if !flagset["record_file"] && cfg.RecordFile != "" {
+		app.RecordFile = cfg.RecordFile
+	}
+	if !flagset["access_log"] && cfg.AccessLog != "" {
+		app.AccessLog = cfg.AccessLog
 	}
-	if !flagset["select_proxy_mode"] && Cfg.SelectProxyMode != "" {
-		selectProxyMode = Cfg.SelectProxyMode
+	if !flagset["access_log_interval"] && cfg.AccessLogInterval >= 0 {
+		app.AccessLogInterval = cfg.AccessLogInterval
 	}
 }
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "graftcp-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "graftcp-local.conf")
+	if err := ioutil.WriteFile(path, []byte("listen = :2233\nloglevel = 6"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfigFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if cfg := currentConfig(); cfg.Listen != ":2233" || cfg.Loglevel != 6 {
+		t.Errorf("loaded listen %q, loglevel %d, want :2233, 6", cfg.Listen, cfg.Loglevel)
+	}
+	if err := loadConfigFile(filepath.Join(dir, "missing.conf")); err == nil {
+		t.Fatal("load the missing config file succeeded, want err")
+	}
+	if cfg := currentConfig(); cfg.Listen != ":2233" {
+		t.Errorf("listen %q after the failed reload, want :2233 kept", cfg.Listen)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+)
+
+// The kinds of the errors returned by HandleConn, which returns them as the
+// Kind of a *ConnError, so they are told apart by ConnErrorKind:
+//
+//	if ConnErrorKind(err) == ErrDialFailed {
+//		...
+//	}
+var (
+	ErrPidLookupFailed = errors.New("can't find the pid and destination")
+	ErrRejected        = errors.New("connection rejected")
+	ErrDialFailed      = errors.New("dial the destination failed")
+	ErrNoDialer        = errors.New("bad dialer, please check the config for proxy")
+	ErrSetupTimeout    = errors.New("connection setup timed out")
+	ErrBadDest         = errors.New("bad destination address")
+)
+
+// connsFailed count the connections failed by the kind of the errors.
+var connsFailed = expvar.NewMap("conns_failed")
+
+var connErrorKindNames = map[error]string{
+	ErrPidLookupFailed: "pid_lookup",
+	ErrRejected:        "rejected",
+	ErrDialFailed:      "dial",
+	ErrNoDialer:        "no_dialer",
+	ErrSetupTimeout:    "setup_timeout",
+	ErrBadDest:         "bad_dest",
+}
+
+// ConnError is the error of a connection failed in HandleConn.
+type ConnError struct {
+	Kind error  // one of the Err* kinds
+	Msg  string // what failed, e.g. "dial 1.2.3.4:443 via socks5"
+	Err  error  // the cause, nil if none
+}
+
+func (e *ConnError) Error() string {
+	if e.Err == nil {
+		return e.Msg
+	}
+	return e.Msg + ": " + e.Err.Error()
+}
+
+// Unwrap returns the cause, and Is matches the kind, for errors.Is and
+// errors.As of Go 1.13 or later.
+func (e *ConnError) Unwrap() error { return e.Err }
+
+func (e *ConnError) Is(target error) bool { return target == e.Kind }
+
+// ConnErrorKind returns the kind of the error err returned by HandleConn, or
+// nil if it's not a *ConnError.
+func ConnErrorKind(err error) error {
+	if e, ok := err.(*ConnError); ok {
+		return e.Kind
+	}
+	return nil
+}
+
+func connError(kind error, msg string, err error) *ConnError {
+	return &ConnError{Kind: kind, Msg: msg, Err: err}
+}
+
+// countConnError count the connection failed with err by its kind.
+func countConnError(err error) {
+	if name, ok := connErrorKindNames[ConnErrorKind(err)]; ok {
+		connsFailed.Add(name, 1)
+	}
+}
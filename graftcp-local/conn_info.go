@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/jedisct1/dlog"
+)
+
+// ConnInfo is the information of a connection from graftcp.
+type ConnInfo struct {
+	Pid      string // PID of the process making the connection
+	SrcAddr  string
+	DestAddr string // Original destination address with format "ip:port"
+	DestIP   net.IP
+	DestPort uint16
+	Host     string // Host name requested to the proxy front-ends, "" if unknown
+	Tag      string // Tag of the rule matched, "" if none
+	Dscp     int    // DSCP of the packets from the app, -1 if unknown
+	ASN      uint32 // ASN of the destination, 0 if unknown
+	PTR      string // PTR name of the destination, "" if unknown or not looked up yet
+
+	ptrPending bool // the PTR lookup of the destination is not done yet
+}
+
+func newConnInfo(pid, srcAddr, destAddr string) *ConnInfo {
+	c := &ConnInfo{
+		Pid:      pid,
+		SrcAddr:  srcAddr,
+		DestAddr: destAddr,
+		Dscp:     -1,
+	}
+	var err error
+	c.DestIP, c.DestPort, err = splitDestAddr(destAddr)
+	if host, port, e := net.SplitHostPort(destAddr); err != nil && e == nil && net.ParseIP(host) == nil {
+		// the host name passed to the proxies by strict_proxy
+		p, _ := strconv.ParseUint(port, 10, 16)
+		c.DestPort = uint16(p)
+	} else if err != nil {
+		dlog.Errorf("splitDestAddr(%s) err: %s", destAddr, err.Error())
+	}
+	return c
+}
+
+// checkDestAddr returns the error if the destination address addr is not like
+// "ip:port" with the port 1-65535, a host name instead of the IP address is
+// allowed if hostOK, e.g. passed by the front-ends.
+func checkDestAddr(addr string, hostOK bool) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if p, err := strconv.ParseUint(port, 10, 16); err != nil || p == 0 {
+		return fmt.Errorf("bad port: %q", port)
+	}
+	if net.ParseIP(host) == nil && (!hostOK || host == "") {
+		return fmt.Errorf("bad IP address: %q", host)
+	}
+	return nil
+}
+
+// Uid returns the user ID owning the process.
+func (c *ConnInfo) Uid() (uint32, error) {
+	return procUid(c.Pid)
+}
+
+// Cmdline returns the command line of the process, the arguments are joined
+// by spaces.
+func (c *ConnInfo) Cmdline() (string, error) {
+	return procCmdline(c.Pid)
+}
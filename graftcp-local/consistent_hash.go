@@ -0,0 +1,84 @@
+package main
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// hashRingReplicas is the number of the points of an upstream on the ring,
+// the more the even the distribution.
+const hashRingReplicas = 160
+
+// hashRing is a consistent hash ring of the upstreams, so adding or removing
+// an upstream only remaps the keys around its points.
+type hashRing struct {
+	modes  []modeT  // the upstreams on the ring
+	points []uint32 // sorted
+	owners []modeT  // upstream of each point
+}
+
+func hash32(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+func newHashRing(modes []modeT) *hashRing {
+	r := &hashRing{modes: modes}
+	type point struct {
+		hash uint32
+		mode modeT
+	}
+	var points []point
+	for _, m := range modes {
+		for i := 0; i < hashRingReplicas; i++ {
+			points = append(points, point{hash32(m.String() + "#" + strconv.Itoa(i)), m})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].hash < points[j].hash })
+	for _, p := range points {
+		r.points = append(r.points, p.hash)
+		r.owners = append(r.owners, p.mode)
+	}
+	return r
+}
+
+// get returns the upstream of the first point at or after the hash of key.
+func (r *hashRing) get(key string) modeT {
+	h := hash32(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[i]
+}
+
+func (r *hashRing) sameModes(modes []modeT) bool {
+	if len(r.modes) != len(modes) {
+		return false
+	}
+	for i, m := range modes {
+		if r.modes[i] != m {
+			return false
+		}
+	}
+	return true
+}
+
+// consistentHashSelect select the proxy among the available ones by the
+// consistent hashing of the source and the destination address of c, so a
+// flow always uses the same proxy, and the flows are distributed evenly.
+func (l *Local) consistentHashSelect(c *ConnInfo) modeT {
+	modes := l.availableProxyModes()
+	if len(modes) == 0 {
+		return OnlyHttpProxyMode
+	}
+	l.ringMu.Lock()
+	if l.ring == nil || !l.ring.sameModes(modes) {
+		l.ring = newHashRing(modes)
+	}
+	ring := l.ring
+	l.ringMu.Unlock()
+	return ring.get(c.SrcAddr + "-" + c.DestAddr)
+}
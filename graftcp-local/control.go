@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	_ "expvar" // register the /debug/vars handler
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/jedisct1/dlog"
+)
+
+// Status is the status of graftcp-local reported on /status.
+type Status struct {
+	Listen  string         `json:"listen"`           // the current listen address
+	Readers []ReaderHealth `json:"readers"`          // readers of the address info
+	Budget  *BudgetStatus  `json:"budget,omitempty"` // nil if there is no budget
+
+	// Weights of the upstreams selected in the random mode, nil if they are
+	// selected evenly
+	Weights map[string]float64 `json:"weights,omitempty"`
+
+	// Upstream in use of the auto mode by primary_backup, empty if there
+	// is no primary_backup
+	ActiveUpstream string `json:"active_upstream,omitempty"`
+}
+
+// Status returns the current status of l.
+func (l *Local) Status() *Status {
+	s := &Status{
+		Listen:  l.ListenAddr(),
+		Readers: l.ReadersHealth(),
+		Weights: l.weights.snapshot(),
+
+		ActiveUpstream: l.primaryBackup.activeUpstream(),
+	}
+	if l.budget != nil {
+		s.Budget = l.budget.Status()
+	}
+	return s
+}
+
+// ServeControl serve the control endpoints of l on addr, which is a TCP
+// address like "127.0.0.1:2234", or a Unix socket path prefixed with "unix:"
+// created with the permissions mode:
+//
+//	/status: the status in JSON format
+//	/debug/vars: the metrics in JSON format
+//	/debug/pidaddr: the address info not taken yet in JSON format, only
+//	                for the clients on the local host
+//	/reload/asn_db: reload the ASN database by POST, only for the clients
+//	                on the local host
+//
+// The clients of the Unix socket are all on the local host.
+func ServeControl(addr string, mode os.FileMode, l *Local) {
+	network := "tcp"
+	if strings.HasPrefix(addr, "unix:") {
+		network, addr = "unix", strings.TrimPrefix(addr, "unix:")
+	}
+	isLocal := func(r *http.Request) bool {
+		return network == "unix" || isLoopbackAddr(r.RemoteAddr)
+	}
+	http.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.Encode(l.Status())
+	})
+	http.HandleFunc("/debug/pidaddr", func(w http.ResponseWriter, r *http.Request) {
+		if !isLocal(r) {
+			http.Error(w, "only for the local host", http.StatusForbidden)
+			return
+		}
+		infos := DumpPidAddr()
+		if infos == nil {
+			infos = []PidAddrInfo{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.Encode(infos)
+	})
+	http.HandleFunc("/reload/asn_db", func(w http.ResponseWriter, r *http.Request) {
+		if !isLocal(r) {
+			http.Error(w, "only for the local host", http.StatusForbidden)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST only", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := l.ReloadAsnDB(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+	ln, err := listenControl(network, addr, mode)
+	if err != nil {
+		dlog.Errorf("control server(%s) err: %s", addr, err.Error())
+		return
+	}
+	dlog.Infof("control server listening %s...", addr)
+	if err := http.Serve(ln, nil); err != nil {
+		dlog.Errorf("control server(%s) err: %s", addr, err.Error())
+	}
+}
+
+// listenControl listen on addr of network, the Unix socket is created again
+// with the permissions mode, and the stale one is removed, but not any other
+// file at addr.
+func listenControl(network, addr string, mode os.FileMode) (net.Listener, error) {
+	if network != "unix" {
+		return net.Listen(network, addr)
+	}
+	if fi, err := os.Lstat(addr); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", addr)
+		}
+		os.Remove(addr)
+	}
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(addr, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// isLoopbackAddr reports whether addr in format "host:port" is a loopback
+// address.
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenControlUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "graftcp-control")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr := filepath.Join(dir, "control.sock")
+	ln, err := listenControl("unix", addr, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// leave the socket behind like a crashed graftcp-local
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+	if ln, err = listenControl("unix", addr, 0600); err != nil {
+		t.Fatalf("listen on the stale socket err: %v", err)
+	}
+	ln.Close()
+
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, []byte("keep"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if ln, err := listenControl("unix", file, 0600); err == nil {
+		ln.Close()
+		t.Fatal("listen on the regular file succeeded, want err")
+	}
+	if b, err := ioutil.ReadFile(file); err != nil || string(b) != "keep" {
+		t.Errorf("the regular file is removed or changed: %q, %v", b, err)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+// SetDebugDest set the destinations whose connections are logged in detail
+// regardless of the log level, in format like "203.0.113.0/24,example.com".
+func (l *Local) SetDebugDest(dests string) error {
+	nets, err := parseDestList(dests)
+	if err != nil {
+		return fmt.Errorf("bad debug_dest: %s", err.Error())
+	}
+	l.debugNets = nets
+	return nil
+}
+
+func (l *Local) isDebugDest(ip net.IP) bool {
+	return ipInNets(ip, l.debugNets)
+}
+
+// parseDestList parse the comma separated IP addresses, CIDRs and host names,
+// the host names are resolved once here.
+func parseDestList(dests string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range strings.Split(dests, ",") {
+		s = strings.TrimSpace(s)
+		if n, err := parseIPNet(s); err == nil {
+			nets = append(nets, n)
+			continue
+		}
+		ips, err := net.LookupIP(s)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			n, _ := parseIPNet(ip.String())
+			nets = append(nets, n)
+		}
+	}
+	return nets, nil
+}
+
+func ipInNets(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// connDebug log the lifecycle of a connection to a debug destination with the
+// time elapsed since it's accepted, it does nothing if nil.
+type connDebug struct {
+	prefix string
+	start  time.Time
+}
+
+func (d *connDebug) logf(format string, args ...interface{}) {
+	if d == nil {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	msg = fmt.Sprintf("[debug_dest] %s: %s (+%s)", d.prefix, msg, time.Since(d.start))
+	// log at the info level, or the log level if higher to be always shown
+	switch lv := dlog.LogLevel(); {
+	case lv <= dlog.SeverityInfo:
+		dlog.Info(msg)
+	case lv == dlog.SeverityNotice:
+		dlog.Notice(msg)
+	case lv == dlog.SeverityWarning:
+		dlog.Warn(msg)
+	case lv == dlog.SeverityError:
+		dlog.Error(msg)
+	default:
+		dlog.Critical(msg)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	"golang.org/x/net/proxy"
+)
+
+// dialTimeoutError is the error of a dial timed out.
+type dialTimeoutError struct {
+	addr    string
+	timeout time.Duration
+}
+
+func (e *dialTimeoutError) Error() string {
+	return fmt.Sprintf("dial %s timeout after %v", e.addr, e.timeout)
+}
+
+func (e *dialTimeoutError) Timeout() bool   { return true }
+func (e *dialTimeoutError) Temporary() bool { return true }
+
+// dialTimeout connect to addr via dialer, and give up after timeout if
+// timeout > 0 or ctx is done.
+func dialTimeout(ctx context.Context, dialer proxy.Dialer, addr string, timeout time.Duration) (net.Conn, error) {
+	if timeout <= 0 && ctx.Done() == nil {
+		return dialer.Dial("tcp", addr)
+	}
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		conn, err := dialer.Dial("tcp", addr)
+		ch <- result{conn, err}
+	}()
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	var err error
+	select {
+	case r := <-ch:
+		return r.conn, r.err
+	case <-expired:
+		err = &dialTimeoutError{addr: addr, timeout: timeout}
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	go func() {
+		if r := <-ch; r.conn != nil {
+			r.conn.Close()
+		}
+	}()
+	return nil, err
+}
+
+// dialRetry connect to addr via dialer, and retry at most retry times if it
+// fails, until ctx is done. It doesn't retry if the SOCKS5 proxy replies the
+// destination refused, and the error is a *socks5ReplyError then.
+func dialRetry(ctx context.Context, dialer proxy.Dialer, addr string, timeout time.Duration, retry int) (conn net.Conn, err error) {
+	for i := 0; i <= retry; i++ {
+		if i > 0 {
+			dlog.Infof("retry(%d/%d) dial %s, last err: %s", i, retry, addr, err.Error())
+		}
+		conn, err = dialTimeout(ctx, dialer, addr, timeout)
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		if e := parseSocks5Reply(err); e != nil {
+			socks5Replies.Add(e.reason(), 1)
+			err = e
+			if !e.retryable() {
+				break
+			}
+		}
+	}
+	return nil, err
+}
+
+// connDialer returns the dialer to dial for the connection c with dialer, the
+// proxy speaking the other protocol is fixed if probed, the socks5 proxy is
+// dialed with the username of the template for c if set, the HTTP proxy is
+// sent the process header of c if set, the direct dialer dials from the
+// source IP address of c if the transparent mode is enabled, and the
+// connections of the compressed upstreams are compressed.
+func (l *Local) connDialer(dialer proxy.Dialer, c *ConnInfo) proxy.Dialer {
+	d := l.probedDialer(dialer)
+	if d == dialer && l.upstreamName(d) == "socks5" && l.socks5UserTemplate != nil && l.socks5Addr != "" {
+		d = l.socks5UserDialer(c)
+	}
+	if l.processHeader != nil {
+		d = l.processHeader.wrap(d, c)
+	}
+	if l.Transparent && l.upstreamName(dialer) == "direct" {
+		if src := transparentSource(c); src != nil {
+			d = transparentDialer{src: src}
+		}
+	}
+	if l.compressUpstreams[l.upstreamName(dialer)] {
+		d = compressedDialer{d}
+	}
+	return d
+}
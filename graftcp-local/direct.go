@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+)
+
+// portRangeDialer dial directly from the local ports in a range, the ports
+// are used round-robin, and the next port is tried if a port is in use.
+type portRangeDialer struct {
+	ports   portRange
+	next    uint32
+	forward *boundDialer
+}
+
+func (d *portRangeDialer) Dial(network, addr string) (conn net.Conn, err error) {
+	n := uint32(d.ports.max-d.ports.min) + 1
+	for i := uint32(0); i < n; i++ {
+		port := d.ports.min + uint16((atomic.AddUint32(&d.next, 1)-1)%n)
+		conn, err = d.forward.dialFrom(network, addr, int(port))
+		if err == nil || !isAddrInUse(err) {
+			return
+		}
+	}
+	return
+}
+
+func isAddrInUse(err error) bool {
+	opErr, ok := err.(*net.OpError)
+	if !ok {
+		return false
+	}
+	sysErr, ok := opErr.Err.(*os.SyscallError)
+	if !ok {
+		return false
+	}
+	return sysErr.Err == syscall.EADDRINUSE || sysErr.Err == syscall.EADDRNOTAVAIL
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"expvar"
+	"io"
+	"net"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+const (
+	// dnsIdleTimeout is the max time to wait for the next query of a client
+	// connection, and for the answer of a query.
+	dnsIdleTimeout = 30 * time.Second
+	dnsDialTimeout = 10 * time.Second
+
+	// dnsAcceptMinDelay and dnsAcceptMaxDelay bound the backoff of accepting
+	// on the temporary errors, e.g. too many open files.
+	dnsAcceptMinDelay = 5 * time.Millisecond
+	dnsAcceptMaxDelay = time.Second
+)
+
+// dnsQueries count the DNS queries forwarded by the result: "answered" or
+// "failed".
+var dnsQueries = expvar.NewMap("dns_queries")
+
+// ServeDNS serve a DNS forwarder over TCP on addr for the apps, which forwards
+// the queries to the DNS server upstream via the socks5 proxy, so the names
+// are resolved at the proxy side and never leak to the local network. The
+// connection to upstream is kept for the queries of a client connection.
+func (l *Local) ServeDNS(addr, upstream string) {
+	if !available(l.socks5Dialer) {
+		dlog.Fatalf("the DNS forwarder %s requires the socks5 proxy", addr)
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		dlog.Fatalf("listen the DNS forwarder %s err: %s", addr, err.Error())
+	}
+	dlog.Infof("DNS forwarder listening %s, forward to %s via the socks5 proxy...", addr, upstream)
+	var delay time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); !ok || !ne.Temporary() {
+				dlog.Errorf("the DNS forwarder %s stops, accept err: %s", addr, err.Error())
+				return
+			}
+			if delay *= 2; delay == 0 {
+				delay = dnsAcceptMinDelay
+			} else if delay > dnsAcceptMaxDelay {
+				delay = dnsAcceptMaxDelay
+			}
+			dlog.Errorf("accept err: %s, retry in %v", err.Error(), delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		go l.forwardDNS(conn, upstream)
+	}
+}
+
+// forwardDNS forward the DNS queries of conn to upstream one by one until
+// conn is closed or idle.
+func (l *Local) forwardDNS(conn net.Conn, upstream string) {
+	defer conn.Close()
+	info := newConnInfo(unknownPid, conn.RemoteAddr().String(), upstream)
+	var up net.Conn
+	defer func() {
+		if up != nil {
+			up.Close()
+		}
+	}()
+	for {
+		conn.SetReadDeadline(time.Now().Add(dnsIdleTimeout))
+		msg, err := readDNSMessage(conn)
+		if err != nil {
+			if err != io.EOF {
+				dlog.Debugf("read the DNS query from %s err: %s", conn.RemoteAddr(), err.Error())
+			}
+			return
+		}
+		answer, err := l.queryDNS(&up, info, msg)
+		if err != nil {
+			dlog.Errorf("forward the DNS query to %s err: %s", upstream, err.Error())
+			dnsQueries.Add("failed", 1)
+			return
+		}
+		dnsQueries.Add("answered", 1)
+		conn.SetWriteDeadline(time.Now().Add(dnsIdleTimeout))
+		if err := writeDNSMessage(conn, answer); err != nil {
+			return
+		}
+	}
+}
+
+// queryDNS returns the answer of the DNS server of info to the query msg via
+// the connection *up, which is dialed if nil, and dialed again once if it's
+// kept from the previous queries but closed by the server. It's dialed as the
+// connections of mode only_socks5, with the limits of the socks5 upstream.
+func (l *Local) queryDNS(up *net.Conn, info *ConnInfo, msg []byte) ([]byte, error) {
+	for {
+		reused := *up != nil
+		if !reused {
+			conn, dialer, err := l.dialChain(context.Background(), []modeT{OnlySocks5Mode}, info, dnsDialTimeout, 0)
+			if err != nil {
+				return nil, err
+			}
+			*up = &limitedConn{Conn: conn, release: func() { l.releaseUpstream(l.upstreamName(dialer)) }}
+		}
+		(*up).SetDeadline(time.Now().Add(dnsIdleTimeout))
+		answer, err := exchangeDNS(*up, msg)
+		if err == nil || !reused {
+			return answer, err
+		}
+		(*up).Close()
+		*up = nil
+	}
+}
+
+// exchangeDNS send the query msg to the DNS server conn, and returns its
+// answer.
+func exchangeDNS(conn net.Conn, msg []byte) ([]byte, error) {
+	if err := writeDNSMessage(conn, msg); err != nil {
+		return nil, err
+	}
+	return readDNSMessage(conn)
+}
+
+// readDNSMessage read a DNS message prefixed with its 2-byte length as over
+// TCP.
+func readDNSMessage(r io.Reader) ([]byte, error) {
+	var n [2]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(n[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// writeDNSMessage write the DNS message msg prefixed with its 2-byte length.
+func writeDNSMessage(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/jedisct1/dlog"
+)
+
+// dscpNames are the names of the DSCP classes besides the class selectors
+// "cs0" to "cs7" and the assured forwarding classes "af11" to "af43".
+var dscpNames = map[string]int{"ef": 46, "va": 44, "le": 1}
+
+// parseDscp parse the DSCP in number or name, e.g.: 46, ef, af41, cs1.
+func parseDscp(s string) (int, error) {
+	s = strings.ToLower(s)
+	if d, ok := dscpNames[s]; ok {
+		return d, nil
+	}
+	if len(s) == 3 && strings.HasPrefix(s, "cs") && s[2] >= '0' && s[2] <= '7' {
+		return int(s[2]-'0') * 8, nil
+	}
+	if len(s) == 4 && strings.HasPrefix(s, "af") && s[2] >= '1' && s[2] <= '4' && s[3] >= '1' && s[3] <= '3' {
+		return int(s[2]-'0')*8 + int(s[3]-'0')*2, nil
+	}
+	d, err := strconv.Atoi(s)
+	if err != nil || d < 0 || d > 63 {
+		return 0, fmt.Errorf("bad DSCP: %s", s)
+	}
+	return d, nil
+}
+
+// SetDscpModes set the modes of the connections by the DSCP of the packets
+// from the apps, which is in format like "ef:only_socks5,cs1:direct". The
+// DSCP mode is used instead of the other default modes, and the rules still
+// override it. The connections whose DSCP can't be read, e.g. from the proxy
+// front-ends, use the default modes.
+func (l *Local) SetDscpModes(spec string) error {
+	modes := make(map[int]modeT)
+	for _, item := range strings.Split(spec, ",") {
+		kv := strings.SplitN(strings.TrimSpace(item), ":", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("bad dscp_modes: %s", item)
+		}
+		d, err := parseDscp(kv[0])
+		if err != nil {
+			return err
+		}
+		m, ok := parseSelectMode(kv[1])
+		if !ok {
+			return fmt.Errorf("unknown mode of DSCP %s: %s", kv[0], kv[1])
+		}
+		modes[d] = m
+	}
+	l.dscpModes = modes
+	return nil
+}
+
+// readDscp returns the DSCP of the packets received on conn, or -1 if it
+// can't be read. It requires the DSCP enabled on the listener by
+// enableDscp.
+func (l *Local) readDscp(conn net.Conn) int {
+	if l.dscpModes == nil {
+		return -1
+	}
+	tc := tcpConnOf(conn)
+	if tc == nil {
+		return -1
+	}
+	tos, err := recvTos(tc)
+	if err != nil {
+		dlog.Debugf("read the TOS of %s err: %s", conn.RemoteAddr().String(), err.Error())
+		return -1
+	}
+	return tos >> 2
+}
+
+// enableDscp let the DSCP of the connections accepted from ln be read if the
+// DSCP modes are set.
+func (l *Local) enableDscp(ln *net.TCPListener) {
+	if l.dscpModes == nil {
+		return
+	}
+	if err := setRecvTos(ln); err != nil {
+		dlog.Errorf("enable receiving the TOS on %s err: %s", ln.Addr().String(), err.Error())
+	}
+}
+
+// SetOutboundDscp set the DSCP of the connections to the proxies and the
+// direct connections, e.g.: 46 or ef.
+func (l *Local) SetOutboundDscp(dscp string) error {
+	d, err := parseDscp(dscp)
+	if err != nil {
+		return err
+	}
+	l.fastOpen.tos = d << 2
+	return nil
+}
+
+// setConnDscp set the DSCP of the connection conn dialed to dscp, which
+// overrides the outbound DSCP by the rule.
+func setConnDscp(conn net.Conn, dscp int) {
+	if err := setTos(conn, dscp<<2); err != nil {
+		dlog.Errorf("set the DSCP of %s err: %s", conn.RemoteAddr().String(), err.Error())
+	}
+}
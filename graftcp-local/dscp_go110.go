@@ -0,0 +1,92 @@
+// +build go1.10
+
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	ipPktOptions = 9  // IP_PKTOPTIONS of Linux
+	ipRecvTos    = 13 // IP_RECVTOS of Linux
+)
+
+// setRecvTos set IP_RECVTOS on ln, which is inherited by the connections
+// accepted, so the TOS they receive is kept.
+func setRecvTos(ln *net.TCPListener) error {
+	rc, err := ln.SyscallConn()
+	if err != nil {
+		return err
+	}
+	cerr := rc.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, ipRecvTos, 1)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// setTos set the TOS, or the traffic class of IPv6, of conn to tos.
+func setTos(conn net.Conn, tos int) error {
+	tc := tcpConnOf(conn)
+	if tc == nil {
+		return errors.New("not a TCP connection")
+	}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	ipv4 := true
+	if addr, ok := tc.LocalAddr().(*net.TCPAddr); ok && addr.IP.To4() == nil {
+		ipv4 = false
+	}
+	cerr := rc.Control(func(fd uintptr) {
+		if ipv4 {
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TOS, tos)
+		} else {
+			err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tos)
+		}
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// recvTos returns the TOS received on the IPv4 connection tc by
+// IP_PKTOPTIONS.
+func recvTos(tc *net.TCPConn) (int, error) {
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	buf := make([]byte, 64)
+	n := uint32(len(buf))
+	cerr := rc.Control(func(fd uintptr) {
+		_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.SOL_IP, ipPktOptions,
+			uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&n)), 0)
+		if errno != 0 {
+			err = errno
+		}
+	})
+	if cerr != nil {
+		return 0, cerr
+	}
+	if err != nil {
+		return 0, err
+	}
+	msgs, err := syscall.ParseSocketControlMessage(buf[:n])
+	if err != nil {
+		return 0, err
+	}
+	for _, m := range msgs {
+		if m.Header.Level == syscall.SOL_IP && m.Header.Type == syscall.IP_TOS && len(m.Data) > 0 {
+			return int(m.Data[0]), nil
+		}
+	}
+	return 0, errors.New("no TOS received")
+}
@@ -0,0 +1,22 @@
+// +build !go1.10
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+var errDscpUnsupported = errors.New("reading and setting the DSCP requires Go 1.10 or later")
+
+func setRecvTos(ln *net.TCPListener) error {
+	return errDscpUnsupported
+}
+
+func recvTos(tc *net.TCPConn) (int, error) {
+	return 0, errDscpUnsupported
+}
+
+func setTos(conn net.Conn, tos int) error {
+	return errDscpUnsupported
+}
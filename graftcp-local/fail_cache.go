@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var errDestFailed = errors.New("dialing the destination failed recently")
+
+// connsFailedFast count the connections failed fast by the fail cache.
+var connsFailedFast = expvar.NewInt("conns_failed_fast")
+
+// failCache remember the destinations failed to dial for ttl, so the new
+// connections to them fail fast instead of waiting for the dial timeout
+// again. A destination is remembered only by the dials really failed for the
+// destination itself, not the fast failures, so it's dialed again as soon as
+// ttl passes, and never by the failures of the proxies or the timeouts, which
+// tell nothing of the destination.
+type failCache struct {
+	ttl time.Duration
+
+	mu        sync.Mutex
+	expires   map[string]time.Time // by destination address
+	nextSweep time.Time
+}
+
+// SetFailCacheTTL fail the connections to the destinations failed to dial
+// within ttl fast, no cache if 0.
+func (l *Local) SetFailCacheTTL(ttl time.Duration) {
+	if ttl <= 0 {
+		l.failCache = nil
+		return
+	}
+	l.failCache = &failCache{ttl: ttl, expires: make(map[string]time.Time)}
+}
+
+// failed reports whether dialing addr failed within ttl.
+func (fc *failCache) failed(addr string) bool {
+	if fc == nil {
+		return false
+	}
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	expires, ok := fc.expires[addr]
+	return ok && time.Now().Before(expires)
+}
+
+// put remember dialing addr failed, the expired destinations are dropped at
+// most once per ttl.
+func (fc *failCache) put(addr string) {
+	if fc == nil {
+		return
+	}
+	now := time.Now()
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if now.After(fc.nextSweep) {
+		for a, expires := range fc.expires {
+			if now.After(expires) {
+				delete(fc.expires, a)
+			}
+		}
+		fc.nextSweep = now.Add(fc.ttl)
+	}
+	fc.expires[addr] = now.Add(fc.ttl)
+}
+
+// destFailed reports whether the error err of dialing via the upstream name
+// is attributable to the destination: the SOCKS5 proxy replied the network
+// or the host unreachable or the connection refused, or the direct dial was
+// refused or found the host unreachable.
+func destFailed(name string, err error) bool {
+	if e := parseSocks5Reply(err); e != nil {
+		return e.code == 3 || e.code == 4 || e.code == 5
+	}
+	if name != "direct" {
+		return false
+	}
+	if e, ok := err.(*net.OpError); ok {
+		err = e.Err
+	}
+	if e, ok := err.(*os.SyscallError); ok {
+		err = e.Err
+	}
+	return err == syscall.ECONNREFUSED || err == syscall.EHOSTUNREACH
+}
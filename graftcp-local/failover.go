@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	"golang.org/x/net/proxy"
+)
+
+var (
+	errFailoverRejected = errors.New("rejected by the failover chain")
+	errUpstreamBusy     = errors.New("the upstream is at its limit of the concurrent connections")
+	failoverDialerModes = map[string]modeT{
+		"socks5":     OnlySocks5Mode,
+		"http_proxy": OnlyHttpProxyMode,
+		"direct":     DirectMode,
+		"reject":     RejectMode,
+	}
+)
+
+// SetFailover set the failover chain of the auto mode, which is a comma
+// separated list of socks5, http_proxy, direct and reject. The dialers in the
+// chain are tried in order until one succeeds, the unavailable dialers are
+// skipped, and reject stops trying and rejects the connection.
+func (l *Local) SetFailover(chain string) error {
+	var modes []modeT
+	for _, name := range strings.Split(chain, ",") {
+		m, ok := failoverDialerModes[strings.TrimSpace(name)]
+		if !ok {
+			return fmt.Errorf("unknown dialer in failover: %s", name)
+		}
+		modes = append(modes, m)
+	}
+	l.failover = modes
+	return nil
+}
+
+// SetDirectFallbackDest only allow the connections to dests to fall back to
+// direct in the failover chain, the others fail closed if the proxies fail.
+// dests is in format like "203.0.113.0/24,example.com".
+func (l *Local) SetDirectFallbackDest(dests string) error {
+	nets, err := parseDestList(dests)
+	if err != nil {
+		return fmt.Errorf("bad direct_fallback_dest: %s", err.Error())
+	}
+	l.directFallbackNets = nets
+	return nil
+}
+
+// canFallBackDirect reports whether the connection to ip may fall back to
+// direct.
+func (l *Local) canFallBackDirect(ip net.IP) bool {
+	return l.directFallbackNets == nil || ipInNets(ip, l.directFallbackNets)
+}
+
+// failoverChain returns the failover chain of the auto mode, which is
+// socks5 or HTTP proxy if socks5 is unavailable, then direct by default.
+// There is no direct in it with strict_proxy.
+func (l *Local) failoverChain() []modeT {
+	chain := l.configuredChain()
+	if l.strictProxy {
+		return proxyOnly(chain)
+	}
+	return chain
+}
+
+func (l *Local) configuredChain() []modeT {
+	if l.primaryBackup != nil {
+		return l.primaryBackup.chain()
+	}
+	if l.failover != nil {
+		return l.failover
+	}
+	if available(l.socks5Dialer) {
+		return []modeT{OnlySocks5Mode, DirectMode}
+	}
+	if available(l.httpProxyDialer) {
+		return []modeT{OnlyHttpProxyMode, DirectMode}
+	}
+	return []modeT{DirectMode}
+}
+
+// dialChain dial the destination of c with the dialers of the modes in chain
+// in order until one succeeds or ctx is done, returns the connection and the
+// dialer used, or the error and the last dialer tried, nil if none is tried.
+// The dialers returned are *namedDialer. The slot of the upstream used is
+// taken, see acquireUpstream.
+func (l *Local) dialChain(ctx context.Context, chain []modeT, c *ConnInfo, timeout time.Duration, retry int) (net.Conn, proxy.Dialer, error) {
+	addr := c.DestAddr
+	err := ErrNoDialer
+	var last proxy.Dialer
+	for i, m := range chain {
+		if m == RejectMode {
+			return nil, nil, errFailoverRejected
+		}
+		dialer := l.proxySelector(m)
+		if !available(dialer) {
+			continue
+		}
+		if i > 0 && m == DirectMode && !l.canFallBackDirect(c.DestIP) {
+			dlog.Infof("%s is not allowed to fall back to direct", addr)
+			continue
+		}
+		if i > 0 {
+			dlog.Infof("dial %s with mode %s", addr, m)
+		}
+		nd := l.namedDialer(dialer)
+		conn, e := l.dialUpstream(ctx, nd, l.connDialer(nd, c), addr, timeout, retry, i == len(chain)-1)
+		if e == errUpstreamBusy {
+			err = e
+			continue
+		}
+		if e == nil {
+			return conn, nd, nil
+		}
+		last = nd
+		if ctx.Err() != nil {
+			return nil, last, e
+		}
+		if i < len(chain)-1 {
+			dlog.Errorf("dial %s with mode %s err: %s", addr, m, e.Error())
+		}
+		err = e
+	}
+	return nil, last, err
+}
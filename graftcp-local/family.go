@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// SetFamilyMode set the mode of the destinations of the address family, "ipv4"
+// or "ipv6", instead of the select mode and the schedule, e.g. for the proxies
+// which can't connect to the IPv6 destinations.
+func (l *Local) SetFamilyMode(family, mode string) error {
+	if family != "ipv4" && family != "ipv6" {
+		return fmt.Errorf("unknown address family: %s", family)
+	}
+	m, ok := parseSelectMode(mode)
+	if !ok {
+		return fmt.Errorf("unknown mode of %s: %s", family, mode)
+	}
+	if l.familyModes == nil {
+		l.familyModes = make(map[string]modeT)
+	}
+	l.familyModes[family] = m
+	return nil
+}
+
+// addrFamily returns the address family of ip, "ipv4" or "ipv6".
+func addrFamily(ip net.IP) string {
+	if ip.To4() != nil {
+		return "ipv4"
+	}
+	return "ipv6"
+}
+
+// defaultMode returns the mode of the connection c accepted at t if no rule
+// matches it.
+func (l *Local) defaultMode(c *ConnInfo, t time.Time) modeT {
+	if m, ok := l.dscpModes[c.Dscp]; ok {
+		return m
+	}
+	if c.DestIP != nil {
+		if m, ok := l.familyModes[addrFamily(c.DestIP)]; ok {
+			return m
+		}
+	}
+	return l.scheduledMode(t)
+}
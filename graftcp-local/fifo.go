@@ -0,0 +1,95 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+const fifoCheckInterval = 2 * time.Second
+
+// FifoSource read the address info from a named pipe.
+type FifoSource struct {
+	path string
+	fd   *os.File
+}
+
+// NewFifoSource returns a FifoSource reading from path.
+func NewFifoSource(path string) *FifoSource {
+	return &FifoSource{path: path}
+}
+
+func (f *FifoSource) Name() string {
+	return "fifo:" + f.path
+}
+
+// Open create the fifo if it does not exist and open it for reading.
+func (f *FifoSource) Open() (err error) {
+	syscall.Mkfifo(f.path, uint32(os.ModePerm))
+	os.Chmod(f.path, 0666)
+	f.fd, err = os.OpenFile(f.path, os.O_RDWR, 0)
+	return
+}
+
+// OpenWait open the fifo as Open, and retry with backoff until wait passes if
+// it fails, e.g. the directory of the fifo is not created yet.
+func (f *FifoSource) OpenWait(wait time.Duration) error {
+	deadline := time.Now().Add(wait)
+	backoff := sourceMinBackoff
+	for {
+		err := f.Open()
+		if err == nil || time.Now().Add(backoff).After(deadline) {
+			return err
+		}
+		dlog.Noticef("wait for fifo %s: %s, retry in %v", f.path, err.Error(), backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > sourceMaxBackoff {
+			backoff = sourceMaxBackoff
+		}
+	}
+}
+
+// Run read the address info from the fifo until reading fails or the fifo is
+// recreated, the fifo is reopened when it's run again.
+func (f *FifoSource) Run(m *readerMonitor) {
+	if f.fd == nil {
+		if err := f.Open(); err != nil {
+			dlog.Errorf("os.OpenFile(%s) err: %s", f.path, err.Error())
+			m.setError(err.Error())
+			return
+		}
+		dlog.Noticef("fifo %s reopened", f.path)
+	}
+	done := make(chan struct{})
+	go watchFifo(f.path, f.fd, done)
+	readProcessAddrInfo(f.fd, m)
+	close(done)
+	f.fd.Close()
+	f.fd = nil
+}
+
+// watchFifo close fd if path no longer refers to the file opened as fd,
+// which happens when the fifo is removed or recreated by someone else.
+func watchFifo(path string, fd *os.File, done <-chan struct{}) {
+	ticker := time.NewTicker(fifoCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		fdInfo, err := fd.Stat()
+		if err != nil {
+			return
+		}
+		pathInfo, err := os.Stat(path)
+		if err != nil || !os.SameFile(fdInfo, pathInfo) {
+			dlog.Warnf("fifo %s has been removed or recreated", path)
+			fd.Close()
+			return
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+// unknownPid is the pid of the connections whose process is unknown, e.g.
+// from the other hosts to the proxy front-ends.
+const unknownPid = "0"
+
+const frontendHandshakeTimeout = 10 * time.Second
+
+// dialReplier is the connection to be told the result of dialing its
+// destination, e.g. the proxy front-ends send the reply to the client.
+type dialReplier interface {
+	replyDial(err error)
+}
+
+// dialErrorReason returns the reason of the dial error err for the replies of
+// the front-ends: "rejected", "timeout", "connection refused", "network
+// unreachable", "host unreachable", or "" for the others.
+func dialErrorReason(err error) string {
+	if err == ErrRejected {
+		return "rejected"
+	}
+	if err == errDestFailed {
+		return "host unreachable"
+	}
+	if e, ok := err.(*socks5ReplyError); ok {
+		switch e.code {
+		case 3:
+			return "network unreachable"
+		case 4:
+			return "host unreachable"
+		case 5:
+			return "connection refused"
+		}
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return "timeout"
+	}
+	opErr, ok := err.(*net.OpError)
+	if !ok {
+		return ""
+	}
+	if opErr.Timeout() {
+		return "timeout"
+	}
+	sysErr, ok := opErr.Err.(*os.SyscallError)
+	if !ok {
+		return ""
+	}
+	switch sysErr.Err {
+	case syscall.ECONNREFUSED:
+		return "connection refused"
+	case syscall.ENETUNREACH:
+		return "network unreachable"
+	case syscall.EHOSTUNREACH:
+		return "host unreachable"
+	}
+	return ""
+}
+
+// frontendConn is a connection to a proxy front-end, the destination is read
+// from the proxy request instead of the address info sent by graftcp.
+type frontendConn interface {
+	net.Conn
+	dialReplier
+	// handshake read the proxy request, returns the destination address, the
+	// host name requested is resolved within ctx.
+	handshake(ctx context.Context) (string, error)
+	// requestedHost returns the host name in the proxy request, or "" if
+	// the destination is requested by the IP address.
+	requestedHost() string
+}
+
+// serveFrontend serve the proxy front-end named name on addr, the accepted
+// connections are wrapped by wrap.
+func (l *Local) serveFrontend(name, addr string, wrap func(net.Conn) frontendConn) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		dlog.Fatalf("listen the %s front-end %s err: %s", name, addr, err.Error())
+	}
+	dlog.Infof("%s front-end listening %s...", name, addr)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			dlog.Errorf("accept err: %s", err.Error())
+			continue
+		}
+		go l.HandleConn(wrap(conn))
+	}
+}
+
+// resolve returns the pid and the destination address of conn, the host name
+// requested to the front-ends is resolved within ctx.
+func (l *Local) resolve(ctx context.Context, conn net.Conn) (pid, destAddr string, err error) {
+	fc, ok := conn.(frontendConn)
+	if !ok {
+		if l.inboundSecret != "" {
+			if err := readSecret(conn, l.inboundSecret); err != nil {
+				return "", "", err
+			}
+		}
+		return l.resolver.Resolve(conn)
+	}
+	fc.SetDeadline(time.Now().Add(frontendHandshakeTimeout))
+	destAddr, err = fc.handshake(ctx)
+	fc.SetDeadline(time.Time{})
+	if err != nil {
+		return "", "", err
+	}
+	return localPid(fc), destAddr, nil
+}
+
+// localPid returns the pid of the local process making the connection conn
+// to graftcp-local, or unknownPid if not found.
+func localPid(conn net.Conn) string {
+	local, remote := conn.RemoteAddr().String(), conn.LocalAddr().String()
+	inode, err := getInodeByAddrs(local, remote, strings.Contains(remote, "["))
+	if err != nil || inode == "" {
+		return unknownPid
+	}
+	dirs, _ := filepath.Glob("/proc/[0-9]*")
+	for _, dir := range dirs {
+		if pid := filepath.Base(dir); hasIncludeInode(pid, inode) {
+			return pid
+		}
+	}
+	return unknownPid
+}
+
+// resolveHost resolve the host name of the destination within ctx, as the
+// rules match the destination IP, it's returned as is if pass. An IPv4
+// address is preferred as net.ResolveIPAddr.
+func resolveHost(ctx context.Context, host string, pass bool) (string, error) {
+	if ip := net.ParseIP(host); ip != nil || pass {
+		return host, nil
+	}
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	for _, addr := range addrs {
+		if ip := net.ParseIP(addr); ip != nil && ip.To4() != nil {
+			return addr, nil
+		}
+	}
+	return addrs[0], nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+const localAddrsRefresh = 30 * time.Second
+
+var localAddrs = struct {
+	sync.Mutex
+	ips   map[string]bool
+	mtime time.Time
+}{}
+
+// isLocalIP reports whether ip is an address of the local host.
+func isLocalIP(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	localAddrs.Lock()
+	defer localAddrs.Unlock()
+	if localAddrs.ips == nil || time.Since(localAddrs.mtime) > localAddrsRefresh {
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			dlog.Errorf("net.InterfaceAddrs() err: %s", err.Error())
+		} else {
+			localAddrs.ips = make(map[string]bool)
+			for _, a := range addrs {
+				if n, ok := a.(*net.IPNet); ok {
+					localAddrs.ips[n.IP.String()] = true
+				}
+			}
+		}
+		localAddrs.mtime = time.Now()
+	}
+	return localAddrs.ips[ip.String()]
+}
+
+// SetHairpinPolicy set how to handle the connections to the local host:
+// "proxy" handle them as the others, "direct" connect them directly, or
+// "reject" reject them.
+func (l *Local) SetHairpinPolicy(policy string) error {
+	switch policy {
+	case "proxy":
+		l.hairpinEnabled = false
+	case "direct":
+		l.hairpinEnabled, l.hairpinMode = true, DirectMode
+	case "reject":
+		l.hairpinEnabled, l.hairpinMode = true, RejectMode
+	default:
+		return fmt.Errorf("unknown hairpin policy: %s", policy)
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+)
+
+// SetHashKey set the key of the hash mode, "pid" or "source" (the source IP
+// address).
+func (l *Local) SetHashKey(key string) error {
+	switch key {
+	case "pid", "source":
+		l.hashKey = key
+		return nil
+	}
+	return fmt.Errorf("unknown hash key: %s", key)
+}
+
+// hashSelect select the proxy among the available ones by hashing the key
+// of c, so the connections with the same key always use the same proxy.
+func (l *Local) hashSelect(c *ConnInfo) modeT {
+	key := c.Pid
+	if l.hashKey == "source" {
+		if host, _, err := net.SplitHostPort(c.SrcAddr); err == nil {
+			key = host
+		}
+	}
+	modes := l.availableProxyModes()
+	if len(modes) == 0 {
+		return OnlyHttpProxyMode
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return modes[h.Sum32()%uint32(len(modes))]
+}
+
+// availableProxyModes returns the modes of the available proxies.
+func (l *Local) availableProxyModes() []modeT {
+	var modes []modeT
+	if available(l.socks5Dialer) {
+		modes = append(modes, OnlySocks5Mode)
+	}
+	if available(l.httpProxyDialer) {
+		modes = append(modes, OnlyHttpProxyMode)
+	}
+	return modes
+}
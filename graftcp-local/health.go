@@ -0,0 +1,50 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// ReaderHealth is the health of a reader of the address info sent by graftcp.
+type ReaderHealth struct {
+	Name      string    `json:"name"`
+	Running   bool      `json:"running"`
+	Restarts  int       `json:"restarts"`
+	Records   int64     `json:"records"`
+	LastRead  time.Time `json:"last_read"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+type readerMonitor struct {
+	sync.Mutex
+	h ReaderHealth
+}
+
+func (m *readerMonitor) setRunning(running bool) {
+	m.Lock()
+	m.h.Running = running
+	if !running {
+		m.h.Restarts++
+	}
+	m.Unlock()
+}
+
+func (m *readerMonitor) read() {
+	m.Lock()
+	m.h.Records++
+	m.h.LastRead = time.Now()
+	m.Unlock()
+}
+
+func (m *readerMonitor) setError(err string) {
+	m.Lock()
+	m.h.LastError = err
+	m.Unlock()
+}
+
+// Health returns a snapshot of the health.
+func (m *readerMonitor) Health() ReaderHealth {
+	m.Lock()
+	defer m.Unlock()
+	return m.h
+}
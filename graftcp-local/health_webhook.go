@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+const (
+	healthWebhookQueueSize = 64
+	healthWebhookTimeout   = 5 * time.Second
+)
+
+// healthWebhookStats count the transitions "posted", "failed" to post, and
+// "dropped" as the queue is full.
+var healthWebhookStats = expvar.NewMap("health_webhook")
+
+// healthEvent is the JSON payload posted to the health webhook.
+type healthEvent struct {
+	Upstream string    `json:"upstream"`
+	Addr     string    `json:"addr,omitempty"` // address of the proxy
+	State    string    `json:"state"`          // "up" or "down"
+	Error    string    `json:"error,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// HealthWebhook post the transitions of the health of the upstreams to a
+// URL in JSON asynchronously, so the health checks are never delayed, the
+// transitions are dropped if the queue is full. A nil *HealthWebhook is valid
+// and does nothing.
+type HealthWebhook struct {
+	url    string
+	queue  chan healthEvent
+	client *http.Client
+}
+
+// SetHealthWebhook post the transitions of the health of the primary
+// upstream of primary_backup to the HTTP or HTTPS URL rawURL like:
+//
+//	{"upstream":"socks5","addr":"127.0.0.1:1080","state":"down","error":"...","time":"..."}
+func (l *Local) SetHealthWebhook(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("bad health webhook URL: %s", rawURL)
+	}
+	w := &HealthWebhook{
+		url:    rawURL,
+		queue:  make(chan healthEvent, healthWebhookQueueSize),
+		client: &http.Client{Timeout: healthWebhookTimeout},
+	}
+	go w.run()
+	l.healthWebhook = w
+	return nil
+}
+
+// notify queue the transition of the upstream name at addr to up or down,
+// with the error of the health check if down.
+func (w *HealthWebhook) notify(name, addr string, up bool, err error) {
+	if w == nil {
+		return
+	}
+	e := healthEvent{Upstream: name, Addr: addr, State: "up", Time: time.Now()}
+	if !up {
+		e.State = "down"
+		if err != nil {
+			e.Error = err.Error()
+		}
+	}
+	select {
+	case w.queue <- e:
+	default:
+		healthWebhookStats.Add("dropped", 1)
+	}
+}
+
+// run post the transitions queued in order.
+func (w *HealthWebhook) run() {
+	for e := range w.queue {
+		if err := w.post(e); err != nil {
+			healthWebhookStats.Add("failed", 1)
+			dlog.Errorf("post the %s transition of %s to the health webhook err: %s", e.State, e.Upstream, err.Error())
+			continue
+		}
+		healthWebhookStats.Add("posted", 1)
+	}
+}
+
+func (w *HealthWebhook) post(e healthEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/net/proxy"
+)
+
+// honeypotDialer dial the honeypot regardless of the destination.
+type honeypotDialer struct {
+	addr    string
+	forward proxy.Dialer
+}
+
+func (d *honeypotDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.forward.Dial(network, d.addr)
+}
+
+// SetHoneypot set the address of the honeypot, the connections of mode
+// honeypot are redirected to it instead of their destinations.
+func (l *Local) SetHoneypot(addr string) error {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return fmt.Errorf("bad honeypot address %s: %s", addr, err.Error())
+	}
+	l.honeypotDialer = &honeypotDialer{addr: addr, forward: l.fastOpen}
+	return nil
+}
+
+// usesHoneypot reports whether any of rules redirects to the honeypot.
+func usesHoneypot(rules []*Rule) bool {
+	for _, r := range rules {
+		if r.mode == HoneypotMode {
+			return true
+		}
+	}
+	return false
+}
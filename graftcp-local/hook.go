@@ -0,0 +1,14 @@
+package main
+
+import "golang.org/x/net/proxy"
+
+// PreDialHook is called after the pid and the destination of a connection
+// are resolved but before dialing. A returned error rejects the connection,
+// a returned dialer overrides the selection of the proxy, and nil, nil uses
+// the default selection. It's called after the middlewares of Use.
+type PreDialHook func(ConnInfo) (proxy.Dialer, error)
+
+// SetPreDialHook set the hook called before dialing the destinations.
+func (l *Local) SetPreDialHook(hook PreDialHook) {
+	l.preDialHook = hook
+}
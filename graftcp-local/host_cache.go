@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// hostDecision is the rule matching the connections to a host:port.
+type hostDecision struct {
+	rule    *Rule // nil if no rule matched
+	expires time.Time
+}
+
+// hostCache remember the rules matched by the host name and the port for
+// ttl, so the connections to a host name behind the DNS round-robin match the
+// same rule even if it's resolved to the other IPs. The mode is selected for
+// each connection, as it depends on the DSCP, the time and the flow.
+type hostCache struct {
+	ttl time.Duration
+
+	mu        sync.Mutex
+	decisions map[string]hostDecision
+	nextSweep time.Time
+}
+
+// SetHostCacheTTL remember the rules matched by the connections to the proxy
+// front-ends by the requested host name and the port for ttl, no cache if 0.
+// Nothing is cached if any rule matches the process of the connections, as
+// the rules matched differ by the processes.
+func (l *Local) SetHostCacheTTL(ttl time.Duration) {
+	if ttl <= 0 {
+		l.hostCache = nil
+		return
+	}
+	l.hostCache = &hostCache{ttl: ttl, decisions: make(map[string]hostDecision)}
+}
+
+// get returns the decision cached for key.
+func (hc *hostCache) get(key string) (hostDecision, bool) {
+	if hc == nil || key == "" {
+		return hostDecision{}, false
+	}
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	d, ok := hc.decisions[key]
+	if !ok || time.Now().After(d.expires) {
+		return hostDecision{}, false
+	}
+	return d, true
+}
+
+// put cache the decision d for key, the expired decisions are dropped at
+// most once per ttl.
+func (hc *hostCache) put(key string, d hostDecision) {
+	if hc == nil || key == "" {
+		return
+	}
+	now := time.Now()
+	d.expires = now.Add(hc.ttl)
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if now.After(hc.nextSweep) {
+		for k, old := range hc.decisions {
+			if now.After(old.expires) {
+				delete(hc.decisions, k)
+			}
+		}
+		hc.nextSweep = now.Add(hc.ttl)
+	}
+	hc.decisions[key] = d
+}
+
+// hostKey returns the key of the rule of the connection c in l.hostCache,
+// empty if it's not to be cached: c is not to a host name, or the rule
+// depends on the process of c.
+func (l *Local) hostKey(c *ConnInfo) string {
+	if c.Host == "" || l.processRules {
+		return ""
+	}
+	return net.JoinHostPort(c.Host, strconv.Itoa(int(c.DestPort)))
+}
+
+// reset drop all the cached decisions.
+func (hc *hostCache) reset() {
+	if hc == nil {
+		return
+	}
+	hc.mu.Lock()
+	hc.decisions = make(map[string]hostDecision)
+	hc.mu.Unlock()
+}
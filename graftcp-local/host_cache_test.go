@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// routeHost route the connection of pid from src to the host name
+// example.com:443 resolved to 192.0.2.1 at start with DSCP dscp, and returns
+// the mode selected.
+func routeHost(t *testing.T, l *Local, pid, src string, dscp int, start time.Time) modeT {
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	info := newConnInfo(pid, src, "192.0.2.1:443")
+	info.Host, info.Dscp = "example.com", dscp
+	ctx := l.newConnContext(conn, info, start)
+	if passed, err := runMiddleware(l.routeConn, ctx); !passed || err != nil {
+		t.Fatalf("routeConn passed %v, err %v", passed, err)
+	}
+	return ctx.Mode
+}
+
+func newHostCacheLocal(t *testing.T) *Local {
+	l := NewLocal("127.0.0.1:0", "127.0.0.1:1080", "", "", "127.0.0.1:8080")
+	l.SetSelectMode("only_socks5")
+	r, err := parseRule("only_http_proxy dest=198.51.100.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.SetRules([]*Rule{r})
+	l.SetHostCacheTTL(time.Minute)
+	return l
+}
+
+func TestHostCacheDscp(t *testing.T) {
+	l := newHostCacheLocal(t)
+	if err := l.SetDscpModes("ef:direct"); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if m := routeHost(t, l, "42", "127.0.0.1:40000", 46, now); m != DirectMode {
+		t.Fatalf("mode of DSCP ef %s, want direct", m)
+	}
+	if m := routeHost(t, l, "42", "127.0.0.1:40001", 0, now); m != OnlySocks5Mode {
+		t.Errorf("mode of DSCP 0 after DSCP ef cached %s, want only_socks5", m)
+	}
+}
+
+func TestHostCacheSchedule(t *testing.T) {
+	l := newHostCacheLocal(t)
+	if err := l.SetSchedule("09:00-18:00=direct", "UTC"); err != nil {
+		t.Fatal(err)
+	}
+	day := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	if m := routeHost(t, l, "42", "127.0.0.1:40000", -1, day); m != DirectMode {
+		t.Fatalf("mode in the window %s, want direct", m)
+	}
+	night := time.Date(2026, 1, 1, 20, 0, 0, 0, time.UTC)
+	if m := routeHost(t, l, "42", "127.0.0.1:40001", -1, night); m != OnlySocks5Mode {
+		t.Errorf("mode out of the window after cached %s, want only_socks5", m)
+	}
+}
+
+func TestHostCacheHash(t *testing.T) {
+	for _, mode := range []string{"hash", "consistent_hash"} {
+		l := newHostCacheLocal(t)
+		l.SetSelectMode(mode)
+		now := time.Now()
+		seen := make(map[modeT]bool)
+		for i := 0; i < 32; i++ {
+			pid, src := strconv.Itoa(100+i), fmt.Sprintf("127.0.0.1:%d", 40000+i)
+			want := l.routeMode(newConnInfo(pid, src, "192.0.2.1:443"), nil, l.selectMode)
+			if m := routeHost(t, l, pid, src, -1, now); m != want {
+				t.Errorf("%s: mode of pid %s from %s %s, want %s", mode, pid, src, m, want)
+			}
+			seen[want] = true
+		}
+		if len(seen) != 2 {
+			t.Errorf("%s: modes %v selected, want both proxies", mode, seen)
+		}
+	}
+}
+
+func TestHostCacheRule(t *testing.T) {
+	l := newHostCacheLocal(t)
+	now := time.Now()
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	info := newConnInfo("42", "127.0.0.1:40000", "198.51.100.1:443")
+	info.Host = "example.com"
+	if passed, err := runMiddleware(l.routeConn, l.newConnContext(conn, info, now)); !passed || err != nil {
+		t.Fatalf("routeConn passed %v, err %v", passed, err)
+	}
+	// resolved to the other IP not matching the rule
+	if m := routeHost(t, l, "42", "127.0.0.1:40001", -1, now); m != OnlyHttpProxyMode {
+		t.Errorf("mode after the rule cached %s, want only_http_proxy of the rule", m)
+	}
+}
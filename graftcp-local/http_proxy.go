@@ -16,6 +16,7 @@ type httpDialer struct {
 	isAuth   bool
 	username string
 	password string
+	header   http.Header // extra header of the CONNECT request
 
 	forward proxy.Dialer
 }
@@ -36,6 +37,9 @@ func (h *httpDialer) Dial(network, addr string) (net.Conn, error) {
 		Host:   addr,
 		Header: make(http.Header),
 	}
+	for k, v := range h.header {
+		req.Header[k] = v
+	}
 	if h.isAuth {
 		req.SetBasicAuth(h.username, h.password)
 	}
@@ -75,3 +79,51 @@ func init() {
 	proxy.RegisterDialerType("http", newHttpProxy)
 	proxy.RegisterDialerType("https", newHttpProxy)
 }
+
+// headerList is a list of the headers with format "Name: value", it can be
+// used as a flag given multiple times.
+type headerList []string
+
+func (h *headerList) String() string {
+	return ""
+}
+
+func (h *headerList) Set(s string) error {
+	*h = append(*h, s)
+	return nil
+}
+
+// parseHeaders parse and validate the headers with format "Name: value".
+func parseHeaders(list []string) (http.Header, error) {
+	header := make(http.Header)
+	for _, line := range list {
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) < 2 {
+			return nil, fmt.Errorf("bad format of header: %s", line)
+		}
+		name, val := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		if !isHeaderName(name) {
+			return nil, fmt.Errorf("bad header name: %q", name)
+		}
+		if strings.ContainsAny(val, "\r\n") {
+			return nil, fmt.Errorf("bad value of header %s", name)
+		}
+		header.Add(name, val)
+	}
+	return header, nil
+}
+
+// isHeaderName reports whether s is a token defined in RFC 7230.
+func isHeaderName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+			strings.ContainsRune("!#$%&'*+-.^_`|~", c) {
+			continue
+		}
+		return false
+	}
+	return true
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	"golang.org/x/net/proxy"
+)
+
+var (
+	// httpProxyPoolStats and socks5PoolStats count the dials to the proxies
+	// by whether a pooled connection is used.
+	httpProxyPoolStats = expvar.NewMap("http_proxy_pool")
+	socks5PoolStats    = expvar.NewMap("socks5_pool")
+
+	poolStats = map[string]*expvar.Map{"http_proxy": httpProxyPoolStats, "socks5": socks5PoolStats}
+)
+
+// pooledConn is an idle connection to the proxy.
+type pooledConn struct {
+	net.Conn
+	since time.Time
+}
+
+// connPool keep up to size idle connections to the proxy at addr dialed in
+// advance, so the CONNECT request or the SOCKS5 handshake is sent without
+// waiting for the TCP handshake. A tunnel can't be reused after it's closed,
+// so each idle connection is used once, and the pool is filled again in the
+// background.
+type connPool struct {
+	name    string // upstream name
+	addr    string
+	forward proxy.Dialer
+	size    int
+	idle    time.Duration // close the idle connections after it
+	stats   *expvar.Map
+
+	mu      sync.Mutex
+	conns   []pooledConn
+	filling bool
+}
+
+// SetHttpProxyPool keep up to size idle connections to the HTTP proxy dialed
+// in advance, they are closed after idle, no pool if size <= 0.
+func (l *Local) SetHttpProxyPool(size int, idle time.Duration) {
+	l.setWarmPool("http_proxy", size, idle)
+}
+
+// SetWarmPool keep the idle connections to the proxies of the upstreams
+// dialed in advance by sizes like "socks5=4,http_proxy=8", they are closed
+// after idle.
+func (l *Local) SetWarmPool(sizes string, idle time.Duration) error {
+	for _, kv := range strings.Split(sizes, ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("bad warm_pool: %s", kv)
+		}
+		name := strings.TrimSpace(parts[0])
+		if poolStats[name] == nil {
+			return fmt.Errorf("unknown upstream in warm_pool: %s", name)
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || size < 0 {
+			return fmt.Errorf("bad size of %s in warm_pool: %s", name, parts[1])
+		}
+		l.setWarmPool(name, size, idle)
+	}
+	return nil
+}
+
+// setWarmPool keep up to size idle connections to the proxy of the upstream
+// name dialed in advance, no pool if size <= 0 or the proxies are from the
+// proxy list.
+func (l *Local) setWarmPool(name string, size int, idle time.Duration) {
+	addr := l.socks5Addr
+	if name == "http_proxy" {
+		addr = l.httpProxyAddr
+	}
+	d := l.forwards[name]
+	if d.pool != nil {
+		d.pool.flush()
+		d.pool = nil
+	}
+	if addr == "" || size <= 0 {
+		return
+	}
+	d.pool = &connPool{name: name, addr: addr, forward: unpooledDialer{d}, size: size, idle: idle,
+		stats: poolStats[name]}
+	go d.pool.fill()
+}
+
+func (p *connPool) Dial(network, addr string) (net.Conn, error) {
+	if addr != p.addr {
+		return p.forward.Dial(network, addr)
+	}
+	defer func() { go p.fill() }()
+	for {
+		conn := p.get()
+		if conn == nil {
+			break
+		}
+		if isIdleConnAlive(conn) {
+			p.stats.Add("hits", 1)
+			return conn, nil
+		}
+		conn.Close()
+	}
+	p.stats.Add("misses", 1)
+	return p.forward.Dial(network, addr)
+}
+
+// get returns the latest idle connection not expired, or nil if none.
+func (p *connPool) get() net.Conn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.expire()
+	if len(p.conns) == 0 {
+		return nil
+	}
+	c := p.conns[len(p.conns)-1]
+	p.conns = p.conns[:len(p.conns)-1]
+	return c.Conn
+}
+
+// expire close the idle connections expired, p.mu must be held.
+func (p *connPool) expire() {
+	if p.idle <= 0 {
+		return
+	}
+	i := 0
+	for ; i < len(p.conns) && time.Since(p.conns[i].since) > p.idle; i++ {
+		p.conns[i].Close()
+	}
+	p.conns = p.conns[i:]
+}
+
+// fill dial the idle connections until there are size of them.
+func (p *connPool) fill() {
+	p.mu.Lock()
+	if p.filling {
+		p.mu.Unlock()
+		return
+	}
+	p.filling = true
+	p.expire()
+	n := p.size - len(p.conns)
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		p.filling = false
+		p.mu.Unlock()
+	}()
+	for ; n > 0; n-- {
+		conn, err := dialTimeout(context.Background(), p.forward, p.addr, probeTimeout)
+		if err != nil {
+			dlog.Debugf("fill the pool of the %s proxy %s err: %s", p.name, p.addr, err.Error())
+			return
+		}
+		p.mu.Lock()
+		p.conns = append(p.conns, pooledConn{Conn: conn, since: time.Now()})
+		p.mu.Unlock()
+	}
+}
+
+// resetWarmPool close the idle connections to the proxy of the upstream name
+// when it's down, and fill its pool again when it's up.
+func (l *Local) resetWarmPool(name string, up bool) {
+	d := l.forwards[name]
+	if d == nil || d.pool == nil {
+		return
+	}
+	if up {
+		go d.pool.fill()
+	} else {
+		d.pool.flush()
+	}
+}
+
+// flush close the idle connections, e.g. the proxy is down.
+func (p *connPool) flush() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range p.conns {
+		c.Close()
+	}
+	p.conns = nil
+}
+
+// isIdleConnAlive reports whether the idle connection conn is still open,
+// nothing is expected to be read from it.
+func isIdleConnAlive(conn net.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	defer conn.SetReadDeadline(time.Time{})
+	var b [1]byte
+	_, err := conn.Read(b[:])
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// ServeHttpProxy serve an HTTP proxy front-end on addr for the apps not
+// traced by graftcp, only the CONNECT method is supported, and the basic
+// Proxy-Authorization is required if the inbound secret is set.
+func (l *Local) ServeHttpProxy(addr string) {
+	l.serveFrontend("HTTP proxy", addr, func(conn net.Conn) frontendConn {
+		return &httpConn{Conn: conn, r: bufio.NewReader(conn), secret: l.inboundSecret, passHost: l.strictProxy}
+	})
+}
+
+// httpConn is a connection to the HTTP proxy front-end.
+type httpConn struct {
+	net.Conn
+	r        *bufio.Reader // may buffer the data sent after the request
+	host     string        // host name requested, empty if an IP address
+	secret   string        // password required if not empty
+	passHost bool          // pass the host name requested to the proxies unresolved
+	replied  bool
+}
+
+func (hc *httpConn) Read(p []byte) (int, error) {
+	return hc.r.Read(p)
+}
+
+// handshake read the CONNECT request.
+func (hc *httpConn) handshake(ctx context.Context) (string, error) {
+	req, err := http.ReadRequest(hc.r)
+	if err != nil {
+		hc.reply(http.StatusBadRequest)
+		return "", err
+	}
+	if req.Method != "CONNECT" {
+		hc.reply(http.StatusMethodNotAllowed)
+		return "", fmt.Errorf("unsupported HTTP method: %s", req.Method)
+	}
+	if hc.secret != "" {
+		req.Header.Set("Authorization", req.Header.Get("Proxy-Authorization"))
+		if _, password, ok := req.BasicAuth(); !ok || !secretEqual(password, hc.secret) {
+			hc.replied = true
+			fmt.Fprintf(hc, "HTTP/1.1 %d %s\r\nProxy-Authenticate: Basic realm=\"graftcp-local\"\r\n\r\n",
+				http.StatusProxyAuthRequired, http.StatusText(http.StatusProxyAuthRequired))
+			return "", errBadSecret
+		}
+	}
+	host, port, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		hc.reply(http.StatusBadRequest)
+		return "", err
+	}
+	if net.ParseIP(host) == nil {
+		hc.host = host
+	}
+	if host, err = resolveHost(ctx, host, hc.passHost); err != nil {
+		hc.reply(http.StatusBadGateway)
+		return "", err
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+func (hc *httpConn) reply(code int) {
+	if hc.replied {
+		return
+	}
+	hc.replied = true
+	text := http.StatusText(code)
+	if code == http.StatusOK {
+		text = "Connection established"
+	}
+	fmt.Fprintf(hc, "HTTP/1.1 %d %s\r\n\r\n", code, text)
+}
+
+// replyError reply the status code with the reason as the body.
+func (hc *httpConn) replyError(code int, reason string) {
+	if hc.replied {
+		return
+	}
+	hc.replied = true
+	body := reason + "\n"
+	fmt.Fprintf(hc, "HTTP/1.1 %d %s\r\nContent-Type: text/plain\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s",
+		code, http.StatusText(code), len(body), body)
+}
+
+func (hc *httpConn) replyDial(err error) {
+	if err == nil {
+		hc.reply(http.StatusOK)
+		return
+	}
+	switch reason := dialErrorReason(err); reason {
+	case "rejected":
+		hc.replyError(http.StatusForbidden, "the connection is rejected by graftcp-local")
+	case "timeout":
+		hc.replyError(http.StatusGatewayTimeout, "dialing the destination timed out")
+	case "":
+		hc.replyError(http.StatusBadGateway, "dialing the destination failed")
+	default:
+		hc.replyError(http.StatusBadGateway, "dialing the destination failed: "+reason)
+	}
+}
+
+func (hc *httpConn) requestedHost() string {
+	return hc.host
+}
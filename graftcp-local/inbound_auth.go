@@ -0,0 +1,40 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+var errBadSecret = errors.New("bad inbound secret")
+
+// SetInboundSecret set the shared secret the inbound connections must present,
+// no secret is required if it's empty. The connections to the listener send
+// the secret and a '\n' before the data, the SOCKS5 front-end requires it as
+// the password, and the HTTP proxy front-end as the password of the basic
+// Proxy-Authorization, with any user name.
+func (l *Local) SetInboundSecret(secret string) {
+	l.inboundSecret = secret
+}
+
+// readSecret read the secret and the '\n' sent first on conn, returns
+// errBadSecret if it's not secret or not sent in time.
+func readSecret(conn net.Conn, secret string) error {
+	buf := make([]byte, len(secret)+1)
+	conn.SetReadDeadline(time.Now().Add(frontendHandshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return errBadSecret
+	}
+	if !secretEqual(string(buf[:len(secret)]), secret) || buf[len(secret)] != '\n' {
+		return errBadSecret
+	}
+	return nil
+}
+
+// secretEqual compare a with the secret b in constant time.
+func secretEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// setKeepAliveIdle enable the TCP keepalive of conn with the idle time. The
+// kernel counts the idle time from the last packet with data, so the probes
+// are only sent on the connections idle for that long, and stop as soon as
+// the data flows again.
+func setKeepAliveIdle(conn net.Conn, idle time.Duration) {
+	tc := tcpConnOf(conn)
+	if tc == nil {
+		return
+	}
+	tc.SetKeepAlive(true)
+	tc.SetKeepAlivePeriod(idle)
+}
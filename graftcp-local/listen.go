@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/jedisct1/dlog"
+)
+
+// SetReusePort let the listener share the listen address with the other
+// graftcp-local listening on it with SO_REUSEPORT, the connections are split
+// between them by the kernel. The listen address is exclusive by default, so
+// a second graftcp-local on it fails to start.
+func (l *Local) SetReusePort() {
+	l.reusePort = true
+}
+
+// listen listen on addr, exclusively unless reuseport is set, the error tells
+// the processes listening on addr if it's in use.
+func (l *Local) listen(addr *net.TCPAddr) (*net.TCPListener, error) {
+	if !l.reusePort {
+		ln, err := net.ListenTCP("tcp", addr)
+		if err != nil && isListenAddrInUse(err) {
+			return nil, fmt.Errorf("the address is already in use by %s, is another graftcp-local running? "+
+				"listen another address, or use -reuseport to share it with another graftcp-local",
+				listenerNames(addr, ""))
+		}
+		return ln, err
+	}
+	ln, err := listenReusePort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if names := listenerNames(addr, strconv.Itoa(os.Getpid())); names != "" {
+		dlog.Noticef("share %s with %s, the connections are split between them", addr, names)
+	}
+	return ln, nil
+}
+
+// isListenAddrInUse reports whether err is EADDRINUSE of listen. Unlike
+// isAddrInUse, it's false for EADDRNOTAVAIL, which means the address is not
+// local.
+func isListenAddrInUse(err error) bool {
+	if e, ok := err.(*net.OpError); ok {
+		err = e.Err
+	}
+	if e, ok := err.(*os.SyscallError); ok {
+		err = e.Err
+	}
+	return err == syscall.EADDRINUSE
+}
+
+// listenerNames returns the commands and the pids of the processes except
+// self listening on addr like "graftcp-local(1234)". If none is found, e.g.
+// of another user, it's "another process" if self is empty, or empty if not.
+func listenerNames(addr *net.TCPAddr, self string) string {
+	var names []string
+	for _, pid := range listenerPids(addr, self) {
+		comm, _ := procComm(pid)
+		names = append(names, comm+"("+pid+")")
+	}
+	if len(names) == 0 && self == "" {
+		return "another process"
+	}
+	return strings.Join(names, ", ")
+}
+
+// listenerPids returns the pids of the processes except self listening on
+// the TCP addr, or on the same port of any address if addr or the listener
+// is of the unspecified address.
+func listenerPids(addr *net.TCPAddr, self string) []string {
+	links := make(map[string]bool)
+	port := fmt.Sprintf("%04X", addr.Port)
+	for _, isTCP6 := range []bool{false, true} {
+		sockets, _ := readProcNetTCP(isTCP6)
+		for _, fields := range sockets {
+			if fields[3] != "0A" /* TCP_LISTEN */ {
+				continue
+			}
+			hexIP := strings.SplitN(fields[1], ":", 2)
+			if len(hexIP) != 2 || hexIP[1] != port {
+				continue
+			}
+			if addr.IP == nil || addr.IP.IsUnspecified() || strings.Trim(hexIP[0], "0") == "" ||
+				hexIP[0] == ip2Hex(addr.IP) {
+				links[socketLink(fields[9])] = true
+			}
+		}
+	}
+	var pids []string
+	if len(links) == 0 {
+		return pids
+	}
+	dirs, _ := filepath.Glob("/proc/[0-9]*")
+	for _, dir := range dirs {
+		pid := filepath.Base(dir)
+		if pid == self {
+			continue
+		}
+		if found, _ := hasFdLink(dir+"/fd/", links); found {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
@@ -1,14 +1,15 @@
 package main
 
 import (
-	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"math/rand"
 	"net"
+	"net/http"
 	"net/url"
-	"os"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jedisct1/dlog"
@@ -28,6 +29,18 @@ const (
 	OnlyHttpProxyMode
 	// DirectMode direct connect
 	DirectMode
+	// RejectMode reject the connection without dialing
+	RejectMode
+	// HoneypotMode redirect the connections to the honeypot instead of their
+	// destinations
+	HoneypotMode
+	// HashSelectMode select the reachable proxy by hashing the pid or the
+	// source address, so the same process always uses the same proxy
+	HashSelectMode
+	// ConsistentHashSelectMode select the reachable proxy by the consistent
+	// hashing of the source and the destination address, so a flow always
+	// uses the same proxy, and the flows are distributed evenly
+	ConsistentHashSelectMode
 )
 
 type Local struct {
@@ -35,13 +48,147 @@ type Local struct {
 
 	faddrString string
 
+	lnMu    sync.Mutex
+	ln      *net.TCPListener
+	closing bool // if the listener is closed by Shutdown
+
 	socks5Dialer    proxy.Dialer
 	httpProxyDialer proxy.Dialer
 	directDialer    proxy.Dialer
+	fastOpen        *fastOpenDialer         // dial the proxies and the direct connections
+	forwards        map[string]*boundDialer // dialers of the proxies and direct by upstream name
+	honeypotDialer  *honeypotDialer         // nil if no honeypot
+	socks5Addr      string                  // empty if from the proxy list
+	socks5Auth      *proxy.Auth
+	socks5Password  string
+	httpProxyAddr   string
+	httpProxyHeader http.Header // extra header of the CONNECT request
+
+	proxyHosts map[string]string // addresses of the proxies as given by upstream name
+
+	socks5UserTemplate userTemplate // SOCKS5 username for each connection, the socks5_username if nil
+
+	// probes of the protocols spoken by the proxies by upstream name, no
+	// probe if nil, and the dialers are fixed by the probes if probeFix
+	probes   map[string]*upstreamProbe
+	probeFix bool
+
+	sources  []*addrSourceRunner // sources of the address info
+	resolver PidResolver
+
+	selectMode  modeT
+	schedule    []scheduleWindow // modes by the time of the day
+	scheduleLoc *time.Location
+	familyModes map[string]modeT // modes by the address family of the destination
+	dscpModes   map[int]modeT    // modes by the DSCP of the connection
+	asnDB       atomic.Value     // *mmdbReader, ASNs of the destinations, nil if not loaded
+	asnDBPath   string           // reloaded on SIGHUP and by the control server
+	failover    []modeT          // the failover chain of the auto mode
+	hashKey     string           // key of the hash mode, "pid" or "source"
+	rand        *lockedRand      // source of the random selection
+	ringMu      sync.Mutex
+	ring        *hashRing // ring of the consistent hash mode
+	rules       []*Rule
+	ruleTrie    *ruleTrie      // index of the rules by destination
+	hostCache   *hostCache     // routing decisions by host:port, no cache if nil
+	affinity    *affinityCache // upstreams pinned by destination, no pinning if nil
+	failCache   *failCache     // destinations failed to dial recently, no cache if nil
+
+	primaryBackup *primaryBackup // replaces the failover chain of the auto mode if not nil
+
+	hairpinEnabled bool // if the connections to the local host use hairpinMode
+	hairpinMode    modeT
+
+	inboundSecret string // required on the inbound connections if not empty
+
+	proxyDestAction string // what to do with the connections to the proxies
+
+	DialTimeout time.Duration // no timeout if 0
+	DialRetry   int
+
+	// Abort the connections whose setup, from accepted until the destination
+	// is dialed, takes longer than SetupTimeout, no timeout if 0
+	SetupTimeout time.Duration
+
+	// Per connection rate limits in bytes per second, no limit if 0
+	UploadRate   int64 // from the app to the destination
+	DownloadRate int64 // from the destination to the app
+
+	// Close the connection if its process exits, checking every
+	// PidCheckInterval, no check if 0
+	PidCheckInterval time.Duration
+
+	// Dial directly from the source IP address of the connections to
+	// graftcp-local with IP_TRANSPARENT
+	Transparent bool
+
+	compressUpstreams map[string]bool // compress the connections to them
+
+	// Disable the Nagle's algorithm on both sides of the connections if
+	// NoDelay, as Go does by default
+	NoDelay bool
+
+	// Send the TCP keepalive probes only after the connections have been
+	// idle for KeepAliveIdle, the system default if 0
+	KeepAliveIdle time.Duration
+
+	// Timeouts of the directions of the connections
+	uploadTimeouts   pipeTimeouts // from the app to the destination
+	downloadTimeouts pipeTimeouts // from the destination to the app
+
+	// Wait for the other direction of the connections to finish until
+	// TeardownGrace after a direction finishes, tear down at once if 0
+	TeardownGrace time.Duration
+
+	// Rate limits shared by all the connections, no limit if nil
+	uploadBucket   *tokenBucket
+	downloadBucket *tokenBucket
+
+	tracer        *Tracer
+	upstreams     map[string]*UpstreamStats // the stats by upstream name
+	budget        *Budget                   // no budget if nil
+	acceptBucket  *tokenBucket              // limit the accept rate, no limit if nil
+	acceptMaxWait time.Duration             // close the connections beyond the rate if they wait longer
+	pending       int64                     // connections admitted but not dialed, accessed atomically
+	maxPending    int64                     // shed the new connections beyond it, no limit if <= 0
+	preDialHook   PreDialHook
+	middlewares   []Middleware
+	handler       ConnHandler // the middlewares chained, built once
+	handlerOnce   sync.Once
+	accessLog     *accessLog       // no access log if nil
+	events        *EventBus        // no events published if nil
+	weights       *upstreamWeights // select the upstreams of the random mode evenly if nil
+
+	directFallbackNets []*net.IPNet // allowed to fall back to direct, all if nil
 
-	FifoFd *os.File
+	debugNets []*net.IPNet // log the connections to them in detail
 
-	selectMode modeT
+	captureNets []*net.IPNet // capture the traffic of the connections to them
+	captureDir  string
+
+	rejectDestClasses map[string]bool // classes of the bogus destinations to reject
+
+	allowPorts []portRange // allow all ports if empty
+	denyPorts  []portRange
+
+	allowlist *allowlistFile // allow all destinations if nil
+
+	// Semaphores limiting the concurrent connections by upstream name, no
+	// limit for the upstreams not in it
+	upstreamSlots map[string]chan struct{}
+
+	strictProxy bool // no direct in the auto mode, and no local DNS for the front-ends
+
+	processHeader *processHeader // header of the CONNECT request telling the process, not sent if nil
+
+	reusePort bool // share the listen address with SO_REUSEPORT
+
+	ptrCache *ptrCache // PTR names of the destinations, no lookup if nil
+	ptrRules bool      // any rule has the ptr matcher, no lookup if not
+
+	processRules bool // any rule matches the process, so the routing is never cached by host
+
+	healthWebhook *HealthWebhook // notified of the health transitions of the upstreams
 }
 
 func NewLocal(listenAddr, socks5Addr, socks5Username, socks5PassWord, httpProxyAddr string) *Local {
@@ -52,8 +199,15 @@ func NewLocal(listenAddr, socks5Addr, socks5Username, socks5PassWord, httpProxyA
 	local := &Local{
 		faddr:       listenTCPAddr,
 		faddrString: listenAddr,
+		resolver:    procPidResolver{},
+		upstreams:   newUpstreamStats(),
+		NoDelay:     true,
+		rand:        newLockedRand(time.Now().UnixNano()),
 	}
-	local.directDialer = proxy.Direct
+	local.fastOpen = &fastOpenDialer{}
+	local.forwards = newForwards(local.fastOpen)
+	local.directDialer = local.forwards["direct"]
+	local.proxyHosts = map[string]string{"socks5": socks5Addr, "http_proxy": httpProxyAddr}
 
 	socks5TCPAddr, err1 := net.ResolveTCPAddr("tcp", socks5Addr)
 	httpProxyTCPAddr, err2 := net.ResolveTCPAddr("tcp", httpProxyAddr)
@@ -70,60 +224,227 @@ func NewLocal(listenAddr, socks5Addr, socks5Username, socks5PassWord, httpProxyA
 				Password: socks5PassWord,
 			}
 		}
-		dialerSocks5, err := proxy.SOCKS5("tcp", socks5TCPAddr.String(), auth, proxy.Direct)
+		dialerSocks5, err := proxy.SOCKS5("tcp", socks5TCPAddr.String(), auth, local.forwards["socks5"])
 		if err != nil {
 			dlog.Errorf("proxy.SOCKS5(%s) fail: %s", socks5TCPAddr.String(), err.Error())
 		} else {
 			local.socks5Dialer = dialerSocks5
+			local.socks5Addr = socks5TCPAddr.String()
+			local.socks5Auth = auth
+			local.socks5Password = socks5PassWord
 		}
 	}
 	if err2 == nil {
 		httpProxyURI, _ := url.Parse("http://" + httpProxyTCPAddr.String())
-		dialerHttpProxy, err := proxy.FromURL(httpProxyURI, proxy.Direct)
+		dialerHttpProxy, err := proxy.FromURL(httpProxyURI, local.forwards["http_proxy"])
 		if err != nil {
 			dlog.Errorf("proxy.FromURL(%v) err: %s", httpProxyURI, err.Error())
 		} else {
 			local.httpProxyDialer = dialerHttpProxy
+			local.httpProxyAddr = httpProxyTCPAddr.String()
 		}
 	}
 	return local
 }
 
-// SetSelectMode set the select mode for l.
-func (l *Local) SetSelectMode(mode string) {
+var modeNames = []string{
+	AutoSelectMode:           "auto",
+	RandomSelectMode:         "random",
+	OnlySocks5Mode:           "only_socks5",
+	OnlyHttpProxyMode:        "only_http_proxy",
+	DirectMode:               "direct",
+	RejectMode:               "reject",
+	HoneypotMode:             "honeypot",
+	HashSelectMode:           "hash",
+	ConsistentHashSelectMode: "consistent_hash",
+}
+
+func (m modeT) String() string {
+	if int(m) < len(modeNames) {
+		return modeNames[m]
+	}
+	return fmt.Sprintf("mode(%d)", int(m))
+}
+
+func parseSelectMode(mode string) (modeT, bool) {
 	switch mode {
 	case "auto":
-		l.selectMode = AutoSelectMode
+		return AutoSelectMode, true
 	case "random":
-		l.selectMode = RandomSelectMode
+		return RandomSelectMode, true
+	case "hash":
+		return HashSelectMode, true
+	case "consistent_hash":
+		return ConsistentHashSelectMode, true
 	case "only_http_proxy":
-		l.selectMode = OnlyHttpProxyMode
+		return OnlyHttpProxyMode, true
 	case "only_socks5":
-		l.selectMode = OnlySocks5Mode
+		return OnlySocks5Mode, true
 	case "direct":
-		l.selectMode = DirectMode
+		return DirectMode, true
+	case "reject":
+		return RejectMode, true
+	case "honeypot":
+		return HoneypotMode, true
+	}
+	return 0, false
+}
+
+// SetHttpProxyHeaders set the extra headers of the CONNECT request sent to
+// the HTTP proxy.
+func (l *Local) SetHttpProxyHeaders(headers []string) error {
+	header, err := parseHeaders(headers)
+	if err != nil {
+		return err
+	}
+	l.httpProxyHeader = header
+	if d, ok := l.httpProxyDialer.(*httpDialer); ok {
+		d.header = header
+	}
+	return nil
+}
+
+// SetSelectMode set the select mode for l.
+func (l *Local) SetSelectMode(mode string) {
+	if m, ok := parseSelectMode(mode); ok {
+		l.selectMode = m
+	}
+}
+
+// SetDirectLocalPort set the local port or port range like "40000-40099"
+// used by the direct connections.
+func (l *Local) SetDirectLocalPort(port string) error {
+	p, err := parsePortRange(port)
+	if err != nil {
+		return err
+	}
+	l.directDialer = &portRangeDialer{ports: p, forward: l.forwards["direct"]}
+	return nil
+}
+
+// SetTracer set the tracer exporting the spans of the connections.
+func (l *Local) SetTracer(t *Tracer) {
+	l.tracer = t
+}
+
+// SetEventBus set the bus publishing the events of the connections.
+func (l *Local) SetEventBus(b *EventBus) {
+	l.events = b
+}
+
+// SetBudget set the budget of the connections.
+func (l *Local) SetBudget(b *Budget) {
+	l.budget = b
+}
+
+// SetPortFilter set the destination ports allowed and denied to connect, in
+// format like "22,80,443,8000-8999", all ports are allowed if allow is empty.
+func (l *Local) SetPortFilter(allow, deny string) (err error) {
+	if allow != "" {
+		if l.allowPorts, err = parsePortRanges(allow); err != nil {
+			return err
+		}
+	}
+	if deny != "" {
+		if l.denyPorts, err = parsePortRanges(deny); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isPortAllowed reports whether the destination port is allowed to connect.
+func (l *Local) isPortAllowed(port uint16) bool {
+	if len(l.allowPorts) > 0 && !portInRanges(port, l.allowPorts) {
+		return false
+	}
+	return !portInRanges(port, l.denyPorts)
+}
+
+// SetTotalRate set the rate limits in bytes per second shared by all the
+// connections, no limit if 0. They work with the per connection rate limits,
+// and the more restrictive one wins.
+func (l *Local) SetTotalRate(upload, download int64) {
+	if upload > 0 {
+		l.uploadBucket = newTokenBucket(upload)
+	}
+	if download > 0 {
+		l.downloadBucket = newTokenBucket(download)
+	}
+}
+
+// SetRules set the rules for l, the mode of the first rule matching the
+// destination is used instead of the select mode.
+func (l *Local) SetRules(rules []*Rule) {
+	l.rules = rules
+	l.ruleTrie = newRuleTrie(rules)
+	l.ptrRules, l.processRules = false, false
+	for _, r := range rules {
+		if len(r.ptrs) > 0 {
+			l.ptrRules = true
+		}
+		if r.matchesProcess() {
+			l.processRules = true
+		}
+	}
+}
+
+// matchRule returns the first rule matching the connection c, or nil if no
+// rule matches.
+func (l *Local) matchRule(c *ConnInfo) *Rule {
+	if l.ruleTrie == nil {
+		return nil
+	}
+	for _, i := range l.ruleTrie.candidates(c.DestIP) {
+		// the destination is matched by the trie
+		if r := l.rules[i]; r.matchExceptDest(c) {
+			return r
+		}
+	}
+	return nil
+}
+
+// routeMode returns the mode of the connection c matching the rule r,
+// defaultMode if r is nil.
+func (l *Local) routeMode(c *ConnInfo, r *Rule, defaultMode modeT) modeT {
+	mode := defaultMode
+	if r != nil {
+		mode = r.mode
+	}
+	if l.hairpinEnabled && isLocalIP(c.DestIP) {
+		dlog.Infof("Dest Addr: %s is the local host, use mode %s", c.DestAddr, l.hairpinMode)
+		mode = l.hairpinMode
+	}
+	switch mode {
+	case HashSelectMode:
+		mode = l.hashSelect(c)
+	case ConsistentHashSelectMode:
+		mode = l.consistentHashSelect(c)
 	}
+	return mode
 }
 
-func (l *Local) proxySelector() proxy.Dialer {
+func (l *Local) proxySelector(mode modeT) proxy.Dialer {
 	if l == nil {
 		return nil
 	}
-	switch l.selectMode {
+	switch mode {
 	case AutoSelectMode:
-		if l.socks5Dialer != nil {
-			return l.socks5Dialer
-		} else if l.httpProxyDialer != nil {
-			return l.httpProxyDialer
-		}
-		return l.directDialer
+		return l.proxySelector(l.failoverChain()[0])
 	case RandomSelectMode:
-		if l.socks5Dialer != nil && l.httpProxyDialer != nil {
-			if rand.Intn(2) == 0 {
+		if available(l.socks5Dialer) && available(l.httpProxyDialer) {
+			// prefer the one not at its limit of the concurrent connections
+			if l.saturated("socks5") != l.saturated("http_proxy") {
+				if l.saturated("socks5") {
+					return l.httpProxyDialer
+				}
+				return l.socks5Dialer
+			}
+			if l.weights.pick(l.rand, "socks5", "http_proxy") == "socks5" {
 				return l.socks5Dialer
 			}
 			return l.httpProxyDialer
-		} else if l.socks5Dialer != nil {
+		} else if available(l.socks5Dialer) {
 			return l.socks5Dialer
 		}
 		return l.httpProxyDialer
@@ -133,40 +454,107 @@ func (l *Local) proxySelector() proxy.Dialer {
 		return l.httpProxyDialer
 	case DirectMode:
 		return l.directDialer
+	case RejectMode:
+		return nil
+	case HoneypotMode:
+		if l.honeypotDialer == nil {
+			return nil
+		}
+		return l.honeypotDialer
 	default:
 		return l.socks5Dialer
 	}
 }
 
 func (l *Local) Start() {
-	ln, err := net.ListenTCP("tcp", l.faddr)
+	ln, err := l.listen(l.faddr)
 	if err != nil {
-		dlog.Fatalf("net.ListenTCP(%s) err: %s", l.faddr.String(), err.Error())
+		dlog.Fatalf("listen %s err: %s", l.faddr.String(), err.Error())
 	}
-	defer ln.Close()
+	l.lnMu.Lock()
+	if l.closing {
+		l.lnMu.Unlock()
+		ln.Close()
+		return
+	}
+	l.ln = ln
+	l.lnMu.Unlock()
 	dlog.Infof("graftcp-local start listening %s...", l.faddr.String())
 
+	// serve the current listener until it's swapped by Rebind or closed by
+	// Shutdown
+	for {
+		l.lnMu.Lock()
+		ln, closing := l.ln, l.closing
+		l.lnMu.Unlock()
+		if closing {
+			return
+		}
+		l.serve(ln)
+	}
+}
+
+// serve accept the connections from ln until it's not the listener of l.
+func (l *Local) serve(ln *net.TCPListener) {
+	defer ln.Close()
+	l.enableDscp(ln)
 	for {
 		conn, err := ln.AcceptTCP()
 		if err != nil {
+			l.lnMu.Lock()
+			current := l.ln == ln && !l.closing
+			l.lnMu.Unlock()
+			if !current {
+				return
+			}
 			dlog.Errorf("accept err: %s", err.Error())
 			continue
 		}
-		go l.HandleConn(conn)
+		if l.throttleAccept(conn) {
+			go l.HandleConn(conn)
+		}
 	}
 }
 
-func getPidByAddr(localAddr, remoteAddr string, isTCP6 bool) (pid string, destAddr string) {
+var (
+	// errUntraced means the connection is not from a process traced by
+	// graftcp, as no address info is sent for it.
+	errUntraced = errors.New("no address info is sent by graftcp")
+	// errPidAddrTaken means the address info of the process is found, but
+	// taken by its other connections before this one, which is a transient
+	// lookup miss rather than an untraced connection.
+	errPidAddrTaken = errors.New("the address info of the process is taken by its other connections")
+)
+
+func getPidByAddr(localAddr, remoteAddr string, isTCP6 bool) (pid string, destAddr string, err error) {
 	inode, err := getInodeByAddrs(localAddr, remoteAddr, isTCP6)
 	if err != nil {
-		dlog.Errorf("getInodeByAddrs(%s, %s) err: %s", localAddr, remoteAddr, err.Error())
-		return "", ""
+		return "", "", err
+	}
+	if inode == "" {
+		return "", "", fmt.Errorf("no inode found for %s", localAddr)
 	}
+	// the pids checked in the previous tries can be skipped
+	checked := make(map[string]bool)
+	// the pid found with only the duplicate address info, which is taken
+	// only if its address info is not received in the tries
+	var dupPid string
 	for i := 0; i < 3; i++ { // try 3 times
-		RangePidAddr(func(p, a string) bool {
+		RangePidAddr(func(p, a string, dup bool) bool {
+			if checked[p] {
+				if p == dupPid && !dup {
+					pid = p
+					return false
+				}
+				return true
+			}
+			checked[p] = true
 			if hasIncludeInode(p, inode) {
+				if dup {
+					dupPid = p
+					return true
+				}
 				pid = p
-				destAddr = a
 				return false
 			}
 			return true
@@ -176,92 +564,296 @@ func getPidByAddr(localAddr, remoteAddr string, isTCP6 bool) (pid string, destAd
 		}
 		time.Sleep(20 * time.Millisecond)
 	}
-	if pid != "" {
-		DeletePidAddr(pid)
+	if pid == "" {
+		pid = dupPid
 	}
-	return
+	if pid == "" {
+		return "", "", errUntraced
+	}
+	// the address info of pid may be taken by its other connection since
+	// ranged, wait for the address info of this one a bit more
+	for i := 0; i < 3; i++ {
+		if destAddr, ok := TakePidAddr(pid); ok {
+			return pid, destAddr, nil
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return "", "", errPidAddrTaken
 }
 
-func (l *Local) HandleConn(conn net.Conn) error {
+// HandleConn find the process and the destination of conn, and relay conn
+// to the destination through the upstream routed. The error returned is a
+// *ConnError, whose kind tells why conn failed.
+func (l *Local) HandleConn(conn net.Conn) (err error) {
+	start := time.Now()
+	defer func() { countConnError(err) }()
+	if !l.admit(conn) {
+		return connError(ErrRejected, "shed connection from "+conn.RemoteAddr().String(), nil)
+	}
+	// released once dialed, or on the return before it
+	pending := true
+	defer func() {
+		if pending {
+			l.release()
+		}
+	}()
+	span := l.tracer.Start("graftcp-local.conn", nil)
+	defer func() { span.End(err) }()
 	raddr := conn.RemoteAddr()
-	var isTCP6 bool
-	if strings.Contains(conn.LocalAddr().String(), "[") {
-		isTCP6 = true
+	span.SetAttr("net.peer.addr", raddr.String())
+	setup := l.newConnSetup(conn)
+	defer setup.finish()
+	setup.enter("pid lookup")
+	lookupSpan := l.tracer.Start("pid_lookup", span)
+	pid, destAddr, err := l.resolve(setup.ctx, conn)
+	lookupSpan.End(err)
+	lookupDone := time.Now()
+	if e := setup.err(); e != nil {
+		return setup.abort("connection from "+raddr.String(), e)
+	}
+	if err == errBadSecret {
+		dlog.Warnf("reject connection from %s: %s", raddr.String(), err.Error())
+		rejectConn(conn, "auth")
+		return connError(ErrRejected, "reject connection from "+raddr.String(), err)
+	}
+	if err == errUntraced {
+		dlog.Warnf("reject untraced connection from %s", raddr.String())
+		rejectConn(conn, "untraced")
+		return connError(ErrRejected, "reject untraced connection from "+raddr.String(), err)
 	}
-	pid, destAddr := getPidByAddr(raddr.String(), conn.LocalAddr().String(), isTCP6)
-	if pid == "" || destAddr == "" {
-		dlog.Errorf("getPidByAddr(%s, %s) failed", raddr.String(), conn.LocalAddr().String())
+	if err != nil {
+		dlog.Errorf("resolve the pid of %s err: %s", raddr.String(), err.Error())
+		connsLookupFailed.Add(1)
 		conn.Close()
-		return fmt.Errorf("can't find the pid and destAddr for %s", raddr.String())
+		return connError(ErrPidLookupFailed, "can't find the pid and destAddr for "+raddr.String(), err)
 	}
-	dlog.Infof("Request PID: %s, Source Addr: %s, Dest Addr: %s", pid, raddr.String(), destAddr)
-
-	dialer := l.proxySelector()
-	if dialer == nil {
-		dlog.Errorf("bad dialer,  please check the config for proxy")
+	_, isFrontend := conn.(frontendConn)
+	if err := checkDestAddr(destAddr, isFrontend); err != nil {
+		dlog.Errorf("reject PID: %s, bad Dest Addr: %q from %s: %s", pid, destAddr, raddr.String(), err.Error())
+		rejectConn(conn, "bad_dest")
+		return connError(ErrBadDest, fmt.Sprintf("bad destination address %q of PID %s", destAddr, pid), err)
+	}
+	setup.enter("routing")
+	info := newConnInfo(pid, raddr.String(), destAddr)
+	if fc, ok := conn.(frontendConn); ok {
+		info.Host = fc.requestedHost()
+	}
+	info.Dscp = l.readDscp(conn)
+	mc := l.newConnContext(conn, info, start)
+	mc.span = span
+	defer func() {
+		if err != nil {
+			mc.dbg.logf("done, err: %s", err.Error())
+		} else {
+			mc.dbg.logf("done")
+		}
+	}()
+	if e := l.connHandler()(mc); e != nil {
+		if ConnErrorKind(e) == nil {
+			dlog.Infof("reject PID: %s, Dest Addr: %s by a middleware: %s", pid, info.DestAddr, e.Error())
+			rejectConn(conn, "middleware")
+			e = connError(ErrRejected, fmt.Sprintf("%s is rejected by a middleware", info.DestAddr), e)
+		}
+		return e
+	}
+	destAddr, dbg, r, mode := info.DestAddr, mc.dbg, mc.Rule, mc.Mode
+	timeout, retry, uploadRate, downloadRate := mc.Timeout, mc.Retry, mc.UploadRate, mc.DownloadRate
+	if l.failCache.failed(destAddr) {
+		dlog.Infof("fail PID: %s, Dest Addr: %s fast as dialing it failed recently", pid, destAddr)
+		connsFailedFast.Add(1)
+		if r, ok := conn.(dialReplier); ok {
+			r.replyDial(errDestFailed)
+		}
 		conn.Close()
-		return fmt.Errorf("bad dialer")
+		return connError(ErrDialFailed, "dial "+destAddr, errDestFailed)
+	}
+	if l.budget != nil && !l.budget.Allow() {
+		dlog.Infof("reject PID: %s, Dest Addr: %s as the budget is exhausted", pid, destAddr)
+		rejectConn(conn, "budget")
+		return connError(ErrRejected, fmt.Sprintf("%s is rejected as the budget is exhausted", destAddr), nil)
+	}
+	chain := []modeT{mode}
+	if mode == AutoSelectMode {
+		chain = l.failoverChain()
+	}
+	pinnable := mode == AutoSelectMode || mode == RandomSelectMode
+	if pinnable {
+		chain = l.affinity.pinnedChain(destAddr, chain)
+	}
+	setup.enter("dial")
+	dialSpan := l.tracer.Start("dial", span)
+	dialStart := time.Now()
+	var destConn net.Conn
+	var dialer proxy.Dialer
+	if mc.Dialer != nil {
+		nd := l.namedDialer(mc.Dialer)
+		dialer = nd
+		destConn, err = l.dialUpstream(setup.ctx, nd, nd, destAddr, timeout, retry, true)
+	} else {
+		destConn, dialer, err = l.dialChain(setup.ctx, chain, info, timeout, retry)
+		if dialer != nil && err != context.DeadlineExceeded {
+			l.weights.update(l.upstreamName(dialer), err == nil)
+		}
+		if pinnable && err != errFailoverRejected && err != context.DeadlineExceeded {
+			l.affinity.update(destAddr, failoverDialerModes[l.upstreamName(dialer)], err == nil)
+		}
+	}
+	limited := err == nil // if a slot of the upstream is taken
+	dialDone := time.Now()
+	pending = false
+	l.release()
+	if e := setup.finish(); e != nil {
+		dialSpan.End(e)
+		if destConn != nil {
+			destConn.Close()
+		}
+		if limited {
+			l.releaseUpstream(l.upstreamName(dialer))
+		}
+		return setup.abort(fmt.Sprintf("PID: %s, Dest Addr: %s", pid, destAddr), e)
 	}
-	destConn, err := dialer.Dial("tcp", destAddr)
-	if err != nil && l.selectMode == AutoSelectMode { // AutoSelectMode try direct
-		dlog.Infof("dial %s direct", destAddr)
-		destConn, err = net.Dial("tcp", destAddr)
+	var via string // upstream and the proxy address used
+	if err == nil {
+		via = dialer.(*namedDialer).String()
+		dlog.Infof("connect PID: %s, Dest Addr: %s via %s", pid, destAddr, via)
+		dialSpan.SetAttr("proxy.used", l.upstreamName(dialer))
+		dbg.logf("dialed via %s", via)
+		if l.upstreamName(dialer) == "honeypot" {
+			dlog.Warnf("redirect PID: %s, Dest Addr: %s to the honeypot %s", pid, destAddr, l.honeypotDialer.addr)
+		}
+	}
+	dialSpan.End(err)
+	if r, ok := conn.(dialReplier); ok && err != errFailoverRejected {
+		r.replyDial(err)
+	}
+	if err == errFailoverRejected {
+		dlog.Infof("reject PID: %s, Dest Addr: %s by the failover chain", pid, destAddr)
+		rejectConn(conn, "failover")
+		return connError(ErrRejected, fmt.Sprintf("%s is rejected", destAddr), err)
 	}
 	if err != nil {
 		dlog.Errorf("dialer.Dial(%s) err: %s", destAddr, err.Error())
 		conn.Close()
-		return err
+		if err == ErrNoDialer {
+			return connError(ErrNoDialer, "dial "+destAddr, nil)
+		}
+		if err == errUpstreamBusy {
+			return connError(ErrDialFailed, "dial "+destAddr, err)
+		}
+		if destFailed(l.upstreamName(dialer), err) {
+			l.failCache.put(destAddr)
+		}
+		return connError(ErrDialFailed, "dial "+destAddr, err)
+	}
+	stats := l.upstreams[l.upstreamName(dialer)]
+	atomic.AddInt64(&stats.Conns, 1)
+	atomic.AddInt64(&stats.Active, 1)
+	ports := portStatsOf(info.DestPort)
+	ports.Add("conns", 1)
+	ports.Add("active", 1)
+	var uploadBuckets, downloadBuckets []*tokenBucket
+	if uploadRate > 0 {
+		uploadBuckets = append(uploadBuckets, newTokenBucket(uploadRate))
+	}
+	if downloadRate > 0 {
+		downloadBuckets = append(downloadBuckets, newTokenBucket(downloadRate))
+	}
+	if l.uploadBucket != nil {
+		uploadBuckets = append(uploadBuckets, l.uploadBucket)
+	}
+	if l.downloadBucket != nil {
+		downloadBuckets = append(downloadBuckets, l.downloadBucket)
+	}
+	setNoDelay(conn, l.NoDelay)
+	setNoDelay(destConn, l.NoDelay)
+	if r != nil && r.dscp >= 0 {
+		setConnDscp(destConn, r.dscp)
+	}
+	if l.KeepAliveIdle > 0 {
+		setKeepAliveIdle(conn, l.KeepAliveIdle)
+		setKeepAliveIdle(destConn, l.KeepAliveIdle)
 	}
 	readChan, writeChan := make(chan int64), make(chan int64)
-	go pipe(conn, destConn, writeChan)
-	go pipe(destConn, conn, readChan)
-	<-writeChan
-	<-readChan
+	var upCapture, downCapture io.Writer
+	if up, down := l.openCapture(info); up != nil {
+		dlog.Infof("capture PID: %s, Dest Addr: %s to %s", pid, destAddr, up.Name())
+		defer up.Close()
+		defer down.Close()
+		upCapture, downCapture = up, down
+	}
+	counters := &connCounters{}
+	torn := &teardown{}
+	go pipe(conn, destConn, downloadMeter, &counters.received, downloadBuckets, downCapture, l.downloadTimeouts,
+		l.TeardownGrace, torn, writeChan)
+	go pipe(destConn, conn, uploadMeter, &counters.sent, uploadBuckets, upCapture, l.uploadTimeouts,
+		l.TeardownGrace, torn, readChan)
+	record := accessRecord{Pid: pid, Src: raddr.String(), Dest: destAddr, Host: info.Host,
+		Upstream: l.upstreamName(dialer), Proxy: dialer.(*namedDialer).addr}
+	l.events.publish("open", record, counters, start)
+	recorder.conn("open", record, counters, start)
+	logRecord := record
+	logRecord.Lookup = lookupDone.Sub(start).Round(time.Microsecond).String()
+	logRecord.Dial = dialDone.Sub(dialStart).Round(time.Microsecond).String()
+	stopInterim := l.accessLog.startInterim(logRecord, counters, start)
+	if l.PidCheckInterval > 0 && pid != unknownPid {
+		done := make(chan struct{})
+		defer close(done)
+		go watchPid(pid, l.PidCheckInterval, done, conn, destConn)
+	}
+	received := <-writeChan
+	sent := <-readChan
 	conn.Close()
 	destConn.Close()
+	stopInterim()
+	l.accessLog.record("close", logRecord, counters, start)
+	l.events.publish("close", record, counters, start)
+	recorder.conn("close", record, counters, start)
+	atomic.AddInt64(&stats.Sent, sent)
+	atomic.AddInt64(&stats.Received, received)
+	atomic.AddInt64(&stats.Active, -1)
+	if limited {
+		l.releaseUpstream(l.upstreamName(dialer))
+	}
+	ports.Add("sent", sent)
+	ports.Add("received", received)
+	ports.Add("active", -1)
+	dbg.logf("closed, %d bytes sent, %d bytes received", sent, received)
+	span.SetAttr("bytes.sent", sent)
+	span.SetAttr("bytes.received", received)
 	return nil
 }
 
-func pipe(dst, src net.Conn, c chan int64) {
-	n, _ := io.Copy(dst, src)
-	now := time.Now()
-	dst.SetDeadline(now)
-	src.SetDeadline(now)
-	c <- n
-}
-
-func (l *Local) UpdateProcessAddrInfo() {
-	r := bufio.NewReader(l.FifoFd)
-	for {
-		line, _, err := r.ReadLine()
-		if err != nil {
-			dlog.Errorf("r.ReadLine err: %s", err.Error())
-			break
-		}
-		copyLine := string(line)
-		// dest_ipaddr:dest_port:pid
-		s := strings.Split(copyLine, ":")
-		if len(s) < 3 {
-			dlog.Errorf("r.ReadLine(): %s", copyLine)
-			continue
-		}
-		var (
-			pid  string
-			addr string
-		)
-		if len(s) > 3 { // IPv6
-			pid = s[len(s)-1]
-			destPort := s[len(s)-2]
-			destIP := copyLine[:len(copyLine)-2-len(pid)-len(destPort)]
-			addr = "[" + destIP + "]:" + destPort
-		} else { // IPv4
-			pid = s[2]
-			addr = s[0] + ":" + s[1]
-		}
-		go StorePidAddr(pid, addr)
+// pipe copy from src to dst, the bytes are counted by meter and count, and
+// the rate is limited by buckets if any, and the bytes are also written to
+// capture if it's not nil. The reads and the writes time out by timeouts.
+// When it's done, the EOF is passed to dst, and the other direction is torn
+// down after grace by torn, which is shared by the both directions.
+func pipe(dst, src net.Conn, meter *byteMeter, count *int64, buckets []*tokenBucket, capture io.Writer,
+	timeouts pipeTimeouts, grace time.Duration, torn *teardown, c chan int64) {
+	var r io.Reader = src
+	if timeouts.read > 0 {
+		r = deadlineReader{conn: src, timeout: timeouts.read, t: torn}
 	}
-}
-
-func init() {
-	rand.Seed(time.Now().UTC().UnixNano())
+	if capture != nil {
+		r = io.TeeReader(r, capture)
+	}
+	var w io.Writer = dst
+	if timeouts.write > 0 {
+		w = deadlineWriter{conn: dst, timeout: timeouts.write, t: torn}
+	}
+	if len(buckets) > 0 {
+		r = &pipeReader{r: r, buckets: buckets}
+	}
+	n, err := copyAdaptive(w, r, func(n int64) {
+		meter.add(int(n))
+		atomic.AddInt64(count, n)
+	})
+	if ne, ok := err.(net.Error); ok && ne.Timeout() && !torn.isTorn() {
+		dlog.Infof("close the connection %s -> %s: %s", src.RemoteAddr().String(), dst.RemoteAddr().String(), err.Error())
+	}
+	if grace > 0 {
+		closeWrite(dst)
+	}
+	torn.tear(dst, src, time.Now().Add(grace))
+	c <- n
 }
@@ -4,7 +4,10 @@ import (
 	"flag"
 	"fmt"
 	"os"
-	"syscall"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/jedisct1/dlog"
 	"github.com/kardianos/service"
@@ -13,12 +16,111 @@ import (
 var selectProxyMode string
 
 type App struct {
-	ListenAddr     string
-	Socks5Addr     string
-	Socks5Username string
-	Socks5Password string
-	HttpProxyAddr  string
-	PipePath       string
+	ListenAddr         string
+	ReusePort          bool
+	Socks5Addr         string
+	Socks5Username     string
+	Socks5Password     string
+	Socks5UserTemplate string
+	HttpProxyAddr      string
+	HttpProxyHeaders   headerList
+	HttpProcessHeader  string
+	HashKey            string
+	HttpProxyPoolSize  int
+	HttpProxyPoolIdle  time.Duration
+	WarmPool           string
+	WarmPoolIdle       time.Duration
+	ProxyList          string
+	ProxyListInterval  time.Duration
+	ProxyProbe         string
+	SelectModeIPv4     string
+	SelectModeIPv6     string
+	DscpModes          string
+	Schedule           string
+	ScheduleTimezone   string
+	RandSeed           int64
+	Failover           string
+	PrimaryBackup      string
+	HealthInterval     time.Duration
+	HealthWebhook      string
+	PipePath           string
+	FifoWait           time.Duration
+	AddrInfoListen     string
+	RuleFile           string
+	AsnDB              string
+	PtrWait            time.Duration
+	PtrCacheTTL        time.Duration
+	InboundSecret      string
+	ProxyDestAction    string
+	HairpinPolicy      string
+	DialTimeout        time.Duration
+	SetupTimeout       time.Duration
+	DialRetry          int
+	FailCacheTTL       time.Duration
+	UploadRate         string
+	DownloadRate       string
+	TotalUploadRate    string
+	TotalDownloadRate  string
+	PidCheckInterval   time.Duration
+	CompressUpstream   string
+	FastOpen           bool
+	FastOpenDirect     bool
+	OutboundDscp       string
+	NoDelay            bool
+	KeepAliveIdle      time.Duration
+	Transparent        bool
+	StrictProxy        bool
+	TeardownGrace      time.Duration
+	ReadTimeout        string
+	WriteTimeout       string
+	BudgetConns        int
+	BudgetBytes        string
+	BudgetWindow       time.Duration
+	BudgetAction       string
+	DirectLocalPort    string
+	UpstreamBind       string
+	UpstreamNetwork    string
+	UpstreamMaxConns   string
+	AllowPorts         string
+	DenyPorts          string
+	Allowlist          string
+	AllowlistInterval  time.Duration
+	RejectDestClasses  string
+	Socks5Listen       string
+	HttpProxyListen    string
+	DnsListen          string
+	DnsUpstream        string
+	HostCacheTTL       time.Duration
+	Honeypot           string
+	DirectFallbackDest string
+	AffinityTTL        time.Duration
+	WeightRecovery     time.Duration
+	ControlListen      string
+	ControlSocketMode  string
+	MetricsPorts       string
+	SyslogAddr         string
+	SyslogFacility     string
+	OtlpEndpoint       string
+	NatsURL            string
+	NatsSubject        string
+	PidAddrTTL         time.Duration
+	PidAddrMax         int
+	DrainTimeout       time.Duration
+	AcceptRate         int
+	AcceptRateAction   string
+	MaxPending         int
+	StatsFile          string
+	RecordFile         string
+	AccessLog          string
+	AccessLogInterval  time.Duration
+	DebugDest          string
+	CaptureDest        string
+	CaptureDir         string
+
+	configPath string // path of the config file loaded, empty if none
+
+	mu    sync.Mutex
+	local *Local // set when running
 }
 
 func (app *App) Start(s service.Service) error {
@@ -32,26 +134,312 @@ func (app *App) Start(s service.Service) error {
 	return nil
 }
 
-func (app *App) run() {
+// newLocal returns the Local configured by app.
+func (app *App) newLocal() *Local {
 	var err error
 
 	l := NewLocal(app.ListenAddr, app.Socks5Addr, app.Socks5Username, app.Socks5Password, app.HttpProxyAddr)
+	if app.ReusePort {
+		l.SetReusePort()
+	}
+	if app.UpstreamBind != "" {
+		if err := l.SetUpstreamBind(app.UpstreamBind); err != nil {
+			dlog.Fatal(err)
+		}
+	}
+	if app.UpstreamNetwork != "" {
+		if err := l.SetUpstreamNetwork(app.UpstreamNetwork); err != nil {
+			dlog.Fatal(err)
+		}
+	}
+	if app.UpstreamMaxConns != "" {
+		if err := l.SetUpstreamMaxConns(app.UpstreamMaxConns); err != nil {
+			dlog.Fatal(err)
+		}
+	}
+	if len(app.HttpProxyHeaders) > 0 {
+		if err := l.SetHttpProxyHeaders(app.HttpProxyHeaders); err != nil {
+			dlog.Fatalf("http_proxy_header err: %s", err.Error())
+		}
+	}
+	if app.HttpProcessHeader != "" {
+		if err := l.SetHttpProcessHeader(app.HttpProcessHeader); err != nil {
+			dlog.Fatalf("http_proxy_process_header err: %s", err.Error())
+		}
+	}
+	if app.Socks5UserTemplate != "" {
+		if err := l.SetSocks5UserTemplate(app.Socks5UserTemplate); err != nil {
+			dlog.Fatal(err)
+		}
+	}
+	if app.ProxyList != "" {
+		if err := l.SetProxyList(app.ProxyList, app.ProxyListInterval); err != nil {
+			dlog.Fatalf("load the proxy list from %s err: %s", app.ProxyList, err.Error())
+		}
+	}
+	if err := l.SetProxyProbe(app.ProxyProbe); err != nil {
+		dlog.Fatal(err)
+	}
+	l.SetHttpProxyPool(app.HttpProxyPoolSize, app.HttpProxyPoolIdle)
+	if app.WarmPool != "" {
+		if err := l.SetWarmPool(app.WarmPool, app.WarmPoolIdle); err != nil {
+			dlog.Fatal(err)
+		}
+	}
 	dlog.Infof("select_proxy_mode: %s", selectProxyMode)
 	l.SetSelectMode(selectProxyMode)
-
-	syscall.Mkfifo(app.PipePath, uint32(os.ModePerm))
-	os.Chmod(app.PipePath, 0666)
-	l.FifoFd, err = os.OpenFile(app.PipePath, os.O_RDWR, 0)
+	if app.RandSeed != 0 {
+		l.SetRandSeed(app.RandSeed)
+	}
+	if err := l.SetHashKey(app.HashKey); err != nil {
+		dlog.Fatal(err)
+	}
+	if app.SelectModeIPv4 != "" {
+		if err := l.SetFamilyMode("ipv4", app.SelectModeIPv4); err != nil {
+			dlog.Fatal(err)
+		}
+	}
+	if app.SelectModeIPv6 != "" {
+		if err := l.SetFamilyMode("ipv6", app.SelectModeIPv6); err != nil {
+			dlog.Fatal(err)
+		}
+	}
+	if app.DscpModes != "" {
+		if err := l.SetDscpModes(app.DscpModes); err != nil {
+			dlog.Fatal(err)
+		}
+	}
+	if app.Schedule != "" {
+		if err := l.SetSchedule(app.Schedule, app.ScheduleTimezone); err != nil {
+			dlog.Fatalf("schedule err: %s", err.Error())
+		}
+	}
+	l.SetHostCacheTTL(app.HostCacheTTL)
+	l.SetPtrLookup(app.PtrWait, app.PtrCacheTTL)
+	l.SetAffinityTTL(app.AffinityTTL)
+	l.SetWeightRecovery(app.WeightRecovery)
+	if app.Failover != "" {
+		if err := l.SetFailover(app.Failover); err != nil {
+			dlog.Fatal(err)
+		}
+	}
+	if app.PrimaryBackup != "" {
+		if err := l.SetPrimaryBackup(app.PrimaryBackup, app.HealthInterval); err != nil {
+			dlog.Fatal(err)
+		}
+	}
+	if app.HealthWebhook != "" {
+		if err := l.SetHealthWebhook(app.HealthWebhook); err != nil {
+			dlog.Fatal(err)
+		}
+	}
+	if app.CompressUpstream != "" {
+		if err := l.SetCompressUpstreams(app.CompressUpstream); err != nil {
+			dlog.Fatal(err)
+		}
+	}
+	if app.AccessLog != "" {
+		if err := l.SetAccessLog(app.AccessLog, app.AccessLogInterval); err != nil {
+			dlog.Fatalf("open the access log err: %s", err.Error())
+		}
+	}
+	if app.Honeypot != "" {
+		if err := l.SetHoneypot(app.Honeypot); err != nil {
+			dlog.Fatal(err)
+		}
+	}
+	if app.StrictProxy {
+		l.SetStrictProxy()
+	} else if app.DirectFallbackDest != "" {
+		if err := l.SetDirectFallbackDest(app.DirectFallbackDest); err != nil {
+			dlog.Fatal(err)
+		}
+	}
+	if app.DebugDest != "" {
+		if err := l.SetDebugDest(app.DebugDest); err != nil {
+			dlog.Fatal(err)
+		}
+	}
+	if app.CaptureDest != "" {
+		if err := l.SetCapture(app.CaptureDest, app.CaptureDir); err != nil {
+			dlog.Fatal(err)
+		}
+	}
+	if app.DirectLocalPort != "" {
+		if err := l.SetDirectLocalPort(app.DirectLocalPort); err != nil {
+			dlog.Fatalf("direct_local_port(%s) err: %s", app.DirectLocalPort, err.Error())
+		}
+	}
+	l.DialTimeout, l.DialRetry = app.DialTimeout, app.DialRetry
+	l.SetupTimeout = app.SetupTimeout
+	l.SetFailCacheTTL(app.FailCacheTTL)
+	l.PidCheckInterval = app.PidCheckInterval
+	l.NoDelay = app.NoDelay
+	l.SetFastOpen(app.FastOpen)
+	l.SetFastOpenDirect(app.FastOpenDirect)
+	if app.OutboundDscp != "" {
+		if err := l.SetOutboundDscp(app.OutboundDscp); err != nil {
+			dlog.Fatal(err)
+		}
+	}
+	l.KeepAliveIdle = app.KeepAliveIdle
+	l.TeardownGrace = app.TeardownGrace
+	if err := l.SetPipeTimeouts(app.ReadTimeout, app.WriteTimeout); err != nil {
+		dlog.Fatal(err)
+	}
+	l.Transparent = app.Transparent
+	if l.UploadRate, err = parseRate(app.UploadRate); err != nil {
+		dlog.Fatalf("upload_rate err: %s", err.Error())
+	}
+	if l.DownloadRate, err = parseRate(app.DownloadRate); err != nil {
+		dlog.Fatalf("download_rate err: %s", err.Error())
+	}
+	totalUploadRate, err := parseRate(app.TotalUploadRate)
+	if err != nil {
+		dlog.Fatalf("total_upload_rate err: %s", err.Error())
+	}
+	totalDownloadRate, err := parseRate(app.TotalDownloadRate)
 	if err != nil {
-		dlog.Fatalf("os.OpenFile(%s) err: %s", app.PipePath, err.Error())
+		dlog.Fatalf("total_download_rate err: %s", err.Error())
+	}
+	l.SetTotalRate(totalUploadRate, totalDownloadRate)
+	if app.RejectDestClasses != "" {
+		if err := l.SetRejectDestClasses(app.RejectDestClasses); err != nil {
+			dlog.Fatal(err)
+		}
+	}
+	if err := l.SetPortFilter(app.AllowPorts, app.DenyPorts); err != nil {
+		dlog.Fatalf("bad allow_ports or deny_ports: %s", err.Error())
+	}
+	if app.Allowlist != "" {
+		if err := l.SetAllowlist(app.Allowlist, app.AllowlistInterval); err != nil {
+			dlog.Fatalf("load the allowlist %s err: %s", app.Allowlist, err.Error())
+		}
+	}
+	l.SetInboundSecret(app.InboundSecret)
+	if err := l.SetProxyDestAction(app.ProxyDestAction); err != nil {
+		dlog.Fatal(err)
+	}
+	if err := l.SetHairpinPolicy(app.HairpinPolicy); err != nil {
+		dlog.Fatal(err)
+	}
+	if app.BudgetConns > 0 || app.BudgetBytes != "0" {
+		budgetBytes, err := parseRate(app.BudgetBytes)
+		if err != nil {
+			dlog.Fatalf("budget_bytes err: %s", err.Error())
+		}
+		budget, err := NewBudget(int64(app.BudgetConns), budgetBytes, app.BudgetWindow, app.BudgetAction)
+		if err != nil {
+			dlog.Fatal(err)
+		}
+		l.SetBudget(budget)
+	}
+	l.SetMaxPending(app.MaxPending)
+	if err := l.SetAcceptRate(app.AcceptRate, app.AcceptRateAction); err != nil {
+		dlog.Fatal(err)
+	}
+	if app.OtlpEndpoint != "" {
+		dlog.Infof("export the spans to %s", app.OtlpEndpoint)
+		l.SetTracer(NewTracer(app.OtlpEndpoint))
+	}
+	if app.NatsURL != "" {
+		events, err := NewEventBus(app.NatsURL, app.NatsSubject)
+		if err != nil {
+			dlog.Fatal(err)
+		}
+		l.SetEventBus(events)
+	}
+	if app.AsnDB != "" {
+		if err := l.SetAsnDB(app.AsnDB); err != nil {
+			dlog.Errorf("load the ASN database %s err: %s, the asn matcher of the rules won't match", app.AsnDB, err.Error())
+		}
+	}
+	if app.RuleFile != "" {
+		rules, err := LoadRuleFile(app.RuleFile)
+		if err != nil {
+			dlog.Fatalf("LoadRuleFile(%s) err: %s", app.RuleFile, err.Error())
+		}
+		dlog.Infof("load %d rules from %s", len(rules), app.RuleFile)
+		if app.Honeypot == "" && usesHoneypot(rules) {
+			dlog.Fatalf("the rules of %s redirect to the honeypot, but honeypot is not set", app.RuleFile)
+		}
+		l.SetRules(rules)
+		if l.ptrRules && l.strictProxy {
+			dlog.Warnf("the ptr matchers of the rules of %s never match with strict_proxy", app.RuleFile)
+		}
+	}
+	return l
+}
+
+func (app *App) run() {
+	var err error
+
+	l := app.newLocal()
+	SetPidAddrMax(app.PidAddrMax) // before the address info is stored
+	if app.RecordFile != "" {
+		if err := SetRecordFile(app.RecordFile); err != nil {
+			dlog.Fatalf("open the record file %s err: %s", app.RecordFile, err.Error())
+		}
+	}
+	for _, path := range strings.Split(app.PipePath, ",") {
+		fifo := NewFifoSource(path)
+		if err = fifo.OpenWait(app.FifoWait); err != nil {
+			dlog.Fatalf("os.OpenFile(%s) err: %s", path, err.Error())
+		}
+		l.AddAddrSource(fifo)
+	}
+	if app.AddrInfoListen != "" {
+		for _, addr := range strings.Split(app.AddrInfoListen, ",") {
+			s := NewSocketSource(addr)
+			if err = s.Listen(); err != nil {
+				dlog.Fatalf("listen %s err: %s", s.Name(), err.Error())
+			}
+			l.AddAddrSource(s)
+		}
 	}
 
 	go l.UpdateProcessAddrInfo()
+	go l.CheckPrimary()
+	l.ProbeProxies()
+	if err = SetMetricsPorts(app.MetricsPorts); err != nil {
+		dlog.Fatal(err)
+	}
+	if app.PidAddrTTL > 0 {
+		go SweepPidAddr(app.PidAddrTTL)
+	}
+	if app.Socks5Listen != "" {
+		go l.ServeSocks5(app.Socks5Listen)
+	}
+	if app.HttpProxyListen != "" {
+		go l.ServeHttpProxy(app.HttpProxyListen)
+	}
+	if app.DnsListen != "" {
+		go l.ServeDNS(app.DnsListen, app.DnsUpstream)
+	}
+	if app.ControlListen != "" {
+		mode, err := strconv.ParseUint(app.ControlSocketMode, 8, 32)
+		if err != nil {
+			dlog.Fatalf("bad control_socket_mode: %s", app.ControlSocketMode)
+		}
+		go ServeControl(app.ControlListen, os.FileMode(mode), l)
+	}
+	app.mu.Lock()
+	app.local = l
+	app.mu.Unlock()
+	go app.watchReload(l)
+	go l.watchStatsDump()
 	l.Start()
 }
 
 func (app *App) Stop(s service.Service) error {
 	dlog.Noticef("graftcp-local stop")
+	app.mu.Lock()
+	l := app.local
+	app.mu.Unlock()
+	if l != nil {
+		l.Shutdown(app.DrainTimeout)
+		l.ReportUpstreamStats(app.StatsFile)
+	}
 	return nil
 }
 
@@ -78,18 +466,195 @@ func main() {
 	}
 
 	flag.StringVar(&app.ListenAddr, "listen", ":2233", "Listen address")
+	flag.BoolVar(&app.ReusePort, "reuseport", false,
+		"Share the listen address with another graftcp-local with SO_REUSEPORT, the connections are split between them")
 	flag.StringVar(&app.Socks5Addr, "socks5", "127.0.0.1:1080", "SOCKS5 address")
 	flag.StringVar(&app.Socks5Username, "socks5_username", "", "SOCKS5 username")
 	flag.StringVar(&app.Socks5Password, "socks5_password", "", "SOCKS5 password")
+	flag.StringVar(&app.Socks5UserTemplate, "socks5_username_template", "",
+		"SOCKS5 username template evaluated for each connection instead of socks5_username, e.g.: user-region-{tag}-session-{pid}")
 	flag.StringVar(&app.HttpProxyAddr, "http_proxy", "", "http proxy address, e.g.: 127.0.0.1:8080")
+	flag.Var(&app.HttpProxyHeaders, "http_proxy_header",
+		"Extra header of the CONNECT request to the HTTP proxy, can be given multiple times, e.g.: \"User-Agent: Mozilla/5.0\"")
+	flag.StringVar(&app.HttpProcessHeader, "http_proxy_process_header", "",
+		"Header of the CONNECT request to the HTTP proxy telling the local process, with the variables of socks5_username_template, e.g.: \"X-Graftcp-Process: {comm}/{pid}\"")
+	flag.IntVar(&app.HttpProxyPoolSize, "http_proxy_pool_size", 0,
+		"Keep up to the number of the idle connections to the HTTP proxy dialed in advance, 0 to disable")
+	flag.DurationVar(&app.HttpProxyPoolIdle, "http_proxy_pool_idle", 30*time.Second,
+		"Close the idle connections to the HTTP proxy in the pool after the duration")
+	flag.StringVar(&app.WarmPool, "warm_pool", "",
+		"Keep the number of the idle connections to each upstream proxy dialed in advance, e.g.: socks5=4,http_proxy=8")
+	flag.DurationVar(&app.WarmPoolIdle, "warm_pool_idle", 30*time.Second,
+		"Close the idle connections to the upstream proxies in warm_pool after the duration")
+	flag.StringVar(&app.ProxyList, "proxy_list", "",
+		"URL or file of the proxy list used instead of socks5 and http_proxy, one proxy per line, e.g.: https://example.com/proxies.txt")
+	flag.DurationVar(&app.ProxyListInterval, "proxy_list_interval", time.Minute,
+		"Fetch the proxy list again every interval to add and remove the proxies, 0 to disable")
+	flag.StringVar(&app.ProxyProbe, "proxy_probe", "warn",
+		"Probe the protocol spoken by the proxies at startup, and what to do if mismatched [off | warn | fix]")
 	flag.StringVar(&selectProxyMode, "select_proxy_mode", "auto",
-		"Set the mode for select a proxy [auto | random | only_http_proxy | only_socks5 | direct]")
+		"Set the mode for select a proxy [auto | random | hash | consistent_hash | only_http_proxy | only_socks5 | direct | reject | honeypot]")
+	flag.StringVar(&app.SelectModeIPv4, "select_proxy_mode_ipv4", "", "Mode of the IPv4 destinations instead of select_proxy_mode and schedule")
+	flag.StringVar(&app.SelectModeIPv6, "select_proxy_mode_ipv6", "",
+		"Mode of the IPv6 destinations instead of select_proxy_mode and schedule, e.g.: direct")
+	flag.StringVar(&app.DscpModes, "dscp_modes", "",
+		"Modes by the DSCP of the IPv4 connections from the apps instead of the other default modes, e.g.: ef:only_socks5,cs1:direct")
+	flag.StringVar(&app.Schedule, "schedule", "",
+		"Modes by the time of the day instead of select_proxy_mode, e.g.: 22:00-07:00=only_http_proxy,09:00-18:00=only_socks5")
+	flag.StringVar(&app.ScheduleTimezone, "schedule_timezone", "", "Time zone of the schedule, e.g.: Asia/Shanghai (default local)")
+	flag.Int64Var(&app.RandSeed, "rand_seed", 0, "Seed of the random selection of the proxies, 0 to seed with the current time")
+	flag.StringVar(&app.HashKey, "hash_key", "pid", "Key of the hash mode [pid | source]")
+	flag.StringVar(&app.Failover, "failover", "",
+		"Failover chain of the auto mode, e.g.: http_proxy,socks5,reject (default socks5 or http_proxy, then direct)")
+	flag.StringVar(&app.PrimaryBackup, "primary_backup", "",
+		"Primary and backup upstream of the auto mode, the backup is only used while the primary is down, e.g.: socks5,http_proxy")
+	flag.DurationVar(&app.HealthInterval, "health_check_interval", 10*time.Second,
+		"Interval of the health checks of the primary upstream of primary_backup")
+	flag.StringVar(&app.HealthWebhook, "health_webhook", "",
+		"URL to post the health transitions of the primary upstream of primary_backup to in JSON, e.g.: http://127.0.0.1:9000/alerts")
+	flag.StringVar(&app.Honeypot, "honeypot", "",
+		"Address of the honeypot the connections of mode honeypot are redirected to instead of their destinations, e.g.: 127.0.0.1:2222")
+	flag.StringVar(&app.DirectFallbackDest, "direct_fallback_dest", "",
+		"Only allow the connections to these destinations to fall back to direct in the failover chain, e.g.: 192.0.2.0/24,example.com")
+	flag.DurationVar(&app.AffinityTTL, "affinity_ttl", 0,
+		"Pin the upstream of the auto and random modes by the destination for the duration after a successful dial, 0 to disable")
+	flag.DurationVar(&app.WeightRecovery, "weight_recovery", 0,
+		"Weight the upstreams of the random mode by the dial results, the weights halved on failures recover with the half-life, 0 to select evenly")
+	flag.StringVar(&app.DirectLocalPort, "direct_local_port", "", "Local port or port range for direct connections, e.g.: 40000-40099")
+	flag.StringVar(&app.UpstreamBind, "upstream_bind", "",
+		"Local IP address or interface to dial each upstream from, e.g.: socks5=192.168.1.2,http_proxy=eth1")
+	flag.StringVar(&app.UpstreamNetwork, "upstream_network", "",
+		"Network to reach the proxy of each upstream [tcp | tcp4 | tcp6 | auto], e.g.: socks5=tcp4,http_proxy=auto")
+	flag.StringVar(&app.UpstreamMaxConns, "upstream_max_conns", "",
+		"Max concurrent connections of each upstream, e.g.: socks5=10,http_proxy=20")
+	flag.StringVar(&app.AllowPorts, "allow_ports", "", "Only allow connecting to these destination ports if set, e.g.: 22,80,443,8000-8999")
+	flag.StringVar(&app.DenyPorts, "deny_ports", "", "Deny connecting to these destination ports, e.g.: 25,6660-6669")
+	flag.StringVar(&app.Allowlist, "allowlist", "",
+		"File of the destinations allowed to connect, one IP address, CIDR or host per line, the others are rejected")
+	flag.DurationVar(&app.AllowlistInterval, "allowlist_interval", 10*time.Second,
+		"Check the allowlist file every interval, and load it again if it changes, 0 to disable")
+	flag.StringVar(&app.RejectDestClasses, "reject_dest_classes", "",
+		"Reject the connections to the destinations of these classes [unspecified | multicast | broadcast | reserved], separated by commas")
+	flag.StringVar(&app.RuleFile, "rule_file", "", "Path to the rule file for selecting the mode by destination")
+	flag.StringVar(&app.AsnDB, "asn_db", "", "Path to the MaxMind ASN database for the asn matcher of the rules, e.g.: GeoLite2-ASN.mmdb")
+	flag.DurationVar(&app.PtrWait, "ptr_wait", 0,
+		"Wait for the PTR lookup of the destination for the ptr matcher of the rules up to the duration, 0 to route the connection without it")
+	flag.DurationVar(&app.PtrCacheTTL, "ptr_cache_ttl", time.Hour, "Cache the PTR names of the destinations for the duration")
+	flag.DurationVar(&app.DialTimeout, "dial_timeout", 0, "Timeout of dialing the destination, 0 for no timeout")
+	flag.DurationVar(&app.SetupTimeout, "setup_timeout", 0,
+		"Timeout of the whole setup of a connection, from accepted until the destination is dialed, 0 for no timeout")
+	flag.IntVar(&app.DialRetry, "dial_retry", 0, "Retry times if dialing the destination fails")
+	flag.DurationVar(&app.FailCacheTTL, "fail_cache_ttl", 0,
+		"Fail the connections to the destinations failed to dial within the duration fast instead of dialing again, 0 to disable")
+	flag.StringVar(&app.UploadRate, "upload_rate", "0",
+		"Per connection rate limit from the app to the destination in bytes per second, e.g.: 512K, 0 for no limit")
+	flag.StringVar(&app.DownloadRate, "download_rate", "0",
+		"Per connection rate limit from the destination to the app in bytes per second, e.g.: 1M, 0 for no limit")
+	flag.StringVar(&app.TotalUploadRate, "total_upload_rate", "0",
+		"Rate limit from the apps to the destinations shared by all connections in bytes per second, 0 for no limit")
+	flag.StringVar(&app.TotalDownloadRate, "total_download_rate", "0",
+		"Rate limit from the destinations to the apps shared by all connections in bytes per second, 0 for no limit")
+	flag.DurationVar(&app.PidCheckInterval, "pid_check_interval", 0,
+		"Close the connection if its process exits, checking every interval, 0 to disable")
+	flag.IntVar(&app.BudgetConns, "budget_conns", 0, "Budget of the connections in the budget window, 0 for no limit")
+	flag.StringVar(&app.BudgetBytes, "budget_bytes", "0", "Budget of the bytes in the budget window, e.g.: 10G, 0 for no limit")
+	flag.DurationVar(&app.BudgetWindow, "budget_window", time.Hour, "Rolling time window of the budget")
+	flag.StringVar(&app.BudgetAction, "budget_action", "warn",
+		"Set what to do when the budget is exhausted [warn | reject]")
+	flag.BoolVar(&app.StrictProxy, "strict_proxy", false,
+		"Never fall back to direct in the auto mode, and pass the host names of the front-ends to the proxies unresolved")
+	flag.BoolVar(&app.Transparent, "transparent", false,
+		"Dial directly from the source IP address of the connection with IP_TRANSPARENT, requires CAP_NET_ADMIN")
+	flag.StringVar(&app.CompressUpstream, "compress_upstream", "",
+		"Compress the connections to these upstreams in the raw DEFLATE format [socks5 | http_proxy], separated by commas")
+	flag.BoolVar(&app.FastOpen, "tfo", false,
+		"Dial the proxies with TCP Fast Open if supported, requires Linux 4.11 or later")
+	flag.BoolVar(&app.FastOpenDirect, "tfo_direct", false,
+		"Dial the direct connections with TCP Fast Open too with tfo, the protocols in which the server speaks first would stall")
+	flag.StringVar(&app.OutboundDscp, "outbound_dscp", "",
+		"DSCP of the connections to the proxies and the direct connections in number or class name, e.g.: 46 or ef")
+	flag.BoolVar(&app.NoDelay, "nodelay", true,
+		"Set TCP_NODELAY on both sides of the connection to disable the Nagle's algorithm, false for the bulk transfers")
+	flag.DurationVar(&app.KeepAliveIdle, "keepalive_idle", 0,
+		"Send the TCP keepalive probes only after the connection has been idle for the duration, 0 for the system default")
+	flag.DurationVar(&app.TeardownGrace, "teardown_grace", 2*time.Second,
+		"Wait for the other direction of the connection to finish until the grace period after a direction finishes, 0 to tear down at once")
+	flag.StringVar(&app.ReadTimeout, "read_timeout", "",
+		"Close the connection if no data is read in a direction within the timeout, e.g.: 10m or upload=10m,download=0 (default no timeout)")
+	flag.StringVar(&app.WriteTimeout, "write_timeout", "",
+		"Close the connection if writing the data in a direction stalls longer than the timeout, e.g.: 30s or upload=30s (default no timeout)")
+	flag.StringVar(&app.InboundSecret, "inbound_secret", "",
+		"Shared secret the inbound connections must present, sent before the data to the listener, or as the password to the front-ends")
+	flag.StringVar(&app.ProxyDestAction, "proxy_dest_action", "warn",
+		"Set what to do with the connections to the socks5 or the HTTP proxy [off | warn | reject]")
+	flag.StringVar(&app.HairpinPolicy, "hairpin_policy", "proxy",
+		"Set how to handle the connections to the local host [proxy | direct | reject]")
+	flag.DurationVar(&app.DrainTimeout, "drain_timeout", 0,
+		"Wait for the active connections to be closed until the timeout when stopping")
+	flag.IntVar(&app.AcceptRate, "accept_rate", 0, "Limit the rate of accepting the connections per second, 0 for no limit")
+	flag.StringVar(&app.AcceptRateAction, "accept_rate_action", "wait",
+		"Set what to do with the connections beyond the accept rate [wait | reject]")
+	flag.IntVar(&app.MaxPending, "max_pending", 0,
+		"Max number of the connections accepted but not dialed yet, the new connections are shed beyond it, 0 for no limit")
+	flag.StringVar(&app.StatsFile, "stats_file", "", "Write the stats of the upstreams in JSON format to the file when stopping")
+	flag.StringVar(&app.RecordFile, "record_file", "",
+		"Record the address info read and the connection events in JSON per line to the file, to reproduce the issues by -replay")
+	replayFile := flag.String("replay", "",
+		"Replay the file recorded by record_file offline with the config, and report the routing of the connections recorded")
+	flag.StringVar(&app.AccessLog, "access_log", "", "Write a record in JSON per line for each connection to the file when it's closed")
+	flag.DurationVar(&app.AccessLogInterval, "access_log_interval", 0,
+		"Write the interim records of the open connections to the access log every interval, 0 to disable")
+	flag.StringVar(&app.DebugDest, "debug_dest", "",
+		"Log the connections to these destinations in detail regardless of the log level, e.g.: 203.0.113.0/24,example.com")
+	flag.StringVar(&app.CaptureDest, "capture_dest", "",
+		"Capture the traffic of the connections to these destinations into capture_dir, e.g.: 203.0.113.10,example.com")
+	flag.StringVar(&app.CaptureDir, "capture_dir", "/tmp/graftcp-capture", "Directory of the capture files")
+	flag.StringVar(&app.SyslogAddr, "syslog_addr", "",
+		"Send logs to the syslog server, e.g.: 192.0.2.10:514 or tcp://192.0.2.10:601 (default the local syslog if syslog_facility is set)")
+	flag.StringVar(&app.SyslogFacility, "syslog_facility", "", "Facility of the logs sent to syslog, e.g.: LOCAL0 (default DAEMON)")
 	flag.StringVar(&configFile, "config", "", "Path to the configuration file")
-	flag.StringVar(&app.PipePath, "pipepath", "/tmp/graftcplocal.fifo", "Pipe path for graftcp to send address info")
+	flag.StringVar(&app.PipePath, "pipepath", "/tmp/graftcplocal.fifo", "Pipe path for graftcp to send address info, multiple pipes are separated by commas")
+	flag.DurationVar(&app.FifoWait, "fifo_wait", 0,
+		"Retry opening the pipe with backoff for the duration at startup if it fails, e.g. its directory is not created yet, 0 to fail fast")
+	flag.StringVar(&app.AddrInfoListen, "addr_info_listen", "",
+		"Listen addresses for graftcp to send address info besides the pipe separated by commas, e.g.: 127.0.0.1:2235 or unix:/tmp/graftcplocal.sock")
+	flag.StringVar(&app.Socks5Listen, "socks5_listen", "",
+		"Listen address of the SOCKS5 front-end for the apps not traced by graftcp, e.g.: 127.0.0.1:2236")
+	flag.StringVar(&app.HttpProxyListen, "http_proxy_listen", "",
+		"Listen address of the HTTP proxy front-end for the apps not traced by graftcp, e.g.: 127.0.0.1:2237")
+	flag.StringVar(&app.DnsListen, "dns_listen", "",
+		"Listen address of the DNS forwarder over TCP forwarding the queries to dns_upstream via the socks5 proxy, e.g.: 127.0.0.1:5353")
+	flag.StringVar(&app.DnsUpstream, "dns_upstream", "1.1.1.1:53", "Address of the DNS server the DNS forwarder forwards the queries to")
+	flag.DurationVar(&app.HostCacheTTL, "host_cache_ttl", 0,
+		"Remember the rules matched by the front-end connections by the requested host name for the duration, 0 to disable")
+	flag.StringVar(&app.ControlListen, "control_listen", "", "Listen address of the control server for status and metrics, e.g.: 127.0.0.1:2234 or unix:/run/graftcp-local.sock")
+	flag.StringVar(&app.ControlSocketMode, "control_socket_mode", "0600", "Permissions of the Unix socket of the control server in octal")
+	flag.StringVar(&app.MetricsPorts, "metrics_ports", "22,80,443",
+		"Destination ports the connections are counted by on their own in the metrics, the others are counted as other")
+	flag.StringVar(&app.OtlpEndpoint, "otlp_endpoint", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"),
+		"OpenTelemetry OTLP/HTTP endpoint to export the spans of the connections, e.g.: http://127.0.0.1:4318")
+	flag.StringVar(&app.NatsURL, "nats_url", "", "URL of the NATS server to publish the open and close events of the connections, e.g.: nats://127.0.0.1:4222")
+	flag.StringVar(&app.NatsSubject, "nats_subject", "graftcp.conns", "NATS subject to publish the events of the connections")
+	flag.DurationVar(&app.PidAddrTTL, "pidaddr_ttl", time.Minute, "Evict the address info sent by graftcp if not used within the TTL, 0 to disable")
+	flag.IntVar(&app.PidAddrMax, "pidaddr_max", 0, "Max number of the address info sent by graftcp not used yet, the oldest are evicted beyond it, 0 for no limit")
 	flag.Parse()
 	ParseConfigFile(configFile, app)
+	if app.SyslogAddr != "" || app.SyslogFacility != "" {
+		if err := useSyslog(app.SyslogAddr, app.SyslogFacility); err != nil {
+			dlog.Errorf("syslog %s err: %s", app.SyslogAddr, err.Error())
+		}
+	}
 	dlog.Noticef("graftcp-local start")
 
+	if flag.Arg(0) == "test" {
+		os.Exit(app.runTest(flag.Args()[1:]))
+	}
+	if *replayFile != "" {
+		if err := app.newLocal().Replay(*replayFile, os.Stdout); err != nil {
+			dlog.Fatalf("replay %s err: %s", *replayFile, err.Error())
+		}
+		return
+	}
 	if *svcFlag != "" {
 		if svc == nil {
 			dlog.Fatal("Built-in service installation is not supported on this platform")
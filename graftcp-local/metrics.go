@@ -0,0 +1,74 @@
+package main
+
+import (
+	"expvar"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// connsRejected count the rejected connections by reason.
+	connsRejected = expvar.NewMap("conns_rejected")
+	// connsLookupFailed count the connections failed to find the address
+	// info because of the errors other than untraced, e.g. the address info
+	// of the process is taken by its other connections.
+	connsLookupFailed = expvar.NewInt("conns_lookup_failed")
+	// connsOrphaned count the connections closed as their processes exited.
+	connsOrphaned = expvar.NewInt("conns_orphaned")
+	// connsByMode count the connections by the mode selected.
+	connsByMode = expvar.NewMap("conns_by_mode")
+
+	uploadMeter   = &byteMeter{} // from the apps to the destinations
+	downloadMeter = &byteMeter{} // from the destinations to the apps
+)
+
+// byteMeter count the bytes, and measure the throughput of the last second.
+type byteMeter struct {
+	total int64 // accessed atomically
+	rate  int64 // accessed atomically
+	last  int64 // total at the last tick
+}
+
+func (m *byteMeter) add(n int) {
+	atomic.AddInt64(&m.total, int64(n))
+}
+
+func (m *byteMeter) tick() {
+	total := atomic.LoadInt64(&m.total)
+	atomic.StoreInt64(&m.rate, total-m.last)
+	m.last = total
+}
+
+func init() {
+	expvar.Publish("bytes_total", expvar.Func(func() interface{} {
+		return map[string]int64{
+			"upload":   atomic.LoadInt64(&uploadMeter.total),
+			"download": atomic.LoadInt64(&downloadMeter.total),
+		}
+	}))
+	expvar.Publish("throughput", expvar.Func(func() interface{} {
+		return map[string]int64{
+			"upload":   atomic.LoadInt64(&uploadMeter.rate),
+			"download": atomic.LoadInt64(&downloadMeter.rate),
+		}
+	}))
+	go func() {
+		for range time.Tick(time.Second) {
+			uploadMeter.tick()
+			downloadMeter.tick()
+		}
+	}()
+}
+
+// rejectConn close conn immediately, and count it by reason.
+func rejectConn(conn net.Conn, reason string) {
+	connsRejected.Add(reason, 1)
+	if r, ok := conn.(dialReplier); ok {
+		r.replyDial(ErrRejected)
+	}
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.SetLinger(0)
+	}
+	conn.Close()
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	"golang.org/x/net/proxy"
+)
+
+// ConnContext is a connection passed through the middlewares after its pid
+// and destination are resolved, the middlewares may modify it for the later
+// ones and the dial.
+type ConnContext struct {
+	Conn  net.Conn
+	Info  *ConnInfo
+	Start time.Time // when the connection is accepted
+
+	Mode         modeT
+	Rule         *Rule // rule matched, nil if none
+	Timeout      time.Duration
+	Retry        int
+	UploadRate   int64
+	DownloadRate int64
+	Dialer       proxy.Dialer // overrides the selection by Mode if not nil
+
+	span *Span
+	dbg  *connDebug
+}
+
+// newConnContext returns the ConnContext of conn to the destination of info
+// accepted at start, with the ASN and the PTR name of the destination looked
+// up, and the default settings.
+func (l *Local) newConnContext(conn net.Conn, info *ConnInfo, start time.Time) *ConnContext {
+	info.ASN = l.lookupASN(info.DestIP)
+	l.lookupPTR(info)
+	return &ConnContext{
+		Conn:         conn,
+		Info:         info,
+		Start:        start,
+		Timeout:      l.DialTimeout,
+		Retry:        l.DialRetry,
+		UploadRate:   l.UploadRate,
+		DownloadRate: l.DownloadRate,
+	}
+}
+
+// ConnHandler handle the connection of ctx, a returned error rejects it.
+type ConnHandler func(ctx *ConnContext) error
+
+// Middleware wrap next, it may return without calling next to short-circuit,
+// e.g. by ctx.Reject.
+type Middleware func(next ConnHandler) ConnHandler
+
+// Reject close the connection of ctx for reason, which counts it in
+// "conns_rejected", and returns the error for the middleware to return.
+func (ctx *ConnContext) Reject(reason, msg string, err error) error {
+	rejectConn(ctx.Conn, reason)
+	return connError(ErrRejected, msg, err)
+}
+
+// Use add the middlewares run after the routing and before the pre-dial
+// hook in order, it must be called before Start, as the chain is built once
+// for the first connection.
+func (l *Local) Use(mws ...Middleware) {
+	l.middlewares = append(l.middlewares, mws...)
+}
+
+// connHandler returns the built-in middlewares and those of Use chained, the
+// middlewares read the settings of l for each connection, so the chain is
+// built once.
+func (l *Local) connHandler() ConnHandler {
+	l.handlerOnce.Do(func() {
+		mws := []Middleware{l.logRequest, l.filterDest, l.routeConn}
+		mws = append(mws, l.middlewares...)
+		mws = append(mws, l.callPreDialHook, rejectMode)
+		h := func(ctx *ConnContext) error { return nil }
+		for i := len(mws) - 1; i >= 0; i-- {
+			h = mws[i](h)
+		}
+		l.handler = h
+	})
+	return l.handler
+}
+
+// logRequest log the connection, and log it in detail if to a debug
+// destination.
+func (l *Local) logRequest(next ConnHandler) ConnHandler {
+	return func(ctx *ConnContext) error {
+		info := ctx.Info
+		dlog.Infof("Request PID: %s, Source Addr: %s, Dest Addr: %s", info.Pid, info.SrcAddr, info.DestAddr)
+		if ctx.span != nil {
+			ctx.span.SetAttr("process.pid", info.Pid)
+			if comm, err := procComm(info.Pid); err == nil {
+				ctx.span.SetAttr("process.command", comm)
+			}
+			ctx.span.SetAttr("dest.addr", info.DestAddr)
+		}
+		if l.isDebugDest(info.DestIP) {
+			ctx.dbg = &connDebug{prefix: fmt.Sprintf("PID: %s, Dest Addr: %s", info.Pid, info.DestAddr), start: ctx.Start}
+			ctx.dbg.logf("accepted from %s, pid lookup done", info.SrcAddr)
+		}
+		return next(ctx)
+	}
+}
+
+// filterDest reject the connections to the destinations not allowed.
+func (l *Local) filterDest(next ConnHandler) ConnHandler {
+	return func(ctx *ConnContext) error {
+		info := ctx.Info
+		pid, destAddr := info.Pid, info.DestAddr
+		if class := l.bogusDestClass(info.DestIP); class != "" {
+			dlog.Warnf("reject PID: %s, Dest Addr: %s, the destination is %s", pid, destAddr, class)
+			return ctx.Reject("bogus_dest", fmt.Sprintf("%s is rejected as a bogus destination: %s", destAddr, class), nil)
+		}
+		if !l.isPortAllowed(info.DestPort) {
+			dlog.Warnf("reject PID: %s, Dest Addr: %s, the port is not allowed", pid, destAddr)
+			return ctx.Reject("port", fmt.Sprintf("the port of %s is not allowed", destAddr), nil)
+		}
+		if !l.isDestAllowed(info) {
+			dlog.Warnf("reject PID: %s, Dest Addr: %s, the destination is not on the allowlist", pid, destAddr)
+			return ctx.Reject("allowlist", fmt.Sprintf("%s is not on the allowlist", destAddr), nil)
+		}
+		if name := l.proxyDestName(info); name != "" {
+			dlog.Warnf("PID: %s, Dest Addr: %s is the %s proxy, it would go to the proxy through the proxy", pid, destAddr, name)
+			if l.proxyDestAction == "reject" {
+				return ctx.Reject("proxy_dest", fmt.Sprintf("%s is rejected as the %s proxy", destAddr, name), nil)
+			}
+		}
+		return next(ctx)
+	}
+}
+
+// routeConn select the mode of the connection by the rules, and apply the
+// settings and the rewrite of the rule matched.
+func (l *Local) routeConn(next ConnHandler) ConnHandler {
+	return func(ctx *ConnContext) error {
+		info, dbg := ctx.Info, ctx.dbg
+		var r *Rule
+		key := l.hostKey(info)
+		if d, ok := l.hostCache.get(key); ok {
+			r = d.rule
+			dbg.logf("rule of %s cached", key)
+		} else {
+			r = l.matchRule(info)
+			if info.ptrPending {
+				// matched again with the PTR name once it's looked up
+				dbg.logf("PTR lookup of %s not done yet", info.DestIP)
+			} else {
+				l.hostCache.put(key, hostDecision{rule: r})
+			}
+		}
+		// the mode depends on the DSCP, the time and the flow of each
+		// connection, so it's not cached
+		mode := l.routeMode(info, r, l.defaultMode(info, ctx.Start))
+		ctx.Rule, ctx.Mode = r, mode
+		if r != nil {
+			dbg.logf("rule matched, mode %s", r.mode)
+			info.Tag = r.tag
+			if r.timeout >= 0 {
+				ctx.Timeout = r.timeout
+			}
+			if r.retry >= 0 {
+				ctx.Retry = r.retry
+			}
+			if r.uploadRate >= 0 {
+				ctx.UploadRate = r.uploadRate
+			}
+			if r.downloadRate >= 0 {
+				ctx.DownloadRate = r.downloadRate
+			}
+		}
+		if r != nil && r.rewrites() && info.DestIP != nil {
+			ip, port, rewritten := r.rewriteDest(info.DestIP, info.DestPort)
+			dlog.Infof("rewrite PID: %s, Dest Addr: %s to %s", info.Pid, info.DestAddr, rewritten)
+			info.DestAddr, info.DestIP, info.DestPort = rewritten, ip, port
+		}
+		ctx.span.SetAttr("proxy.mode", mode.String())
+		connsByMode.Add(mode.String(), 1)
+		dbg.logf("mode %s, dial timeout %s, retry %d, upload rate %d, download rate %d",
+			mode, ctx.Timeout, ctx.Retry, ctx.UploadRate, ctx.DownloadRate)
+		return next(ctx)
+	}
+}
+
+// callPreDialHook call the pre-dial hook if set.
+func (l *Local) callPreDialHook(next ConnHandler) ConnHandler {
+	return func(ctx *ConnContext) error {
+		if l.preDialHook == nil {
+			return next(ctx)
+		}
+		dialer, err := l.preDialHook(*ctx.Info)
+		if err != nil {
+			dlog.Infof("reject PID: %s, Dest Addr: %s by the pre-dial hook: %s", ctx.Info.Pid, ctx.Info.DestAddr, err.Error())
+			return ctx.Reject("hook", fmt.Sprintf("%s is rejected by the pre-dial hook", ctx.Info.DestAddr), err)
+		}
+		if dialer != nil {
+			ctx.Dialer = dialer
+		}
+		return next(ctx)
+	}
+}
+
+// rejectMode reject the connections of mode reject, unless a dialer is given.
+func rejectMode(next ConnHandler) ConnHandler {
+	return func(ctx *ConnContext) error {
+		if ctx.Mode == RejectMode && ctx.Dialer == nil {
+			dlog.Infof("reject PID: %s, Dest Addr: %s by mode reject", ctx.Info.Pid, ctx.Info.DestAddr)
+			return ctx.Reject("mode", fmt.Sprintf("%s is rejected by mode reject", ctx.Info.DestAddr), nil)
+		}
+		return next(ctx)
+	}
+}
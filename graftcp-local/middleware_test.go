@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// newTestContext returns the ConnContext of a connection of pid 42 to dest.
+func newTestContext(t *testing.T, l *Local, dest string) *ConnContext {
+	conn, peer := net.Pipe()
+	t.Cleanup(func() {
+		conn.Close()
+		peer.Close()
+	})
+	return l.newConnContext(conn, newConnInfo("42", "127.0.0.1:40000", dest), time.Now())
+}
+
+// runMiddleware run ctx through mw, and reports whether it's passed to the
+// next handler.
+func runMiddleware(mw Middleware, ctx *ConnContext) (passed bool, err error) {
+	err = mw(func(*ConnContext) error {
+		passed = true
+		return nil
+	})(ctx)
+	return passed, err
+}
+
+func newTestLocal() *Local {
+	return NewLocal("127.0.0.1:0", "127.0.0.1:1080", "", "", "")
+}
+
+func TestLogRequest(t *testing.T) {
+	l := newTestLocal()
+	if err := l.SetDebugDest("192.0.2.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	ctx := newTestContext(t, l, "192.0.2.1:443")
+	if passed, err := runMiddleware(l.logRequest, ctx); !passed || err != nil {
+		t.Fatalf("logRequest passed %v, err %v", passed, err)
+	}
+	if ctx.dbg == nil {
+		t.Error("the connection to the debug destination is not logged in detail")
+	}
+	ctx = newTestContext(t, l, "198.51.100.1:443")
+	runMiddleware(l.logRequest, ctx)
+	if ctx.dbg != nil {
+		t.Error("the connection to the other destination is logged in detail")
+	}
+}
+
+func TestFilterDest(t *testing.T) {
+	l := newTestLocal()
+	if err := l.SetPortFilter("", "25"); err != nil {
+		t.Fatal(err)
+	}
+	passed, err := runMiddleware(l.filterDest, newTestContext(t, l, "192.0.2.1:25"))
+	if passed || ConnErrorKind(err) != ErrRejected {
+		t.Errorf("filterDest of the denied port passed %v, err %v", passed, err)
+	}
+	passed, err = runMiddleware(l.filterDest, newTestContext(t, l, "192.0.2.1:443"))
+	if !passed || err != nil {
+		t.Errorf("filterDest of the allowed port passed %v, err %v", passed, err)
+	}
+}
+
+func TestRouteConn(t *testing.T) {
+	l := newTestLocal()
+	l.SetSelectMode("only_socks5")
+	r, err := parseRule("direct dest=192.0.2.0/24 timeout=3s rewrite=:8443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.SetRules([]*Rule{r})
+	ctx := newTestContext(t, l, "192.0.2.1:443")
+	if passed, err := runMiddleware(l.routeConn, ctx); !passed || err != nil {
+		t.Fatalf("routeConn passed %v, err %v", passed, err)
+	}
+	if ctx.Rule != r || ctx.Mode != DirectMode || ctx.Timeout != 3*time.Second {
+		t.Errorf("routed to rule %v, mode %s, timeout %s, want the rule, direct, 3s", ctx.Rule, ctx.Mode, ctx.Timeout)
+	}
+	if ctx.Info.DestAddr != "192.0.2.1:8443" {
+		t.Errorf("Dest Addr %s, want rewritten to 192.0.2.1:8443", ctx.Info.DestAddr)
+	}
+	ctx = newTestContext(t, l, "198.51.100.1:443")
+	runMiddleware(l.routeConn, ctx)
+	if ctx.Rule != nil || ctx.Mode != OnlySocks5Mode {
+		t.Errorf("routed to rule %v, mode %s, want no rule, only_socks5", ctx.Rule, ctx.Mode)
+	}
+}
+
+func TestCallPreDialHook(t *testing.T) {
+	l := newTestLocal()
+	passed, err := runMiddleware(l.callPreDialHook, newTestContext(t, l, "192.0.2.1:443"))
+	if !passed || err != nil {
+		t.Errorf("callPreDialHook without hook passed %v, err %v", passed, err)
+	}
+	l.SetPreDialHook(func(info ConnInfo) (proxy.Dialer, error) {
+		if info.DestPort == 25 {
+			return nil, errors.New("no mail")
+		}
+		return proxy.Direct, nil
+	})
+	passed, err = runMiddleware(l.callPreDialHook, newTestContext(t, l, "192.0.2.1:25"))
+	if passed || ConnErrorKind(err) != ErrRejected {
+		t.Errorf("callPreDialHook rejecting passed %v, err %v", passed, err)
+	}
+	ctx := newTestContext(t, l, "192.0.2.1:443")
+	if passed, err = runMiddleware(l.callPreDialHook, ctx); !passed || err != nil || ctx.Dialer != proxy.Direct {
+		t.Errorf("callPreDialHook passed %v, err %v, dialer %v, want the dialer of the hook", passed, err, ctx.Dialer)
+	}
+}
+
+func TestRejectMode(t *testing.T) {
+	l := newTestLocal()
+	ctx := newTestContext(t, l, "192.0.2.1:443")
+	ctx.Mode = RejectMode
+	if passed, err := runMiddleware(rejectMode, ctx); passed || ConnErrorKind(err) != ErrRejected {
+		t.Errorf("rejectMode passed %v, err %v", passed, err)
+	}
+	ctx = newTestContext(t, l, "192.0.2.1:443")
+	ctx.Mode, ctx.Dialer = RejectMode, proxy.Direct
+	if passed, err := runMiddleware(rejectMode, ctx); !passed || err != nil {
+		t.Errorf("rejectMode with a dialer passed %v, err %v", passed, err)
+	}
+}
+
+func TestConnHandlerUse(t *testing.T) {
+	l := newTestLocal()
+	var calls []string
+	l.Use(func(next ConnHandler) ConnHandler {
+		calls = append(calls, "build")
+		return func(ctx *ConnContext) error {
+			calls = append(calls, "mode "+ctx.Mode.String())
+			return next(ctx)
+		}
+	})
+	l.SetSelectMode("direct")
+	for i := 0; i < 2; i++ {
+		if err := l.connHandler()(newTestContext(t, l, "192.0.2.1:443")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// built once, and run after the routing
+	if want := "[build mode direct mode direct]"; fmt.Sprint(calls) != want {
+		t.Errorf("calls %v, want %s", calls, want)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+)
+
+// mmdbMetadataMarker starts the metadata at the end of a MaxMind DB file.
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+var errMmdbCorrupt = errors.New("corrupt MaxMind DB")
+
+// mmdbReader look up the records of the IP addresses in a MaxMind DB file,
+// e.g. GeoLite2-ASN.mmdb, see https://maxmind.github.io/MaxMind-DB/.
+type mmdbReader struct {
+	buf        []byte
+	data       []byte // data section
+	nodeCount  uint
+	recordSize uint // bits of a record, 24, 28 or 32
+	ipVersion  uint
+	ipv4Start  uint // node of ::/96 in an IPv6 tree
+	dbType     string
+}
+
+// openMmdb read the MaxMind DB file path.
+func openMmdb(path string) (*mmdbReader, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	i := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, errors.New("not a MaxMind DB: no metadata")
+	}
+	meta, _, err := (&mmdbReader{data: buf[i+len(mmdbMetadataMarker):]}).decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("bad metadata of MaxMind DB: %s", err.Error())
+	}
+	m, ok := meta.(map[string]interface{})
+	if !ok {
+		return nil, errMmdbCorrupt
+	}
+	r := &mmdbReader{buf: buf}
+	nodeCount, _ := m["node_count"].(uint64)
+	recordSize, _ := m["record_size"].(uint64)
+	ipVersion, _ := m["ip_version"].(uint64)
+	r.dbType, _ = m["database_type"].(string)
+	r.nodeCount, r.recordSize, r.ipVersion = uint(nodeCount), uint(recordSize), uint(ipVersion)
+	if r.recordSize != 24 && r.recordSize != 28 && r.recordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size of MaxMind DB: %d", r.recordSize)
+	}
+	treeSize := r.nodeCount * r.recordSize / 4
+	if treeSize+16 > uint(i) {
+		return nil, errMmdbCorrupt
+	}
+	r.data = buf[treeSize+16 : i]
+	if r.ipVersion == 6 {
+		for j := 0; j < 96 && r.ipv4Start < r.nodeCount; j++ {
+			r.ipv4Start = r.readNode(r.ipv4Start, 0)
+		}
+	}
+	return r, nil
+}
+
+// readNode returns the left (bit 0) or right (bit 1) record of the node.
+func (r *mmdbReader) readNode(node, bit uint) uint {
+	b := r.buf[node*r.recordSize/4:]
+	switch r.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// lookup returns the record of ip, or nil if not found.
+func (r *mmdbReader) lookup(ip net.IP) (interface{}, error) {
+	bits := ip.To4()
+	node := uint(0)
+	if bits != nil && r.ipVersion == 6 {
+		node = r.ipv4Start
+	} else if bits == nil {
+		if r.ipVersion != 6 {
+			return nil, nil
+		}
+		bits = ip.To16()
+	}
+	for i := 0; i < len(bits)*8 && node < r.nodeCount; i++ {
+		node = r.readNode(node, uint(bits[i/8]>>(7-uint(i%8)))&1)
+	}
+	if node <= r.nodeCount {
+		return nil, nil
+	}
+	v, _, err := r.decode(node - r.nodeCount - 16)
+	return v, err
+}
+
+// decode decode the data field at offset of the data section, returns it and
+// the offset after it.
+func (r *mmdbReader) decode(offset uint) (interface{}, uint, error) {
+	if offset >= uint(len(r.data)) {
+		return nil, 0, errMmdbCorrupt
+	}
+	ctrl := r.data[offset]
+	offset++
+	typ := uint(ctrl >> 5)
+	if typ == 1 { // pointer
+		return r.decodePointer(ctrl, offset)
+	}
+	if typ == 0 { // extended
+		if offset >= uint(len(r.data)) {
+			return nil, 0, errMmdbCorrupt
+		}
+		typ = 7 + uint(r.data[offset])
+		offset++
+	}
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > uint(len(r.data)) {
+			return nil, 0, errMmdbCorrupt
+		}
+		v := uint(0)
+		for _, b := range r.data[offset : offset+n] {
+			v = v<<8 | uint(b)
+		}
+		offset += n
+		switch size {
+		case 29:
+			size = 29 + v
+		case 30:
+			size = 285 + v
+		default:
+			size = 65821 + v
+		}
+	}
+	switch typ {
+	case 7: // map
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			k, next, err := r.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errMmdbCorrupt
+			}
+			v, next, err := r.decode(next)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[key], offset = v, next
+		}
+		return m, offset, nil
+	case 11: // array
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			v, next, err := r.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			a, offset = append(a, v), next
+		}
+		return a, offset, nil
+	case 14: // boolean
+		return size != 0, offset, nil
+	}
+	if offset+size > uint(len(r.data)) {
+		return nil, 0, errMmdbCorrupt
+	}
+	b := r.data[offset : offset+size]
+	offset += size
+	switch typ {
+	case 2: // string
+		return string(b), offset, nil
+	case 3: // double
+		if size != 8 {
+			return nil, 0, errMmdbCorrupt
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case 15: // float
+		if size != 4 {
+			return nil, 0, errMmdbCorrupt
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	case 5, 6, 9, 8: // uint16, uint32, uint64, int32
+		v := uint64(0)
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		if typ == 8 {
+			return int64(int32(v)), offset, nil
+		}
+		return v, offset, nil
+	case 4, 10: // bytes, uint128
+		return b, offset, nil
+	}
+	return nil, 0, fmt.Errorf("unknown type %d in MaxMind DB", typ)
+}
+
+// decodePointer decode the pointer with the control byte ctrl, and the value
+// it points to.
+func (r *mmdbReader) decodePointer(ctrl byte, offset uint) (interface{}, uint, error) {
+	n := uint(ctrl>>3)&3 + 1
+	if offset+n > uint(len(r.data)) {
+		return nil, 0, errMmdbCorrupt
+	}
+	p := uint(0)
+	if n < 4 {
+		p = uint(ctrl & 7)
+	}
+	for _, b := range r.data[offset : offset+n] {
+		p = p<<8 | uint(b)
+	}
+	switch n {
+	case 2:
+		p += 2048
+	case 3:
+		p += 526336
+	}
+	v, _, err := r.decode(p)
+	return v, offset + n, err
+}
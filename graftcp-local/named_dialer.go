@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net"
+
+	"golang.org/x/net/proxy"
+)
+
+// namedDialer is the dialer of an upstream with its name, and the address of
+// the proxy dialed, which is the one picked from the proxy list for each dial
+// if the dialer is a proxy pool.
+type namedDialer struct {
+	proxy.Dialer
+	name string
+	addr string // empty if dialing directly
+}
+
+// namedDialer returns dialer with its upstream name and proxy address.
+func (l *Local) namedDialer(dialer proxy.Dialer) *namedDialer {
+	name := l.upstreamName(dialer)
+	return &namedDialer{Dialer: dialer, name: name, addr: l.upstreamAddr(name)}
+}
+
+func (d *namedDialer) Dial(network, addr string) (net.Conn, error) {
+	p, ok := d.Dialer.(*proxyPool)
+	if !ok {
+		return d.Dialer.Dial(network, addr)
+	}
+	host, conn, err := p.dial(network, addr)
+	d.addr = host
+	return conn, err
+}
+
+// String returns the name and the proxy address like "socks5 127.0.0.1:1080",
+// or only the name if dialing directly.
+func (d *namedDialer) String() string {
+	if d.addr == "" {
+		return d.name
+	}
+	return d.name + " " + d.addr
+}
+
+// upstreamAddr returns the address of the proxy of the upstream name, empty
+// if it dials directly or its proxies are from the proxy list.
+func (l *Local) upstreamAddr(name string) string {
+	switch name {
+	case "socks5":
+		return l.socks5Addr
+	case "http_proxy":
+		return l.httpProxyAddr
+	case "honeypot":
+		return l.honeypotDialer.addr
+	}
+	return ""
+}
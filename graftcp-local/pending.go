@@ -0,0 +1,38 @@
+package main
+
+import (
+	"expvar"
+	"net"
+	"sync/atomic"
+
+	"github.com/jedisct1/dlog"
+)
+
+// connsPending count the connections accepted but not dialed yet.
+var connsPending = expvar.NewInt("conns_pending")
+
+// SetMaxPending set the max number of the connections accepted but not dialed
+// yet, the new connections are shed beyond it, no limit if max <= 0.
+func (l *Local) SetMaxPending(max int) {
+	l.maxPending = int64(max)
+}
+
+// admit count conn as pending, or shed it if there are too many pending
+// connections, it returns false if conn is shed.
+func (l *Local) admit(conn net.Conn) bool {
+	n := atomic.AddInt64(&l.pending, 1)
+	if l.maxPending > 0 && n > l.maxPending {
+		atomic.AddInt64(&l.pending, -1)
+		dlog.Warnf("shed the connection from %s: %d connections pending", conn.RemoteAddr().String(), n-1)
+		rejectConn(conn, "overload")
+		return false
+	}
+	connsPending.Add(1)
+	return true
+}
+
+// release uncount a connection admitted.
+func (l *Local) release() {
+	atomic.AddInt64(&l.pending, -1)
+	connsPending.Add(-1)
+}
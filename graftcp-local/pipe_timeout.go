@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pipeTimeouts are the timeouts of a direction of the connections, no
+// timeout if 0.
+type pipeTimeouts struct {
+	read  time.Duration // waiting for the data from the source
+	write time.Duration // writing the data to the destination
+}
+
+// SetPipeTimeouts set the read and the write timeouts of the directions of
+// the connections, each is a duration for both directions, or like
+// "upload=10m,download=0" for each direction, no timeout if empty or 0.
+func (l *Local) SetPipeTimeouts(read, write string) error {
+	var err error
+	if l.uploadTimeouts.read, l.downloadTimeouts.read, err = parseDirTimeouts(read); err != nil {
+		return fmt.Errorf("bad read_timeout: %s", err.Error())
+	}
+	if l.uploadTimeouts.write, l.downloadTimeouts.write, err = parseDirTimeouts(write); err != nil {
+		return fmt.Errorf("bad write_timeout: %s", err.Error())
+	}
+	return nil
+}
+
+// parseDirTimeouts parse the timeouts of the upload and the download
+// directions like "10m" or "upload=10m,download=0".
+func parseDirTimeouts(s string) (upload, download time.Duration, err error) {
+	if s == "" {
+		return 0, 0, nil
+	}
+	if !strings.Contains(s, "=") {
+		d, err := time.ParseDuration(s)
+		return d, d, err
+	}
+	for _, kv := range strings.Split(s, ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return 0, 0, fmt.Errorf("bad timeout: %s", kv)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return 0, 0, err
+		}
+		switch strings.TrimSpace(parts[0]) {
+		case "upload":
+			upload = d
+		case "download":
+			download = d
+		default:
+			return 0, 0, fmt.Errorf("unknown direction: %s", parts[0])
+		}
+	}
+	return upload, download, nil
+}
+
+// teardown is the teardown of the both directions of a connection, the
+// deadlines of the connection are set with it held, so a deadline of a read or
+// a write never overrides the deadline of the teardown.
+type teardown struct {
+	sync.Mutex
+	torn bool
+}
+
+// isTorn reports whether the connection is torn down.
+func (t *teardown) isTorn() bool {
+	t.Lock()
+	defer t.Unlock()
+	return t.torn
+}
+
+// tear mark the connection torn down, and set the deadline of dst and src.
+func (t *teardown) tear(dst, src net.Conn, deadline time.Time) {
+	t.Lock()
+	defer t.Unlock()
+	t.torn = true
+	dst.SetDeadline(deadline)
+	src.SetDeadline(deadline)
+}
+
+// deadlineReader read from conn, each read times out after timeout, until
+// the connection is torn down and its deadlines are set by the teardown.
+type deadlineReader struct {
+	conn    net.Conn
+	timeout time.Duration
+	t       *teardown
+}
+
+func (r deadlineReader) Read(p []byte) (int, error) {
+	r.t.Lock()
+	if !r.t.torn {
+		r.conn.SetReadDeadline(time.Now().Add(r.timeout))
+	}
+	r.t.Unlock()
+	return r.conn.Read(p)
+}
+
+// deadlineWriter write to conn, each write times out after timeout, until
+// the connection is torn down.
+type deadlineWriter struct {
+	conn    net.Conn
+	timeout time.Duration
+	t       *teardown
+}
+
+func (w deadlineWriter) Write(p []byte) (int, error) {
+	w.t.Lock()
+	if !w.t.torn {
+		w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+	}
+	w.t.Unlock()
+	return w.conn.Write(p)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// TestPipeTeardown checks that the read deadlines of an idle direction don't
+// override the deadline of the teardown once the other direction is done.
+func TestPipeTeardown(t *testing.T) {
+	timeouts := pipeTimeouts{read: time.Hour, write: time.Hour}
+	for i := 0; i < 100; i++ {
+		app, conn := net.Pipe()
+		destConn, dest := net.Pipe()
+		torn := &teardown{}
+		up, down := make(chan int64, 1), make(chan int64, 1)
+		go pipe(destConn, conn, &byteMeter{}, new(int64), nil, nil, timeouts, 0, torn, up)
+		go pipe(conn, destConn, &byteMeter{}, new(int64), nil, nil, timeouts, 0, torn, down)
+		app.Close() // the upload is done, the download is idle
+		select {
+		case <-up:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the upload is not done after the app closed")
+		}
+		select {
+		case <-down:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the idle download is not torn down")
+		}
+		dest.Close()
+	}
+}
+
+func TestParseDirTimeouts(t *testing.T) {
+	tests := []struct {
+		s                string
+		upload, download time.Duration
+		wantErr          bool
+	}{
+		{s: ""},
+		{s: "10m", upload: 10 * time.Minute, download: 10 * time.Minute},
+		{s: "upload=10m,download=0", upload: 10 * time.Minute},
+		{s: "download=30s", download: 30 * time.Second},
+		{s: "upload", wantErr: true},
+		{s: "sideways=1s", wantErr: true},
+		{s: "upload=soon", wantErr: true},
+	}
+	for _, tt := range tests {
+		upload, download, err := parseDirTimeouts(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseDirTimeouts(%q) err = %v, want err %v", tt.s, err, tt.wantErr)
+			continue
+		}
+		if err == nil && (upload != tt.upload || download != tt.download) {
+			t.Errorf("parseDirTimeouts(%q) = %s, %s, want %s, %s", tt.s, upload, download, tt.upload, tt.download)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// portStats are the stats of the connections by the bucket of the
+// destination port, which is the port itself for the metrics ports, and
+// "other" for the rest, so the cardinality is bounded.
+var portStats = expvar.NewMap("ports")
+
+// metricsPorts are the destination ports counted on their own.
+var metricsPorts map[uint16]bool
+
+func init() {
+	SetMetricsPorts("22,80,443")
+}
+
+// SetMetricsPorts count the connections to each of ports, a comma separated
+// list, on their own, and the others as "other".
+func SetMetricsPorts(ports string) error {
+	m := make(map[uint16]bool)
+	for _, s := range strings.Split(ports, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		port, err := strconv.ParseUint(s, 10, 16)
+		if err != nil || port == 0 {
+			return fmt.Errorf("bad port in metrics_ports: %s", s)
+		}
+		m[uint16(port)] = true
+	}
+	metricsPorts = m
+	portStats.Init()
+	for port := range m {
+		portStats.Set(strconv.Itoa(int(port)), newPortStat())
+	}
+	portStats.Set("other", newPortStat())
+	return nil
+}
+
+// newPortStat returns the stats of a bucket, all the counters are reported
+// even if zero.
+func newPortStat() *expvar.Map {
+	m := new(expvar.Map).Init()
+	for _, k := range []string{"conns", "active", "sent", "received"} {
+		m.Set(k, new(expvar.Int))
+	}
+	return m
+}
+
+// portStatsOf returns the stats of the bucket of port.
+func portStatsOf(port uint16) *expvar.Map {
+	bucket := "other"
+	if metricsPorts[port] {
+		bucket = strconv.Itoa(int(port))
+	}
+	return portStats.Get(bucket).(*expvar.Map)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+// healthCheckThreshold is the number of the consecutive check results to
+// mark the primary upstream down or up, so it doesn't flap on a single
+// failure.
+const healthCheckThreshold = 2
+
+// primaryBackup is the primary and the backup upstream of the auto mode, the
+// backup is only used while the health checks of the primary fail.
+type primaryBackup struct {
+	primary, backup modeT
+	names           [2]string // upstream names of the primary and the backup
+	interval        time.Duration
+
+	mu     sync.Mutex
+	down   bool // if the primary is down
+	streak int  // consecutive check results against down
+}
+
+// SetPrimaryBackup use the primary upstream of spec in the auto mode while
+// it's healthy, and the backup only while it's down, spec is like
+// "socks5,http_proxy". The primary is checked every interval by connecting
+// to it. It replaces the failover chain.
+func (l *Local) SetPrimaryBackup(spec string, interval time.Duration) error {
+	names := strings.Split(spec, ",")
+	if len(names) != 2 {
+		return fmt.Errorf("bad primary_backup: %s, want primary,backup", spec)
+	}
+	var modes [2]modeT
+	for i, name := range names {
+		names[i] = strings.TrimSpace(name)
+		m, ok := failoverDialerModes[names[i]]
+		if !ok || m == RejectMode {
+			return fmt.Errorf("unknown upstream in primary_backup: %s", name)
+		}
+		modes[i] = m
+	}
+	if modes[0] == modes[1] {
+		return fmt.Errorf("the same primary and backup in primary_backup: %s", spec)
+	}
+	if interval <= 0 {
+		return fmt.Errorf("bad health_check_interval: %s", interval)
+	}
+	l.primaryBackup = &primaryBackup{
+		primary:  modes[0],
+		backup:   modes[1],
+		names:    [2]string{names[0], names[1]},
+		interval: interval,
+	}
+	return nil
+}
+
+// active returns the upstream to use, the primary unless it's down.
+func (pb *primaryBackup) active() modeT {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	if pb.down {
+		return pb.backup
+	}
+	return pb.primary
+}
+
+// chain returns the failover chain of the auto mode, the backup is tried
+// after the primary fails even if it's considered up.
+func (pb *primaryBackup) chain() []modeT {
+	if pb.active() == pb.backup {
+		return []modeT{pb.backup}
+	}
+	return []modeT{pb.primary, pb.backup}
+}
+
+// report record a health check result of the primary, log the failover and
+// the failback, and reports whether the primary is marked down or up.
+func (pb *primaryBackup) report(ok bool, err error) bool {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	if ok != pb.down {
+		pb.streak = 0
+		return false
+	}
+	pb.streak++
+	if pb.streak < healthCheckThreshold {
+		return false
+	}
+	pb.streak = 0
+	pb.down = !ok
+	if pb.down {
+		dlog.Warnf("primary upstream %s is down (%s), fail over to the backup %s", pb.names[0], err.Error(), pb.names[1])
+	} else {
+		dlog.Noticef("primary upstream %s recovered, fail back from the backup %s", pb.names[0], pb.names[1])
+	}
+	return true
+}
+
+// CheckPrimary check the health of the primary upstream periodically, it
+// never returns, and returns at once if there is no primary_backup.
+func (l *Local) CheckPrimary() {
+	pb := l.primaryBackup
+	if pb == nil {
+		return
+	}
+	for {
+		err := l.checkUpstream(pb.primary)
+		if pb.report(err == nil, err) {
+			l.resetWarmPool(pb.names[0], err == nil)
+			l.healthWebhook.notify(pb.names[0], l.upstreamAddr(pb.names[0]), err == nil, err)
+		}
+		time.Sleep(pb.interval)
+	}
+}
+
+// checkUpstream connect to the proxy of the upstream mode, the direct
+// upstream is always healthy, and a proxy from the proxy list is healthy if
+// there is one.
+func (l *Local) checkUpstream(mode modeT) error {
+	var name, addr string
+	switch mode {
+	case OnlySocks5Mode:
+		name, addr = "socks5", l.socks5Addr
+	case OnlyHttpProxyMode:
+		name, addr = "http_proxy", l.httpProxyAddr
+	default:
+		return nil
+	}
+	if !available(l.proxySelector(mode)) {
+		return ErrNoDialer
+	}
+	if addr == "" {
+		return nil
+	}
+	// bypass the warm pool, an idle connection says nothing of the proxy now
+	conn, err := dialTimeout(context.Background(), unpooledDialer{l.forwards[name]}, addr, probeTimeout)
+	if err != nil {
+		return err
+	}
+	conn.Close()
+	return nil
+}
+
+// activeUpstream returns the name of the upstream in use by primary_backup,
+// empty if there is no primary_backup.
+func (pb *primaryBackup) activeUpstream() string {
+	if pb == nil {
+		return ""
+	}
+	if pb.active() == pb.backup {
+		return pb.names[1]
+	}
+	return pb.names[0]
+}
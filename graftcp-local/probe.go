@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	"golang.org/x/net/proxy"
+)
+
+const probeTimeout = 5 * time.Second
+
+var proxyKinds = map[string]string{
+	"socks5":     "a SOCKS5 proxy",
+	"http_proxy": "an HTTP proxy",
+}
+
+// upstreamProbe is the probe of the protocol spoken by a proxy, which is done
+// once in the background at startup.
+type upstreamProbe struct {
+	addr  string
+	done  chan struct{} // closed once probed
+	fixed proxy.Dialer  // the dialer of the protocol probed if it's mismatched
+}
+
+// SetProxyProbe set what to do if a proxy doesn't speak the protocol
+// configured, "off" not to probe the protocol, "warn" to log the protocol
+// spoken, or "fix" to use the proxy with the protocol spoken as well. The
+// proxies are probed by ProbeProxies.
+func (l *Local) SetProxyProbe(action string) error {
+	switch action {
+	case "off":
+		l.probes = nil
+		return nil
+	case "warn", "fix":
+	default:
+		return fmt.Errorf("unknown proxy_probe: %s", action)
+	}
+	l.probeFix = action == "fix"
+	l.probes = make(map[string]*upstreamProbe)
+	if l.socks5Addr != "" {
+		l.probes["socks5"] = &upstreamProbe{addr: l.socks5Addr, done: make(chan struct{})}
+	}
+	if l.httpProxyAddr != "" {
+		l.probes["http_proxy"] = &upstreamProbe{addr: l.httpProxyAddr, done: make(chan struct{})}
+	}
+	return nil
+}
+
+// ProbeProxies probe the protocols spoken by the proxies concurrently in the
+// background, so neither the startup nor the connections wait for them. The
+// proxies are dialed as configured until probed.
+func (l *Local) ProbeProxies() {
+	for name, p := range l.probes {
+		go l.probe(name, p)
+	}
+}
+
+// waitProbes wait for the probes started by ProbeProxies to be done.
+func (l *Local) waitProbes() {
+	for _, p := range l.probes {
+		<-p.done
+	}
+}
+
+func (l *Local) probe(name string, p *upstreamProbe) {
+	defer close(p.done)
+	protocol, err := probeProtocol(l.forwards[name], p.addr)
+	if err != nil {
+		dlog.Warnf("probe the protocol of the %s proxy %s err: %s", name, p.addr, err.Error())
+		return
+	}
+	if protocol == name {
+		dlog.Debugf("the %s proxy %s is %s", name, p.addr, proxyKinds[protocol])
+		return
+	}
+	dlog.Warnf("the %s proxy %s is actually %s, please check the config for proxy", name, p.addr, proxyKinds[protocol])
+	if l.probeFix {
+		dlog.Noticef("use %s as %s instead", p.addr, proxyKinds[protocol])
+		p.fixed = newProxyDialer(protocol, p.addr, l.forwards[name], l.proxyAuth(name), l.httpProxyHeader)
+	}
+}
+
+// probedDialer returns the dialer to dial with dialer, it's dialer itself
+// unless the proxy of dialer speaks the other protocol and it's fixed.
+func (l *Local) probedDialer(dialer proxy.Dialer) proxy.Dialer {
+	p, ok := l.probes[l.upstreamName(dialer)]
+	if !ok || !isClosed(p.done) || p.fixed == nil {
+		return dialer
+	}
+	return p.fixed
+}
+
+// proxyAuth returns the credentials configured for the proxy of the upstream
+// name: the socks5 username and password, or the basic credentials in the
+// Proxy-Authorization header of http_proxy. It's nil if none.
+func (l *Local) proxyAuth(name string) *proxy.Auth {
+	if name == "socks5" {
+		return l.socks5Auth
+	}
+	req := &http.Request{Header: http.Header{"Authorization": l.httpProxyHeader["Proxy-Authorization"]}}
+	if user, password, ok := req.BasicAuth(); ok {
+		return &proxy.Auth{User: user, Password: password}
+	}
+	return nil
+}
+
+// probeProtocol returns the protocol spoken by the proxy at addr, "socks5" or
+// "http_proxy". The SOCKS5 greeting is sent first, which is answered at once
+// by a SOCKS5 proxy, then the end of the request is sent to make an HTTP proxy
+// answer the bad request.
+func probeProtocol(dialer proxy.Dialer, addr string) (string, error) {
+	conn, err := dialTimeout(context.Background(), dialer, addr, probeTimeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte{5, 1, 0}); err != nil {
+		return "", err
+	}
+	buf := make([]byte, 5)
+	conn.SetReadDeadline(time.Now().Add(probeTimeout / 2))
+	n, err := conn.Read(buf)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		if _, err := conn.Write([]byte("\r\n\r\n")); err != nil {
+			return "", err
+		}
+		conn.SetReadDeadline(time.Now().Add(probeTimeout / 2))
+		n, err = conn.Read(buf)
+	}
+	if n == 0 {
+		if err == nil || err == io.EOF {
+			err = fmt.Errorf("closed without a reply")
+		}
+		return "", err
+	}
+	if buf[0] == 5 {
+		return "socks5", nil
+	}
+	if n < len(buf) {
+		if _, err := io.ReadFull(conn, buf[n:]); err != nil {
+			return "", err
+		}
+	}
+	if bytes.Equal(buf, []byte("HTTP/")) {
+		return "http_proxy", nil
+	}
+	return "", fmt.Errorf("unknown reply: %q", buf)
+}
+
+// newProxyDialer returns the dialer of the proxy at addr speaking protocol,
+// "socks5" or "http_proxy", through forward with the credentials auth if not
+// nil, and the extra header of the CONNECT request if it's an HTTP proxy.
+func newProxyDialer(protocol, addr string, forward proxy.Dialer, auth *proxy.Auth, header http.Header) proxy.Dialer {
+	if protocol == "http_proxy" {
+		d := &httpDialer{host: addr, header: header, forward: forward}
+		if auth != nil {
+			d.isAuth, d.username, d.password = true, auth.User, auth.Password
+		}
+		return d
+	}
+	dialer, err := proxy.SOCKS5("tcp", addr, auth, forward)
+	if err != nil {
+		dlog.Errorf("create the %s dialer of %s err: %s", protocol, addr, err.Error())
+		return nil
+	}
+	return dialer
+}
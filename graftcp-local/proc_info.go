@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+// procCacheTTL is how long the process information is cached, keep it short
+// as the pid may be reused by another process.
+const procCacheTTL = 10 * time.Second
+
+type procCacheEntry struct {
+	val   interface{}
+	mtime time.Time
+}
+
+// procCache cache the information loaded from /proc/<pid>.
+type procCache struct {
+	sync.Mutex
+	m map[string]procCacheEntry
+}
+
+func newProcCache() *procCache {
+	return &procCache{m: make(map[string]procCacheEntry)}
+}
+
+// get returns the cached value for pid, or the value loaded by load.
+func (c *procCache) get(pid string, load func(pid string) (interface{}, error)) (interface{}, error) {
+	now := time.Now()
+	c.Lock()
+	e, ok := c.m[pid]
+	c.Unlock()
+	if ok && now.Sub(e.mtime) < procCacheTTL {
+		return e.val, nil
+	}
+	val, err := load(pid)
+	if err != nil {
+		return nil, err
+	}
+	c.Lock()
+	for k, e := range c.m {
+		if now.Sub(e.mtime) >= procCacheTTL {
+			delete(c.m, k)
+		}
+	}
+	c.m[pid] = procCacheEntry{val: val, mtime: now}
+	c.Unlock()
+	return val, nil
+}
+
+var uidCache = newProcCache()
+
+// procUid returns the user ID owning the process pid.
+func procUid(pid string) (uint32, error) {
+	v, err := uidCache.get(pid, func(pid string) (interface{}, error) {
+		fi, err := os.Stat("/proc/" + pid)
+		if err != nil {
+			return nil, err
+		}
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok {
+			return nil, fmt.Errorf("unknown owner of /proc/%s", pid)
+		}
+		return st.Uid, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return v.(uint32), nil
+}
+
+var commCache = newProcCache()
+
+// procComm returns the command name of the process pid.
+func procComm(pid string) (string, error) {
+	v, err := commCache.get(pid, func(pid string) (interface{}, error) {
+		data, err := ioutil.ReadFile("/proc/" + pid + "/comm")
+		if err != nil {
+			return nil, err
+		}
+		return strings.TrimSpace(string(data)), nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return v.(string), nil
+}
+
+var cmdlineCache = newProcCache()
+
+// procCmdline returns the command line of the process pid, the arguments are
+// joined by spaces.
+func procCmdline(pid string) (string, error) {
+	v, err := cmdlineCache.get(pid, func(pid string) (interface{}, error) {
+		data, err := ioutil.ReadFile("/proc/" + pid + "/cmdline")
+		if err != nil {
+			return nil, err
+		}
+		args := strings.Split(strings.TrimRight(string(data), "\x00"), "\x00")
+		return strings.Join(args, " "), nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return v.(string), nil
+}
+
+// watchPid close conns if the process pid exits, it checks every interval
+// until done is closed.
+func watchPid(pid string, interval time.Duration, done <-chan struct{}, conns ...io.Closer) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		if _, err := os.Stat("/proc/" + pid); os.IsNotExist(err) {
+			dlog.Infof("PID: %s exited, close its connection", pid)
+			connsOrphaned.Add(1)
+			for _, c := range conns {
+				c.Close()
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"expvar"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+type pidAddrEntry struct {
+	addr  string
+	mtime time.Time // when the entry was stored
+}
+
+const (
+	// pidAddrDupWindow is the window of the duplicate address info, e.g. sent
+	// twice by graftcp for a restarted connect(2).
+	pidAddrDupWindow = 10 * time.Millisecond
+	// pidAddrStaleWindow is how long an address info may wait to be taken
+	// after a newer one of the same pid is received. It's stale beyond that,
+	// e.g. the connect(2) failed before graftcp-local accepted it, and it's
+	// dropped so it never shifts the later connections of the pid onto the
+	// previous destinations.
+	pidAddrStaleWindow = time.Second
+)
+
+// pidAddrs is the address info of a pid not taken yet, in the order received.
+// The same address info received again within pidAddrDupWindow is kept as a
+// duplicate instead of queued, as it can't be told from the connections to the
+// same destination in a row. The duplicates are only taken if the queue is
+// empty, and the latest first, so a stale one never takes the place of the
+// next connection. The queued ones stale for pidAddrStaleWindow are dropped
+// when taking.
+type pidAddrs struct {
+	queue []pidAddrEntry
+	dups  []pidAddrEntry
+	last  pidAddrEntry // the last address info received
+}
+
+func (p *pidAddrs) push(addr string, now time.Time) {
+	e := pidAddrEntry{addr: addr, mtime: now}
+	if addr == p.last.addr && now.Sub(p.last.mtime) < pidAddrDupWindow {
+		p.dups = append(p.dups, e)
+		pidAddrDuplicates.Add(1)
+	} else {
+		p.queue = append(p.queue, e)
+	}
+	p.last = e
+	atomic.AddInt64(&pidAddrSize, 1)
+}
+
+// next returns the address to be taken next, dup is true if it's a
+// duplicate.
+func (p *pidAddrs) next() (addr string, dup bool, ok bool) {
+	p.dropStale()
+	if len(p.queue) > 0 {
+		return p.queue[0].addr, false, true
+	}
+	if len(p.dups) > 0 {
+		return p.dups[len(p.dups)-1].addr, true, true
+	}
+	return "", false, false
+}
+
+func (p *pidAddrs) take() (string, bool) {
+	p.dropStale()
+	if len(p.queue) > 0 {
+		e := p.queue[0]
+		p.queue = p.queue[1:]
+		atomic.AddInt64(&pidAddrSize, -1)
+		return e.addr, true
+	}
+	if len(p.dups) > 0 {
+		e := p.dups[len(p.dups)-1]
+		p.dups = p.dups[:len(p.dups)-1]
+		atomic.AddInt64(&pidAddrSize, -1)
+		return e.addr, true
+	}
+	return "", false
+}
+
+// dropStale drop the queued entries received pidAddrStaleWindow before the
+// last one, which are never taken by their connections.
+func (p *pidAddrs) dropStale() {
+	n := 0
+	for n < len(p.queue)-1 && p.last.mtime.Sub(p.queue[n].mtime) > pidAddrStaleWindow {
+		n++
+	}
+	if n > 0 {
+		p.queue = p.queue[n:]
+		atomic.AddInt64(&pidAddrSize, -int64(n))
+		pidAddrStale.Add(int64(n))
+	}
+}
+
+// evict delete the entries stored before t, returns the number of entries
+// deleted.
+func (p *pidAddrs) evict(t time.Time) int {
+	n := len(p.queue) + len(p.dups)
+	p.queue = entriesSince(p.queue, t)
+	p.dups = entriesSince(p.dups, t)
+	atomic.AddInt64(&pidAddrSize, int64(p.len()-n))
+	return n - p.len()
+}
+
+// clear delete all the entries.
+func (p *pidAddrs) clear() {
+	atomic.AddInt64(&pidAddrSize, -int64(p.len()))
+	p.queue, p.dups = nil, nil
+}
+
+// appendMtimes append the times the entries were stored to mtimes.
+func (p *pidAddrs) appendMtimes(mtimes []time.Time) []time.Time {
+	for _, e := range p.queue {
+		mtimes = append(mtimes, e.mtime)
+	}
+	for _, e := range p.dups {
+		mtimes = append(mtimes, e.mtime)
+	}
+	return mtimes
+}
+
+func (p *pidAddrs) len() int {
+	return len(p.queue) + len(p.dups)
+}
+
+// PidAddrInfo is an address info of a pid not taken yet, for debugging.
+type PidAddrInfo struct {
+	Pid       string `json:"pid"`
+	Addr      string `json:"addr"`
+	Age       string `json:"age"` // since received
+	Duplicate bool   `json:"duplicate,omitempty"`
+}
+
+// dump returns the address info of pid in the order to be taken.
+func (p *pidAddrs) dump(pid string, now time.Time) []PidAddrInfo {
+	var infos []PidAddrInfo
+	for _, e := range p.queue {
+		infos = append(infos, PidAddrInfo{Pid: pid, Addr: e.addr, Age: now.Sub(e.mtime).String()})
+	}
+	for i := len(p.dups) - 1; i >= 0; i-- {
+		e := p.dups[i]
+		infos = append(infos, PidAddrInfo{Pid: pid, Addr: e.addr, Age: now.Sub(e.mtime).String(), Duplicate: true})
+	}
+	return infos
+}
+
+// entriesSince returns the entries stored since t, the entries are in the
+// order stored.
+func entriesSince(entries []pidAddrEntry, t time.Time) []pidAddrEntry {
+	for i, e := range entries {
+		if !e.mtime.Before(t) {
+			return entries[i:]
+		}
+	}
+	return nil
+}
+
+var (
+	pidAddrEvictions         = expvar.NewInt("pidaddr_evictions")
+	pidAddrOverflowEvictions = expvar.NewInt("pidaddr_overflow_evictions")
+	pidAddrDuplicates        = expvar.NewInt("pidaddr_duplicates")
+	pidAddrStale             = expvar.NewInt("pidaddr_stale")
+
+	pidAddrSize    int64 // number of the entries, accessed atomically
+	pidAddrMax     int64 // max number of the entries, no limit if <= 0, accessed atomically
+	pidAddrLimitMu sync.Mutex
+)
+
+// SetPidAddrMax set the max number of the pid/addr entries, the oldest
+// entries are evicted beyond it, no limit if max <= 0.
+func SetPidAddrMax(max int) {
+	atomic.StoreInt64(&pidAddrMax, int64(max))
+}
+
+// limitPidAddr evict the oldest entries if there are more than pidAddrMax
+// entries, down to 9/10 of pidAddrMax so it's not done on every store.
+func limitPidAddr() {
+	max := atomic.LoadInt64(&pidAddrMax)
+	if max <= 0 || atomic.LoadInt64(&pidAddrSize) <= max {
+		return
+	}
+	pidAddrLimitMu.Lock()
+	defer pidAddrLimitMu.Unlock()
+	var mtimes []time.Time
+	rangePidAddrs(func(p *pidAddrs) {
+		mtimes = p.appendMtimes(mtimes)
+	})
+	excess := len(mtimes) - int(max-max/10)
+	if excess <= 0 {
+		return
+	}
+	sort.Slice(mtimes, func(i, j int) bool { return mtimes[i].Before(mtimes[j]) })
+	n := EvictPidAddr(mtimes[excess-1].Add(1))
+	pidAddrOverflowEvictions.Add(int64(n))
+	dlog.Warnf("evict the %d oldest pid/addr entries as there are more than %d", n, max)
+}
+
+// SweepPidAddr evict the pid/addr entries older than ttl periodically.
+func SweepPidAddr(ttl time.Duration) {
+	interval := ttl / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	for range time.Tick(interval) {
+		if n := EvictPidAddr(time.Now().Add(-ttl)); n > 0 {
+			pidAddrEvictions.Add(int64(n))
+			dlog.Debugf("evict %d stale pid/addr entries", n)
+		}
+	}
+}
+
+func init() {
+	expvar.Publish("pidaddr_size", expvar.Func(func() interface{} {
+		return atomic.LoadInt64(&pidAddrSize)
+	}))
+}
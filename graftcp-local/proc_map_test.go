@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func takeAll(p *pidAddrs) []string {
+	var addrs []string
+	for {
+		addr, ok := p.take()
+		if !ok {
+			return addrs
+		}
+		addrs = append(addrs, addr)
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestPidAddrsDuplicate(t *testing.T) {
+	var p pidAddrs
+	now := time.Now()
+	p.push("1.1.1.1:80", now)
+	p.push("1.1.1.1:80", now.Add(time.Millisecond)) // sent twice for a restarted connect
+	p.push("2.2.2.2:80", now.Add(2*time.Millisecond))
+	// the duplicate is taken only after the queue is empty
+	want := []string{"1.1.1.1:80", "2.2.2.2:80", "1.1.1.1:80"}
+	if got := takeAll(&p); !equalStrings(got, want) {
+		t.Errorf("take = %v, want %v", got, want)
+	}
+}
+
+func TestPidAddrsRapidConnect(t *testing.T) {
+	var p pidAddrs
+	now := time.Now()
+	want := []string{"1.1.1.1:80", "2.2.2.2:80", "1.1.1.1:80", "3.3.3.3:443"}
+	for i, addr := range want {
+		p.push(addr, now.Add(time.Duration(i)*pidAddrDupWindow))
+	}
+	if got := takeAll(&p); !equalStrings(got, want) {
+		t.Errorf("take = %v, want %v", got, want)
+	}
+}
+
+func TestPidAddrsStale(t *testing.T) {
+	var p pidAddrs
+	now := time.Now()
+	p.push("9.9.9.9:80", now) // the connect failed before accepted
+	p.push("1.1.1.1:80", now.Add(2*pidAddrStaleWindow))
+	p.push("2.2.2.2:80", now.Add(2*pidAddrStaleWindow+pidAddrDupWindow))
+	want := []string{"1.1.1.1:80", "2.2.2.2:80"}
+	if got := takeAll(&p); !equalStrings(got, want) {
+		t.Errorf("take = %v, want %v", got, want)
+	}
+	if p.len() != 0 {
+		t.Errorf("len = %d, want 0", p.len())
+	}
+}
+
+func TestStoreTakePidAddr(t *testing.T) {
+	const pid = "test-store-take"
+	defer DeletePidAddr(pid)
+	want := []string{"1.1.1.1:80", "[::1]:443", "1.1.1.1:80"}
+	for _, addr := range want {
+		StorePidAddr(pid, addr)
+		time.Sleep(pidAddrDupWindow)
+	}
+	for _, w := range want {
+		if addr, ok := TakePidAddr(pid); !ok || addr != w {
+			t.Errorf("TakePidAddr = %q, %v, want %q", addr, ok, w)
+		}
+	}
+	if addr, ok := TakePidAddr(pid); ok {
+		t.Errorf("TakePidAddr = %q after all taken", addr)
+	}
+}
@@ -2,54 +2,126 @@
 
 package main
 
-import "sync"
+import (
+	"sync"
+	"time"
+)
 
 var (
 	pidAddrMap = struct {
 		sync.RWMutex
-		// map[pid]dest-address-info
-		pidAddr map[string]string
+		// map[pid]dest-address-infos
+		pidAddr map[string]*pidAddrs
 	}{
-		pidAddr: make(map[string]string),
+		pidAddr: make(map[string]*pidAddrs),
 	}
 )
 
-// StorePidAddr store IP address and port for pid to pidAddrMap:
-// pidAddrMap["127.0.0.1:1234"]"5678"
+// StorePidAddr store IP address and port for pid to pidAddrMap, the
+// addresses of a pid are taken in the order stored.
 func StorePidAddr(pid, addr string) {
 	pidAddrMap.Lock()
-	pidAddrMap.pidAddr[pid] = addr
+	p, ok := pidAddrMap.pidAddr[pid]
+	if !ok {
+		p = &pidAddrs{}
+		pidAddrMap.pidAddr[pid] = p
+	}
+	p.push(addr, time.Now())
 	pidAddrMap.Unlock()
+	limitPidAddr()
 }
 
-// Load returns the address stored in the pidAddrMap for pid.
+// Load returns the address to be taken next in the pidAddrMap for pid.
 // The ok result indicates whether address was found in the pidAddrMap.
 func LoadPidAddr(pid string) (addr string, ok bool) {
 	pidAddrMap.RLock()
-	addr, ok = pidAddrMap.pidAddr[pid]
-	pidAddrMap.RUnlock()
-	if ok {
-		return addr, true
+	defer pidAddrMap.RUnlock()
+	if p, ok := pidAddrMap.pidAddr[pid]; ok {
+		addr, _, ok = p.next()
+		return addr, ok
 	}
 	return "", false
+}
 
+// TakePidAddr returns the address to be taken next for pid, and delete it.
+func TakePidAddr(pid string) (addr string, ok bool) {
+	pidAddrMap.Lock()
+	defer pidAddrMap.Unlock()
+	p, ok := pidAddrMap.pidAddr[pid]
+	if !ok {
+		return "", false
+	}
+	addr, ok = p.take()
+	if p.len() == 0 {
+		delete(pidAddrMap.pidAddr, pid)
+	}
+	return addr, ok
 }
 
 // DeletePidAddr delete pid's address information.
 func DeletePidAddr(pid string) {
 	pidAddrMap.Lock()
-	delete(pidAddrMap.pidAddr, pid)
+	if p, ok := pidAddrMap.pidAddr[pid]; ok {
+		p.clear()
+		delete(pidAddrMap.pidAddr, pid)
+	}
 	pidAddrMap.Unlock()
 }
 
-// RangePidAddr calls f sequentially for each pid and addr present in the pidAddrMap.
-// If f returns false, range stops the iteration.
-func RangePidAddr(f func(pid, addr string) bool) {
+// RangePidAddr calls f sequentially for each pid and the address to be taken
+// next present in the pidAddrMap, dup is true if it's a duplicate. If f
+// returns false, range stops the iteration.
+func RangePidAddr(f func(pid, addr string, dup bool) bool) {
 	pidAddrMap.RLock()
-	for k, e := range pidAddrMap.pidAddr {
-		if !f(k, e) {
+	for k, p := range pidAddrMap.pidAddr {
+		addr, dup, ok := p.next()
+		if ok && !f(k, addr, dup) {
 			break
 		}
 	}
 	pidAddrMap.RUnlock()
 }
+
+// EvictPidAddr delete the entries stored before t, returns the number of
+// entries deleted.
+func EvictPidAddr(t time.Time) (n int) {
+	pidAddrMap.Lock()
+	for k, p := range pidAddrMap.pidAddr {
+		n += p.evict(t)
+		if p.len() == 0 {
+			delete(pidAddrMap.pidAddr, k)
+		}
+	}
+	pidAddrMap.Unlock()
+	return
+}
+
+// rangePidAddrs calls f for the address info of each pid.
+func rangePidAddrs(f func(p *pidAddrs)) {
+	pidAddrMap.RLock()
+	for _, p := range pidAddrMap.pidAddr {
+		f(p)
+	}
+	pidAddrMap.RUnlock()
+}
+
+// DumpPidAddr returns all the entries in the pidAddrMap.
+func DumpPidAddr() (infos []PidAddrInfo) {
+	now := time.Now()
+	pidAddrMap.RLock()
+	for k, p := range pidAddrMap.pidAddr {
+		infos = append(infos, p.dump(k, now)...)
+	}
+	pidAddrMap.RUnlock()
+	return
+}
+
+// LenPidAddr returns the number of entries in the pidAddrMap.
+func LenPidAddr() (n int) {
+	pidAddrMap.RLock()
+	for _, p := range pidAddrMap.pidAddr {
+		n += p.len()
+	}
+	pidAddrMap.RUnlock()
+	return
+}
@@ -2,39 +2,147 @@
 
 package main
 
-import "sync"
+import (
+	"sync"
+	"time"
+)
 
+// pidAddrMap["5678"]*syncPidAddrs
 var pidAddrMap sync.Map
 
-// StorePidAddr store IP address and port for pid to pidAddrMap:
-// pidAddrMap["127.0.0.1:1234"]"5678"
+type syncPidAddrs struct {
+	sync.Mutex
+	pidAddrs
+	deleted bool // deleted from pidAddrMap, so not to be stored into
+}
+
+// StorePidAddr store IP address and port for pid to pidAddrMap, the
+// addresses of a pid are taken in the order stored.
 func StorePidAddr(pid, addr string) {
-	pidAddrMap.Store(pid, addr)
+	now := time.Now()
+	for {
+		v, _ := pidAddrMap.LoadOrStore(pid, &syncPidAddrs{})
+		p := v.(*syncPidAddrs)
+		p.Lock()
+		if !p.deleted {
+			p.push(addr, now)
+			p.Unlock()
+			limitPidAddr()
+			return
+		}
+		p.Unlock()
+	}
 }
 
-// LoadPidAddr returns the address stored in the pidAddrMap for pid.
+// LoadPidAddr returns the address to be taken next in the pidAddrMap for pid.
 // The ok result indicates whether address was found in the pidAddrMap.
 func LoadPidAddr(pid string) (addr string, ok bool) {
 	v, ok := pidAddrMap.Load(pid)
 	if !ok {
 		return "", ok
 	}
-	addr, ok = v.(string)
-	return
+	p := v.(*syncPidAddrs)
+	p.Lock()
+	defer p.Unlock()
+	addr, _, ok = p.next()
+	return addr, ok
+}
+
+// TakePidAddr returns the address to be taken next for pid, and delete it.
+func TakePidAddr(pid string) (addr string, ok bool) {
+	v, ok := pidAddrMap.Load(pid)
+	if !ok {
+		return "", ok
+	}
+	p := v.(*syncPidAddrs)
+	p.Lock()
+	defer p.Unlock()
+	addr, ok = p.take()
+	if p.len() == 0 {
+		p.deleted = true
+		pidAddrMap.Delete(pid)
+	}
+	return addr, ok
 }
 
 // DeletePidAddr delete pid's address information.
 func DeletePidAddr(pid string) {
-	pidAddrMap.Delete(pid)
+	if v, ok := pidAddrMap.Load(pid); ok {
+		p := v.(*syncPidAddrs)
+		p.Lock()
+		p.clear()
+		p.deleted = true
+		pidAddrMap.Delete(pid)
+		p.Unlock()
+	}
 }
 
-// RangePidAddr calls f sequentially for each pid and addr present in the pidAddrMap.
-// If f returns false, range stops the iteration.
-func RangePidAddr(f func(pid, addr string) bool) {
+// RangePidAddr calls f sequentially for each pid and the address to be taken
+// next present in the pidAddrMap, dup is true if it's a duplicate. If f
+// returns false, range stops the iteration.
+func RangePidAddr(f func(pid, addr string, dup bool) bool) {
 	f2 := func(k, v interface{}) bool {
-		p, _ := k.(string)
-		a, _ := v.(string)
-		return f(p, a)
+		p := v.(*syncPidAddrs)
+		p.Lock()
+		addr, dup, ok := p.next()
+		p.Unlock()
+		if !ok {
+			return true
+		}
+		return f(k.(string), addr, dup)
 	}
 	pidAddrMap.Range(f2)
 }
+
+// EvictPidAddr delete the entries stored before t, returns the number of
+// entries deleted.
+func EvictPidAddr(t time.Time) (n int) {
+	pidAddrMap.Range(func(k, v interface{}) bool {
+		p := v.(*syncPidAddrs)
+		p.Lock()
+		n += p.evict(t)
+		if p.len() == 0 {
+			p.deleted = true
+			pidAddrMap.Delete(k)
+		}
+		p.Unlock()
+		return true
+	})
+	return
+}
+
+// rangePidAddrs calls f for the address info of each pid with it locked.
+func rangePidAddrs(f func(p *pidAddrs)) {
+	pidAddrMap.Range(func(k, v interface{}) bool {
+		p := v.(*syncPidAddrs)
+		p.Lock()
+		f(&p.pidAddrs)
+		p.Unlock()
+		return true
+	})
+}
+
+// DumpPidAddr returns all the entries in the pidAddrMap.
+func DumpPidAddr() (infos []PidAddrInfo) {
+	now := time.Now()
+	pidAddrMap.Range(func(k, v interface{}) bool {
+		p := v.(*syncPidAddrs)
+		p.Lock()
+		infos = append(infos, p.dump(k.(string), now)...)
+		p.Unlock()
+		return true
+	})
+	return
+}
+
+// LenPidAddr returns the number of entries in the pidAddrMap.
+func LenPidAddr() (n int) {
+	pidAddrMap.Range(func(k, v interface{}) bool {
+		p := v.(*syncPidAddrs)
+		p.Lock()
+		n += p.len()
+		p.Unlock()
+		return true
+	})
+	return
+}
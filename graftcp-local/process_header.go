@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/proxy"
+)
+
+// processHeader is the header of the CONNECT request telling the HTTP proxy
+// the local process of the connection.
+type processHeader struct {
+	name  string
+	value userTemplate
+}
+
+// SetHttpProcessHeader set the header like "X-Graftcp-Process: {comm}/{pid}"
+// added to the CONNECT request sent to the HTTP proxy for each connection, so
+// the proxy logs may tell the local process of it. The value is a template
+// with the variables of the SOCKS5 username template. It's only sent to the
+// HTTP proxies, not to the SOCKS5 proxies, and not to the proxies from the
+// proxy list.
+func (l *Local) SetHttpProcessHeader(header string) error {
+	kv := strings.SplitN(header, ":", 2)
+	if len(kv) < 2 {
+		return fmt.Errorf("bad format of header: %s", header)
+	}
+	name, val := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+	if !isHeaderName(name) {
+		return fmt.Errorf("bad header name: %q", name)
+	}
+	if strings.ContainsAny(val, "\r\n") {
+		return fmt.Errorf("bad value of header %s", name)
+	}
+	t, err := parseUserTemplate(val)
+	if err != nil {
+		return err
+	}
+	l.processHeader = &processHeader{name: http.CanonicalHeaderKey(name), value: t}
+	return nil
+}
+
+// wrap returns d sending the process header for the connection c if it dials
+// via an HTTP proxy, or d itself if not.
+func (h *processHeader) wrap(d proxy.Dialer, c *ConnInfo) proxy.Dialer {
+	switch v := d.(type) {
+	case *httpDialer:
+		return h.dialer(v, c)
+	case *namedDialer:
+		if hd, ok := v.Dialer.(*httpDialer); ok {
+			nd := *v
+			nd.Dialer = h.dialer(hd, c)
+			return &nd
+		}
+	}
+	return d
+}
+
+// dialer returns a copy of d adding the process header for the connection c
+// to its CONNECT request.
+func (h *processHeader) dialer(d *httpDialer, c *ConnInfo) *httpDialer {
+	header := make(http.Header, len(d.header)+1)
+	for k, v := range d.header {
+		header[k] = append([]string(nil), v...)
+	}
+	// Header.Write replaces the newlines in the values, which a process name
+	// may have, with spaces.
+	header.Add(h.name, h.value.expand(c))
+	dialer := *d
+	dialer.header = header
+	return &dialer
+}
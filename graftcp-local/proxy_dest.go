@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// SetProxyDestAction set what to do with the connections to the socks5 or the
+// HTTP proxy, which would go to the proxy through the proxy: "off" to handle
+// them as the others, "warn" to log a warning, or "reject" to reject them.
+func (l *Local) SetProxyDestAction(action string) error {
+	switch action {
+	case "off", "warn", "reject":
+	default:
+		return fmt.Errorf("unknown proxy_dest_action: %s", action)
+	}
+	l.proxyDestAction = action
+	return nil
+}
+
+// proxyDestName returns the upstream name of the proxy the connection c goes
+// to, or "" if it doesn't go to a proxy.
+func (l *Local) proxyDestName(c *ConnInfo) string {
+	if l.proxyDestAction == "" || l.proxyDestAction == "off" {
+		return ""
+	}
+	addrs := map[string][]string{
+		"socks5":     {l.socks5Addr},
+		"http_proxy": {l.httpProxyAddr},
+	}
+	if p, ok := l.socks5Dialer.(*proxyPool); ok {
+		addrs["socks5"] = p.hosts()
+	}
+	if p, ok := l.httpProxyDialer.(*proxyPool); ok {
+		addrs["http_proxy"] = p.hosts()
+	}
+	for name, list := range addrs {
+		for _, addr := range list {
+			if sameHostPort(addr, c.DestIP, c.DestPort) {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// sameHostPort reports whether addr is the IP address ip and port.
+func sameHostPort(addr string, ip net.IP, port uint16) bool {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil || portStr != fmt.Sprint(port) {
+		return false
+	}
+	h := net.ParseIP(host)
+	return h != nil && h.Equal(ip)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+const (
+	// ptrLookupTimeout is the max time of a PTR lookup.
+	ptrLookupTimeout = 5 * time.Second
+	// ptrFailureTTL is how long a failed PTR lookup is cached, e.g. the IP has
+	// no PTR name, so it's tried again sooner than ptr_cache_ttl.
+	ptrFailureTTL = time.Minute
+)
+
+// ptrEntry is the PTR name of an IP, being looked up until done is closed.
+type ptrEntry struct {
+	name    string // "" if the IP has no PTR name or the lookup failed
+	done    chan struct{}
+	expires time.Time
+}
+
+// ptrCache look up the PTR names of the destinations in the background and
+// cache them for ttl, as the lookups may be slow.
+type ptrCache struct {
+	ttl  time.Duration
+	wait time.Duration // max time to wait for a lookup, 0 to never wait
+
+	mu        sync.Mutex
+	entries   map[string]*ptrEntry
+	nextSweep time.Time
+}
+
+// SetPtrLookup look up the PTR names of the destinations for the ptr matcher
+// of the rules and cache them for ttl. A connection waits for the lookup of
+// its destination up to wait, it's routed without the PTR name if the lookup
+// is not done by then, and the later connections to the destination are
+// routed with it once done. If ttl is 0, it's looked up for each connection,
+// which waits for it up to ptrLookupTimeout regardless of wait. No lookup is
+// made if no rule has the ptr matcher, or with strict_proxy, as the local DNS
+// would see the destinations.
+func (l *Local) SetPtrLookup(wait, ttl time.Duration) {
+	l.ptrCache = &ptrCache{ttl: ttl, wait: wait, entries: make(map[string]*ptrEntry)}
+}
+
+// lookupPTR set the PTR name of the destination of c if any rule has the ptr
+// matcher.
+func (l *Local) lookupPTR(c *ConnInfo) {
+	if !l.ptrRules || l.ptrCache == nil || l.strictProxy || c.DestIP == nil {
+		return
+	}
+	var done bool
+	c.PTR, done = l.ptrCache.lookup(c.DestIP)
+	c.ptrPending = !done
+}
+
+// lookup returns the PTR name of ip, and whether the lookup is done. The
+// lookup is started if ip is not cached, and waited for up to pc.wait, or
+// until done if nothing is cached.
+func (pc *ptrCache) lookup(ip net.IP) (name string, done bool) {
+	key := ip.String()
+	now := time.Now()
+	pc.mu.Lock()
+	e, ok := pc.entries[key]
+	if !ok || isClosed(e.done) && now.After(e.expires) {
+		if now.After(pc.nextSweep) {
+			for k, old := range pc.entries {
+				if isClosed(old.done) && now.After(old.expires) {
+					delete(pc.entries, k)
+				}
+			}
+			pc.nextSweep = now.Add(pc.ttl)
+		}
+		e = &ptrEntry{done: make(chan struct{})}
+		pc.entries[key] = e
+		go pc.resolve(key, e)
+	}
+	pc.mu.Unlock()
+
+	wait := pc.wait
+	if pc.ttl == 0 {
+		// not cached for the later connections
+		wait = ptrLookupTimeout
+	}
+	if wait > 0 {
+		t := time.NewTimer(wait)
+		defer t.Stop()
+		select {
+		case <-e.done:
+		case <-t.C:
+		}
+	}
+	if !isClosed(e.done) {
+		return "", false
+	}
+	return e.name, true
+}
+
+// resolve look up the PTR name of ip for e, the first one if it has many.
+func (pc *ptrCache) resolve(ip string, e *ptrEntry) {
+	ctx, cancel := context.WithTimeout(context.Background(), ptrLookupTimeout)
+	defer cancel()
+	names, err := net.DefaultResolver.LookupAddr(ctx, ip)
+	ttl := pc.ttl
+	if err != nil {
+		dlog.Debugf("look up the PTR name of %s err: %s", ip, err.Error())
+		if ttl > ptrFailureTTL {
+			ttl = ptrFailureTTL
+		}
+	} else if len(names) > 0 {
+		e.name = strings.TrimSuffix(strings.ToLower(names[0]), ".")
+	}
+	pc.mu.Lock()
+	e.expires = time.Now().Add(ttl)
+	pc.mu.Unlock()
+	close(e.done)
+}
+
+func isClosed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+// parsePtrPattern parse the pattern of the PTR names like "*.amazonaws.com",
+// the syntax is of path.Match, and it's case-insensitive.
+func parsePtrPattern(s string) (string, error) {
+	pattern := strings.TrimSuffix(strings.ToLower(s), ".")
+	if _, err := path.Match(pattern, ""); err != nil {
+		return "", fmt.Errorf("bad ptr pattern: %s", s)
+	}
+	return pattern, nil
+}
+
+// matchPTR reports whether the PTR name matches any of patterns.
+func matchPTR(name string, patterns []string) bool {
+	if name == "" {
+		return false
+	}
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// lockedRand is a rand.Rand safe for concurrent use.
+type lockedRand struct {
+	sync.Mutex
+	r *rand.Rand
+}
+
+func newLockedRand(seed int64) *lockedRand {
+	return &lockedRand{r: rand.New(rand.NewSource(seed))}
+}
+
+func (r *lockedRand) Intn(n int) int {
+	r.Lock()
+	defer r.Unlock()
+	return r.r.Intn(n)
+}
+
+func (r *lockedRand) Float64() float64 {
+	r.Lock()
+	defer r.Unlock()
+	return r.r.Float64()
+}
+
+// SetRandSeed set the seed of the random source used to select the proxies,
+// the selection is deterministic with the same seed. It's seeded with the
+// current time by default.
+func (l *Local) SetRandSeed(seed int64) {
+	l.rand = newLockedRand(seed)
+}
+
+func init() {
+	// for the trace and span IDs
+	rand.Seed(time.Now().UTC().UnixNano())
+}
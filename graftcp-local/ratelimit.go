@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenBucket limit the rate of bytes, it's safe for concurrent use.
+type tokenBucket struct {
+	sync.Mutex
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int64) *tokenBucket {
+	return &tokenBucket{
+		rate:   float64(rate),
+		burst:  float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// reserve take n tokens from b, returns how long to wait before the n bytes
+// can be passed.
+func (b *tokenBucket) reserve(n int) time.Duration {
+	b.Lock()
+	defer b.Unlock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// take take n tokens from b if they are available within maxWait, returns how
+// long to wait before they are available. Nothing is taken if ok is false.
+func (b *tokenBucket) take(n int, maxWait time.Duration) (wait time.Duration, ok bool) {
+	b.Lock()
+	defer b.Unlock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	left := b.tokens - float64(n)
+	if left < -maxWait.Seconds()*b.rate {
+		return 0, false
+	}
+	b.tokens = left
+	if left >= 0 {
+		return 0, true
+	}
+	return time.Duration(-left / b.rate * float64(time.Second)), true
+}
+
+// pipeReader limit the rate of reading from r by all the buckets, the most
+// restrictive one wins. It's only used if the rate is limited, as it hides the
+// fast path of io.Copy of the connection r.
+type pipeReader struct {
+	r       io.Reader
+	buckets []*tokenBucket
+}
+
+func (pr *pipeReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	if n > 0 {
+		var wait time.Duration
+		for _, b := range pr.buckets {
+			if d := b.reserve(n); d > wait {
+				wait = d
+			}
+		}
+		time.Sleep(wait)
+	}
+	return n, err
+}
+
+// parseRate parse the rate in bytes per second like "512K" or "1M", the
+// suffixes K, M and G are 1024 based.
+func parseRate(s string) (int64, error) {
+	unit := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		unit = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		unit = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		unit = 1 << 30
+	}
+	if unit > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bad rate: %s", s)
+	}
+	return n * unit, nil
+}
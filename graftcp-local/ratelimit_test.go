@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// pipeThroughput returns how long pipe takes to pass size bytes limited by
+// the buckets.
+func pipeThroughput(t *testing.T, size int, buckets []*tokenBucket) time.Duration {
+	src, srcPeer := net.Pipe()
+	dst, dstPeer := net.Pipe()
+	go func() {
+		srcPeer.Write(make([]byte, size))
+		srcPeer.Close()
+	}()
+	received := make(chan int64)
+	go func() {
+		n, _ := io.Copy(ioutil.Discard, dstPeer)
+		received <- n
+	}()
+	c := make(chan int64, 1)
+	start := time.Now()
+	pipe(dst, src, &byteMeter{}, new(int64), buckets, nil, pipeTimeouts{}, 0, &teardown{}, c)
+	elapsed := time.Since(start)
+	if n := <-c; n != int64(size) {
+		t.Fatalf("pipe passed %d bytes, want %d", n, size)
+	}
+	dst.Close()
+	if n := <-received; n != int64(size) {
+		t.Fatalf("received %d bytes, want %d", n, size)
+	}
+	return elapsed
+}
+
+func TestPipeRateLimit(t *testing.T) {
+	const rate, size = 512 << 10, 2 * 512 << 10
+	// the first rate bytes pass at once as the burst
+	want := time.Duration(float64(size-rate) / rate * float64(time.Second))
+	tests := []struct {
+		name    string
+		buckets []*tokenBucket
+	}{
+		{"connection", []*tokenBucket{newTokenBucket(rate)}},
+		{"connection and total", []*tokenBucket{newTokenBucket(rate), newTokenBucket(4 * rate)}},
+		{"total", []*tokenBucket{newTokenBucket(4 * rate), newTokenBucket(rate)}},
+	}
+	for _, tt := range tests {
+		elapsed := pipeThroughput(t, size, tt.buckets)
+		if elapsed < want*9/10 || elapsed > want*3/2 {
+			t.Errorf("%s: passed %d bytes at %d B/s in %s, want about %s", tt.name, size, rate, elapsed, want)
+		}
+	}
+	if elapsed := pipeThroughput(t, size, nil); elapsed > want/4 {
+		t.Errorf("unlimited: passed %d bytes in %s, want much less than %s", size, elapsed, want)
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    int64
+		wantErr bool
+	}{
+		{s: "0", want: 0},
+		{s: "1000", want: 1000},
+		{s: "512K", want: 512 << 10},
+		{s: "1M", want: 1 << 20},
+		{s: "2G", want: 2 << 30},
+		{s: "", wantErr: true},
+		{s: "K", wantErr: true},
+		{s: "-1M", wantErr: true},
+		{s: "1MB", wantErr: true},
+	}
+	for _, tt := range tests {
+		n, err := parseRate(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseRate(%q) err = %v, want err %v", tt.s, err, tt.wantErr)
+			continue
+		}
+		if err == nil && n != tt.want {
+			t.Errorf("parseRate(%q) = %d, want %d", tt.s, n, tt.want)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+// recordEntry is an entry of the record file, written in JSON per line.
+type recordEntry struct {
+	Time   time.Time     `json:"time"`
+	Kind   string        `json:"kind"`             // "addr" or "conn"
+	Source string        `json:"source,omitempty"` // reader of the address info
+	Line   string        `json:"line,omitempty"`   // address info as sent by graftcp
+	Conn   *accessRecord `json:"conn,omitempty"`   // "open" or "close" event of a connection
+}
+
+// sessionRecorder write the address info read and the connection events to
+// a file in order, to reproduce the issues by Replay later.
+type sessionRecorder struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// recorder is the recorder of the session, nothing is recorded if nil.
+var recorder *sessionRecorder
+
+// SetRecordFile record the address info read and the connection events to
+// the file path.
+func SetRecordFile(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	recorder = &sessionRecorder{f: f}
+	return nil
+}
+
+func (sr *sessionRecorder) write(e recordEntry) {
+	if sr == nil {
+		return
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	if _, err := sr.f.Write(append(b, '\n')); err != nil {
+		dlog.Errorf("write the record file err: %s", err.Error())
+	}
+}
+
+// addrInfo record the address info line read from source.
+func (sr *sessionRecorder) addrInfo(source, line string) {
+	if sr == nil {
+		return
+	}
+	sr.write(recordEntry{Time: time.Now(), Kind: "addr", Source: source, Line: line})
+}
+
+// conn record the event of the connection of r.
+func (sr *sessionRecorder) conn(event string, r accessRecord, counters *connCounters, start time.Time) {
+	if sr == nil {
+		return
+	}
+	r = r.fill(event, counters, start)
+	sr.write(recordEntry{Time: r.Time, Kind: "conn", Conn: &r})
+}
+
+// Replay replay the record file path offline: the address info is stored as
+// if read from graftcp, and for each connection opened, its address info is
+// taken by its pid and routed as the live connections without dialing. The
+// results are written to w, and compared with the destinations and the
+// upstreams recorded. The connections go through the same checks and
+// middlewares as the live ones, including the pre-dial hook. The matchers of
+// the rules on the processes, e.g. user and cmdline, only match if the
+// processes recorded are still alive.
+func (l *Local) Replay(path string, w io.Writer) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var addrs, conns, mismatches int
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		var e recordEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return fmt.Errorf("line %d: %s", lineno, err.Error())
+		}
+		switch {
+		case e.Kind == "addr":
+			pid, addr, ok := parseProcessAddrInfo(e.Line)
+			if !ok {
+				fmt.Fprintf(w, "line %d: bad address info: %s\n", lineno, e.Line)
+				continue
+			}
+			StorePidAddr(pid, addr)
+			addrs++
+		case e.Kind == "conn" && e.Conn != nil && e.Conn.Event == "open":
+			conns++
+			if !l.replayConn(w, e) {
+				mismatches++
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "replayed %d address info and %d connections, %d mismatched\n", addrs, conns, mismatches)
+	return nil
+}
+
+// replayConn route the connection opened of e, reports whether the result
+// matches the record.
+func (l *Local) replayConn(w io.Writer, e recordEntry) bool {
+	c := e.Conn
+	prefix := fmt.Sprintf("%s PID: %s, Dest Addr: %s", e.Time.Format(time.RFC3339Nano), c.Pid, c.Dest)
+	destAddr, ok := TakePidAddr(c.Pid)
+	if !ok {
+		fmt.Fprintf(w, "%s: MISMATCH no address info of the pid\n", prefix)
+		return false
+	}
+	if err := checkDestAddr(destAddr, false); err != nil {
+		fmt.Fprintf(w, "%s: MISMATCH bad destination address %q: %s\n", prefix, destAddr, err.Error())
+		return false
+	}
+	info := newConnInfo(c.Pid, c.Src, destAddr)
+	info.Host = c.Host
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	mc := l.newConnContext(conn, info, e.Time)
+	err := l.connHandler()(mc)
+	mode, upstream := mc.Mode, "none"
+	switch {
+	case err != nil:
+		mode, upstream = RejectMode, "reject"
+	case mc.Dialer != nil: // by the pre-dial hook
+		upstream = l.upstreamName(mc.Dialer)
+	default:
+		if mode == AutoSelectMode {
+			mode = l.failoverChain()[0]
+		}
+		if dialer := l.proxySelector(mode); available(dialer) {
+			upstream = l.upstreamName(dialer)
+		}
+	}
+	result := "ok"
+	if info.DestAddr != c.Dest || upstream != c.Upstream {
+		result = "MISMATCH"
+	}
+	fmt.Fprintf(w, "%s: %s dest %s, mode %s, upstream %s, recorded %s\n",
+		prefix, result, info.DestAddr, mode, upstream, c.Upstream)
+	return result == "ok"
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/jedisct1/dlog"
+)
+
+// ListenAddr returns the current listen address of l.
+func (l *Local) ListenAddr() string {
+	l.lnMu.Lock()
+	defer l.lnMu.Unlock()
+	return l.faddrString
+}
+
+// Rebind listen on addr instead of the current listen address. The new
+// listener accepts the connections before the old one is closed, and the
+// connections accepted by the old one are not affected.
+func (l *Local) Rebind(addr string) error {
+	faddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return err
+	}
+	ln, err := l.listen(faddr)
+	if err != nil {
+		return err
+	}
+	l.lnMu.Lock()
+	if l.closing {
+		l.lnMu.Unlock()
+		ln.Close()
+		return errors.New("graftcp-local is stopping")
+	}
+	old, oldAddr := l.ln, l.faddrString
+	l.ln, l.faddr, l.faddrString = ln, faddr, addr
+	l.lnMu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	dlog.Noticef("graftcp-local listening %s instead of %s", addr, oldAddr)
+	return nil
+}
+
+// watchReload reload the config file on SIGHUP. Only the listen address is
+// reloaded for now, and it's not reloaded if given by the flag. The cached
+// rules of the host names are dropped, and the ASN database and the allowlist
+// are reloaded.
+func (app *App) watchReload(l *Local) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		l.ReloadAsnDB()
+		l.ReloadAllowlist()
+		if app.configPath == "" {
+			dlog.Notice("SIGHUP received, but no config file to reload")
+			continue
+		}
+		dlog.Noticef("reload %s", app.configPath)
+		l.hostCache.reset()
+		if err := loadConfigFile(app.configPath); err != nil {
+			continue
+		}
+		cfg := currentConfig()
+		if flagsSet()["listen"] || cfg.Listen == "" || cfg.Listen == l.ListenAddr() {
+			continue
+		}
+		if err := l.Rebind(cfg.Listen); err != nil {
+			dlog.Errorf("listen %s err: %s", cfg.Listen, err.Error())
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net"
+	"strings"
+)
+
+// PidResolver resolve the pid of the process making the connection conn to
+// graftcp-local, and the original destination address of it. It returns
+// errUntraced if the connection is not from a process traced by graftcp.
+//
+// The default resolver finds the process by the socket inodes in /proc and
+// the address info sent by graftcp, a fake one can be set by
+// Local.SetPidResolver to handle the connections without graftcp.
+type PidResolver interface {
+	Resolve(conn net.Conn) (pid, destAddr string, err error)
+}
+
+// procPidResolver is the default PidResolver.
+type procPidResolver struct{}
+
+func (procPidResolver) Resolve(conn net.Conn) (string, string, error) {
+	isTCP6 := strings.Contains(conn.LocalAddr().String(), "[")
+	return getPidByAddr(conn.RemoteAddr().String(), conn.LocalAddr().String(), isTCP6)
+}
+
+// SetPidResolver set the resolver of the pid and the destination address of
+// the connections.
+func (l *Local) SetPidResolver(r PidResolver) {
+	l.resolver = r
+}
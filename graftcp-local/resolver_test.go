@@ -0,0 +1,141 @@
+package main
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeResolver resolve every connection to pid and destAddr, or fail with err.
+type fakeResolver struct {
+	pid, destAddr string
+	err           error
+}
+
+func (r fakeResolver) Resolve(conn net.Conn) (string, string, error) {
+	return r.pid, r.destAddr, r.err
+}
+
+// listenEcho returns the address of a server echoing the connections.
+func listenEcho(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// handleFake handle the connection resolved by r in l, and returns the client
+// side of it and the result of HandleConn.
+func handleFake(l *Local, r PidResolver) (net.Conn, chan error) {
+	l.SetPidResolver(r)
+	client, conn := net.Pipe()
+	done := make(chan error, 1)
+	go func() { done <- l.HandleConn(conn) }()
+	return client, done
+}
+
+func TestHandleConnDirect(t *testing.T) {
+	l := newTestLocal()
+	l.SetSelectMode("direct")
+	client, done := handleFake(l, fakeResolver{pid: "42", destAddr: listenEcho(t)})
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("read %q, %v, want the echo", buf, err)
+	}
+	client.Close()
+	if err := <-done; err != nil {
+		t.Errorf("HandleConn err: %v", err)
+	}
+}
+
+func TestHandleConnUntraced(t *testing.T) {
+	l := newTestLocal()
+	client, done := handleFake(l, fakeResolver{err: errUntraced})
+	defer client.Close()
+	if err := <-done; ConnErrorKind(err) != ErrRejected {
+		t.Errorf("HandleConn err: %v, want %v", err, ErrRejected)
+	}
+}
+
+func TestHandleConnRejectedByRule(t *testing.T) {
+	l := newTestLocal()
+	l.SetSelectMode("direct")
+	r, err := parseRule("reject dest=127.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.SetRules([]*Rule{r})
+	client, done := handleFake(l, fakeResolver{pid: "42", destAddr: listenEcho(t)})
+	defer client.Close()
+	if err := <-done; ConnErrorKind(err) != ErrRejected {
+		t.Errorf("HandleConn err: %v, want %v", err, ErrRejected)
+	}
+}
+
+func TestHandleConnDialFailed(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := ln.Addr().String()
+	ln.Close()
+	l := newTestLocal()
+	l.SetSelectMode("direct")
+	client, done := handleFake(l, fakeResolver{pid: "42", destAddr: closed})
+	defer client.Close()
+	if err := <-done; ConnErrorKind(err) != ErrDialFailed {
+		t.Errorf("HandleConn err: %v, want %v", err, ErrDialFailed)
+	}
+}
+
+// blockingResolver resolve the connections once unblock is closed.
+type blockingResolver struct {
+	fakeResolver
+	resolving chan struct{}
+	unblock   chan struct{}
+}
+
+func (r blockingResolver) Resolve(conn net.Conn) (string, string, error) {
+	r.resolving <- struct{}{}
+	<-r.unblock
+	return r.fakeResolver.Resolve(conn)
+}
+
+func TestHandleConnShed(t *testing.T) {
+	l := newTestLocal()
+	l.SetMaxPending(1)
+	r := blockingResolver{fakeResolver{err: errUntraced}, make(chan struct{}), make(chan struct{})}
+	client, done := handleFake(l, r)
+	defer client.Close()
+	<-r.resolving
+	shedClient, shedDone := handleFake(l, r)
+	defer shedClient.Close()
+	if err := <-shedDone; ConnErrorKind(err) != ErrRejected {
+		t.Errorf("HandleConn beyond max pending err: %v, want %v", err, ErrRejected)
+	}
+	close(r.unblock)
+	<-done
+	if n := atomic.LoadInt64(&l.pending); n != 0 {
+		t.Errorf("%d connections pending after handled, want 0", n)
+	}
+}
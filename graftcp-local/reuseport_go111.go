@@ -0,0 +1,32 @@
+// +build go1.11
+
+package main
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+const soReusePort = 15 // SO_REUSEPORT of Linux
+
+// listenReusePort listen on addr with SO_REUSEPORT.
+func listenReusePort(addr *net.TCPAddr) (*net.TCPListener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var err error
+			cerr := c.Control(func(fd uintptr) {
+				err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+			})
+			if cerr != nil {
+				return cerr
+			}
+			return err
+		},
+	}
+	ln, err := lc.Listen(context.Background(), "tcp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+	return ln.(*net.TCPListener), nil
+}
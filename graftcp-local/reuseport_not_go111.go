@@ -0,0 +1,12 @@
+// +build !go1.11
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+func listenReusePort(addr *net.TCPAddr) (*net.TCPListener, error) {
+	return nil, errors.New("reuseport requires Go 1.11 or later")
+}
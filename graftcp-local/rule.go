@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type portRange struct {
+	min, max uint16
+}
+
+// Rule select the mode for the connections whose destination matches it.
+type Rule struct {
+	mode  modeT
+	nets  []*net.IPNet // match all destination IPs if empty
+	ports []portRange  // match all destination ports if empty
+	uids  []uint32     // match all users if empty
+	asns  []uint32     // ASNs of the destination, match all if empty
+	ptrs  []string     // patterns of the PTR name of the destination, match all if empty
+
+	cmdlines       []string         // substrings of the command line
+	cmdlineRegexps []*regexp.Regexp // match all command lines if both empty
+
+	timeout time.Duration // dial timeout, -1 to use the default
+	retry   int           // dial retry times, -1 to use the default
+
+	uploadRate   int64 // bytes per second, 0 for no limit, -1 to use the default
+	downloadRate int64
+
+	rewriteIP   net.IP // rewrite the destination IP to it if not nil
+	rewritePort uint16 // rewrite the destination port to it if not 0
+
+	tag string // {tag} of the SOCKS5 username template
+
+	dscp int // DSCP of the connection dialed, -1 to use the default
+
+	line string // the rule as in the rule file
+}
+
+// Match reports whether the connection c matches r.
+func (r *Rule) Match(c *ConnInfo) bool {
+	if len(r.nets) > 0 {
+		found := false
+		for _, n := range r.nets {
+			if n.Contains(c.DestIP) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return r.matchExceptDest(c)
+}
+
+// matchesProcess reports whether r matches the process of the connections,
+// by the user or the command line, besides the destination.
+func (r *Rule) matchesProcess() bool {
+	return len(r.uids) > 0 || len(r.cmdlines) > 0 || len(r.cmdlineRegexps) > 0
+}
+
+// matchExceptDest reports whether the connection c matches the matchers of r
+// other than dest.
+func (r *Rule) matchExceptDest(c *ConnInfo) bool {
+	if len(r.ports) > 0 && !portInRanges(c.DestPort, r.ports) {
+		return false
+	}
+	if len(r.asns) > 0 && !containsUint32(r.asns, c.ASN) {
+		return false
+	}
+	if len(r.ptrs) > 0 && !matchPTR(c.PTR, r.ptrs) {
+		return false
+	}
+	if len(r.uids) > 0 {
+		uid, err := c.Uid()
+		if err != nil {
+			return false
+		}
+		found := false
+		for _, u := range r.uids {
+			if uid == u {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(r.cmdlines) > 0 || len(r.cmdlineRegexps) > 0 {
+		cmdline, err := c.Cmdline()
+		if err != nil {
+			return false
+		}
+		if len(r.cmdlines) > 0 && !containsAny(cmdline, r.cmdlines) {
+			return false
+		}
+		if len(r.cmdlineRegexps) > 0 {
+			found := false
+			for _, re := range r.cmdlineRegexps {
+				if re.MatchString(cmdline) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func containsUint32(a []uint32, v uint32) bool {
+	for _, x := range a {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAny(s string, substrs []string) bool {
+	for _, sub := range substrs {
+		if strings.Contains(s, sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRule parse the rule with format:
+//
+//	<mode> [<matcher>=<value>[,<value>...]]... [<option>=<value>]...
+func parseRule(line string) (*Rule, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty rule")
+	}
+	mode, ok := parseSelectMode(fields[0])
+	if !ok {
+		return nil, fmt.Errorf("unknown mode: %s", fields[0])
+	}
+	r := &Rule{mode: mode, timeout: -1, retry: -1, uploadRate: -1, downloadRate: -1, dscp: -1,
+		line: strings.Join(fields, " ")}
+	for _, field := range fields[1:] {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) < 2 || kv[1] == "" {
+			return nil, fmt.Errorf("bad format of field: %s", field)
+		}
+		if err := r.parseField(kv[0], kv[1]); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// parseField parse the matcher or the option key=val of r.
+func (r *Rule) parseField(key, val string) (err error) {
+	switch key {
+	case "timeout":
+		r.timeout, err = time.ParseDuration(val)
+		if err != nil || r.timeout < 0 {
+			return fmt.Errorf("bad timeout: %s", val)
+		}
+		return nil
+	case "retry":
+		r.retry, err = strconv.Atoi(val)
+		if err != nil || r.retry < 0 {
+			return fmt.Errorf("bad retry: %s", val)
+		}
+		return nil
+	case "upload_rate":
+		r.uploadRate, err = parseRate(val)
+		return err
+	case "download_rate":
+		r.downloadRate, err = parseRate(val)
+		return err
+	case "rewrite":
+		return r.parseRewrite(val)
+	case "tag":
+		r.tag = val
+		return nil
+	case "dscp":
+		r.dscp, err = parseDscp(val)
+		return err
+	case "cmdline_regex": // not split by commas
+		re, err := regexp.Compile(val)
+		if err != nil {
+			return fmt.Errorf("bad cmdline_regex: %s", err.Error())
+		}
+		r.cmdlineRegexps = append(r.cmdlineRegexps, re)
+		return nil
+	}
+	for _, v := range strings.Split(val, ",") {
+		switch key {
+		case "dest":
+			n, err := parseIPNet(v)
+			if err != nil {
+				return err
+			}
+			r.nets = append(r.nets, n)
+		case "port":
+			p, err := parsePortOrService(v)
+			if err != nil {
+				return err
+			}
+			r.ports = append(r.ports, p)
+		case "asn":
+			asn, err := parseASN(v)
+			if err != nil {
+				return err
+			}
+			r.asns = append(r.asns, asn)
+		case "ptr":
+			pattern, err := parsePtrPattern(v)
+			if err != nil {
+				return err
+			}
+			r.ptrs = append(r.ptrs, pattern)
+		case "user":
+			uid, err := lookupUid(v)
+			if err != nil {
+				return err
+			}
+			r.uids = append(r.uids, uid)
+		case "cmdline":
+			r.cmdlines = append(r.cmdlines, v)
+		default:
+			return fmt.Errorf("unknown matcher: %s", key)
+		}
+	}
+	return nil
+}
+
+// parseRewrite parse the rewrite of the destination, which is an IP address
+// like "192.0.2.1" or "[2001:db8::1]", a port like ":8443", or both like
+// "192.0.2.1:8443" or "[2001:db8::1]:8443".
+func (r *Rule) parseRewrite(s string) error {
+	if ip := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")); ip != nil {
+		r.rewriteIP = ip
+		return nil
+	}
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return fmt.Errorf("bad rewrite: %s", s)
+	}
+	if host != "" {
+		if r.rewriteIP = net.ParseIP(host); r.rewriteIP == nil {
+			return fmt.Errorf("bad IP address of rewrite: %s", s)
+		}
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || p == 0 {
+		return fmt.Errorf("bad port of rewrite: %s", s)
+	}
+	r.rewritePort = uint16(p)
+	return nil
+}
+
+// rewrites reports whether r rewrites the destination.
+func (r *Rule) rewrites() bool {
+	return r.rewriteIP != nil || r.rewritePort != 0
+}
+
+// rewriteDest returns the destination ip and port rewritten by r and the
+// address joined of them, the parts not rewritten are kept.
+func (r *Rule) rewriteDest(ip net.IP, port uint16) (net.IP, uint16, string) {
+	if r.rewriteIP != nil {
+		ip = r.rewriteIP
+	}
+	if r.rewritePort != 0 {
+		port = r.rewritePort
+	}
+	return ip, port, net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+}
+
+// parseIPNet parse s as a CIDR, or as a single IP address.
+func parseIPNet(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, n, err := net.ParseCIDR(s)
+		return n, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("bad IP address: %s", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// parsePortRange parse s as a single port, or a range like "5900-5999".
+func parsePortRange(s string) (p portRange, err error) {
+	items := strings.SplitN(s, "-", 2)
+	min, err := strconv.ParseUint(items[0], 10, 16)
+	if err != nil || min == 0 {
+		return p, fmt.Errorf("bad port: %s", s)
+	}
+	max := min
+	if len(items) == 2 {
+		max, err = strconv.ParseUint(items[1], 10, 16)
+		if err != nil || max < min {
+			return p, fmt.Errorf("bad port range: %s", s)
+		}
+	}
+	return portRange{min: uint16(min), max: uint16(max)}, nil
+}
+
+// parsePortOrService parse s as a single port, a port range, or a TCP service
+// name in /etc/services like "https", which is resolved to its port.
+func parsePortOrService(s string) (portRange, error) {
+	p, err := parsePortRange(s)
+	if err == nil || s == "" || s[0] >= '0' && s[0] <= '9' {
+		return p, err
+	}
+	port, e := net.LookupPort("tcp", s)
+	if e != nil || port <= 0 {
+		return p, fmt.Errorf("unknown service: %s", s)
+	}
+	return portRange{min: uint16(port), max: uint16(port)}, nil
+}
+
+// lookupUid returns the user ID of the user name or the numeric uid s.
+func lookupUid(s string) (uint32, error) {
+	if uid, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return uint32(uid), nil
+	}
+	u, err := user.Lookup(s)
+	if err != nil {
+		return 0, err
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("bad uid of user %s: %s", s, u.Uid)
+	}
+	return uint32(uid), nil
+}
+
+// parsePortRanges parse the comma separated ports or port ranges.
+func parsePortRanges(s string) ([]portRange, error) {
+	var ranges []portRange
+	for _, item := range strings.Split(s, ",") {
+		p, err := parsePortRange(strings.TrimSpace(item))
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, p)
+	}
+	return ranges, nil
+}
+
+func portInRanges(port uint16, ranges []portRange) bool {
+	for _, p := range ranges {
+		if port >= p.min && port <= p.max {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadRuleFile load the rules from path, one rule per line, the empty lines
+// and the lines starting with '#' are ignored.
+func LoadRuleFile(path string) ([]*Rule, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var rules []*Rule
+	scanner := bufio.NewScanner(file)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := parseRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, lineno, err.Error())
+		}
+		rules = append(rules, r)
+	}
+	return rules, scanner.Err()
+}
+
+// splitDestAddr split the destination address with format "ip:port".
+func splitDestAddr(addr string) (ip net.IP, port uint16, err error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, 0, err
+	}
+	ip = net.ParseIP(host)
+	if ip == nil {
+		return nil, 0, fmt.Errorf("bad IP address: %s", host)
+	}
+	p, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, 0, fmt.Errorf("bad port: %s", portStr)
+	}
+	return ip, uint16(p), nil
+}
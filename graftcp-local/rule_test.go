@@ -0,0 +1,87 @@
+package main
+
+import "testing"
+
+func TestParsePortOrService(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    portRange
+		wantErr bool
+	}{
+		{s: "80", want: portRange{min: 80, max: 80}},
+		{s: "8000-9000", want: portRange{min: 8000, max: 9000}},
+		{s: "https", want: portRange{min: 443, max: 443}},
+		{s: "http", want: portRange{min: 80, max: 80}},
+		{s: "", wantErr: true},
+		{s: "0", wantErr: true},
+		{s: "65536", wantErr: true},
+		{s: "9000-8000", wantErr: true},
+		{s: "80x", wantErr: true},
+		{s: "no-such-service", wantErr: true},
+	}
+	for _, tt := range tests {
+		p, err := parsePortOrService(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parsePortOrService(%q) err = %v, want err %v", tt.s, err, tt.wantErr)
+			continue
+		}
+		if err == nil && p != tt.want {
+			t.Errorf("parsePortOrService(%q) = %v, want %v", tt.s, p, tt.want)
+		}
+	}
+}
+
+func TestParseRulePorts(t *testing.T) {
+	for _, line := range []string{"direct port=80,", "direct port=,443", "direct port=80,,443"} {
+		if _, err := parseRule(line); err == nil {
+			t.Errorf("parseRule(%q) err = nil, want bad port", line)
+		}
+	}
+	r, err := parseRule("direct port=https,22,8000-8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []portRange{{443, 443}, {22, 22}, {8000, 8080}}
+	if len(r.ports) != len(want) {
+		t.Fatalf("ports = %v, want %v", r.ports, want)
+	}
+	for i := range want {
+		if r.ports[i] != want[i] {
+			t.Errorf("ports[%d] = %v, want %v", i, r.ports[i], want[i])
+		}
+	}
+}
+
+func TestRuleRewrite(t *testing.T) {
+	tests := []struct {
+		rewrite string
+		dest    string
+		want    string
+	}{
+		{rewrite: "192.0.2.1", dest: "10.0.0.1:443", want: "192.0.2.1:443"},
+		{rewrite: ":8443", dest: "10.0.0.1:443", want: "10.0.0.1:8443"},
+		{rewrite: "192.0.2.1:8443", dest: "10.0.0.1:443", want: "192.0.2.1:8443"},
+		{rewrite: "2001:db8::1", dest: "10.0.0.1:443", want: "[2001:db8::1]:443"},
+		{rewrite: "[2001:db8::1]", dest: "[2001:db8::2]:443", want: "[2001:db8::1]:443"},
+		{rewrite: ":8443", dest: "[2001:db8::2]:443", want: "[2001:db8::2]:8443"},
+		{rewrite: "[2001:db8::1]:8443", dest: "[2001:db8::2]:443", want: "[2001:db8::1]:8443"},
+		{rewrite: "192.0.2.1:8443", dest: "[2001:db8::2]:443", want: "192.0.2.1:8443"},
+	}
+	for _, tt := range tests {
+		r, err := parseRule("direct rewrite=" + tt.rewrite)
+		if err != nil {
+			t.Errorf("parseRule(rewrite=%s) err: %s", tt.rewrite, err)
+			continue
+		}
+		c := newConnInfo("1", "", tt.dest)
+		if _, _, got := r.rewriteDest(c.DestIP, c.DestPort); got != tt.want {
+			t.Errorf("rewrite=%s of %s = %s, want %s", tt.rewrite, tt.dest, got, tt.want)
+		}
+	}
+	for _, s := range []string{"", "example.com", ":0", ":65536", "192.0.2.1:", "2001:db8::1:8443x",
+		"[2001:db8::1]:", "[example.com]:80"} {
+		if _, err := parseRule("direct rewrite=" + s); err == nil {
+			t.Errorf("parseRule(rewrite=%s) err = nil, want bad rewrite", s)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net"
+)
+
+// ruleTrie is a binary radix trie of the destination CIDRs of the rules, to
+// find the rules whose destination contains an IP address in O(prefix length)
+// regardless of the number of the rules.
+type ruleTrie struct {
+	v4, v6 *trieNode
+	any    []int // indices of the rules matching all destination IPs
+}
+
+type trieNode struct {
+	child [2]*trieNode
+	rules []int // indices of the rules with the prefix ending here
+	// indices of the rules matching the prefix ending here in ascending order,
+	// i.e. rules and those of the ancestors and of all destination IPs, nil
+	// if no prefix ends here
+	matches []int
+}
+
+func newRuleTrie(rules []*Rule) *ruleTrie {
+	t := &ruleTrie{v4: &trieNode{}, v6: &trieNode{}}
+	for i, r := range rules {
+		if len(r.nets) == 0 {
+			t.any = append(t.any, i)
+			continue
+		}
+		for _, n := range r.nets {
+			t.insert(n, i)
+		}
+	}
+	t.v4.index(t.any)
+	t.v6.index(t.any)
+	return t
+}
+
+// insert add the rule i of the CIDR n. The IPv4-mapped IPv6 CIDRs like
+// "::ffff:10.0.0.0/104" are the IPv4 ones, as net.IPNet.Contains takes them.
+func (t *ruleTrie) insert(n *net.IPNet, i int) {
+	node, ip := t.v6, n.IP.To16()
+	ones, _ := n.Mask.Size()
+	if ip4 := n.IP.To4(); ip4 != nil {
+		if len(n.Mask) == net.IPv6len {
+			if ones -= 8 * (net.IPv6len - net.IPv4len); ones < 0 {
+				ones = 0
+			}
+		}
+		node, ip = t.v4, ip4
+	}
+	for b := 0; b < ones; b++ {
+		bit := ip[b/8] >> uint(7-b%8) & 1
+		if node.child[bit] == nil {
+			node.child[bit] = &trieNode{}
+		}
+		node = node.child[bit]
+	}
+	// a rule may have overlapping CIDRs
+	if k := len(node.rules); k == 0 || node.rules[k-1] != i {
+		node.rules = append(node.rules, i)
+	}
+}
+
+// index set the matches of the nodes of the subtree of n, inherited are the
+// matches of the nearest ancestor.
+func (n *trieNode) index(inherited []int) {
+	if n == nil {
+		return
+	}
+	if len(n.rules) > 0 {
+		n.matches = mergeRules(inherited, n.rules)
+		inherited = n.matches
+	}
+	n.child[0].index(inherited)
+	n.child[1].index(inherited)
+}
+
+// mergeRules returns the union of the ascending indices a and b in ascending
+// order.
+func mergeRules(a, b []int) []int {
+	m := make([]int, 0, len(a)+len(b))
+	for len(a) > 0 || len(b) > 0 {
+		switch {
+		case len(b) == 0 || len(a) > 0 && a[0] < b[0]:
+			m, a = append(m, a[0]), a[1:]
+		case len(a) == 0 || b[0] < a[0]:
+			m, b = append(m, b[0]), b[1:]
+		default:
+			m, a, b = append(m, a[0]), a[1:], b[1:]
+		}
+	}
+	return m
+}
+
+// candidates returns the indices of the rules whose destination contains ip,
+// in ascending order. It must not be modified.
+func (t *ruleTrie) candidates(ip net.IP) []int {
+	node, bits := t.v6, ip.To16()
+	if ip4 := ip.To4(); ip4 != nil {
+		node, bits = t.v4, ip4
+	} else if bits == nil {
+		return t.any
+	}
+	c := t.any
+	for b := 0; node != nil; b++ {
+		if node.matches != nil {
+			c = node.matches
+		}
+		if b == len(bits)*8 {
+			break
+		}
+		node = node.child[bits[b/8]>>uint(7-b%8)&1]
+	}
+	return c
+}
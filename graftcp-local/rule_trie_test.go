@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+// linearCandidates returns the indices of the rules whose destination
+// contains ip by matching them one by one.
+func linearCandidates(rules []*Rule, ip net.IP) []int {
+	var c []int
+	for i, r := range rules {
+		if len(r.nets) == 0 {
+			c = append(c, i)
+			continue
+		}
+		for _, n := range r.nets {
+			if n.Contains(ip) {
+				c = append(c, i)
+				break
+			}
+		}
+	}
+	return c
+}
+
+func TestRuleTrieCandidates(t *testing.T) {
+	var rules []*Rule
+	for _, line := range []string{
+		"direct dest=10.0.0.0/8",
+		"only_socks5 dest=::ffff:10.1.0.0/112",
+		"reject port=25",
+		"direct dest=10.1.2.3,192.168.0.0/16",
+		"only_http_proxy dest=0.0.0.0/0",
+		"direct dest=2001:db8::/32",
+		"reject dest=::/0",
+		"direct dest=10.0.0.0/8,10.1.0.0/16",
+	} {
+		r, err := parseRule(line)
+		if err != nil {
+			t.Fatalf("parseRule(%q) err: %s", line, err)
+		}
+		rules = append(rules, r)
+	}
+	trie := newRuleTrie(rules)
+	for _, s := range []string{"10.1.2.3", "10.1.9.9", "10.2.0.1", "192.168.1.1", "8.8.8.8",
+		"::ffff:10.1.2.3", "2001:db8::1", "2001:db9::1", "::1"} {
+		ip := net.ParseIP(s)
+		got, want := trie.candidates(ip), linearCandidates(rules, ip)
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("candidates(%s) = %v, want %v", s, got, want)
+		}
+	}
+	if got := trie.candidates(nil); fmt.Sprint(got) != "[2]" {
+		t.Errorf("candidates(nil) = %v, want [2]", got)
+	}
+}
+
+// newRules10k returns 10k rules of the /24 CIDRs in 10.0.0.0/8.
+func newRules10k(b *testing.B) []*Rule {
+	var rules []*Rule
+	for i := 0; i < 10000; i++ {
+		r, err := parseRule(fmt.Sprintf("direct dest=10.%d.%d.0/24", i/256, i%256))
+		if err != nil {
+			b.Fatal(err)
+		}
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+func BenchmarkMatchRule10k(b *testing.B) {
+	l := &Local{}
+	l.SetRules(newRules10k(b))
+	c := newConnInfo("1", "", "10.39.15.1:443") // the last rule
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if l.matchRule(c) == nil {
+			b.Fatal("no rule matched")
+		}
+	}
+}
+
+func BenchmarkMatchRule10kLinear(b *testing.B) {
+	rules := newRules10k(b)
+	c := newConnInfo("1", "", "10.39.15.1:443")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var matched *Rule
+		for _, r := range rules {
+			if r.Match(c) {
+				matched = r
+				break
+			}
+		}
+		if matched == nil {
+			b.Fatal("no rule matched")
+		}
+	}
+}
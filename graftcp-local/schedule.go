@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// scheduleWindow is a daily time window using a mode, in minutes of the day.
+type scheduleWindow struct {
+	start, end int
+	mode       modeT
+}
+
+// contains reports whether the minute of the day m is in w, w crosses
+// midnight if end is before start, and is the whole day if end equals start.
+func (w scheduleWindow) contains(m int) bool {
+	switch {
+	case w.start < w.end:
+		return w.start <= m && m < w.end
+	case w.start > w.end:
+		return m >= w.start || m < w.end
+	}
+	return true
+}
+
+// SetSchedule set the modes by the time of the day, in format like
+// "22:00-07:00=only_http_proxy,09:00-18:00=only_socks5", the first window
+// containing the current time in the location named tz wins, and the select
+// mode is used out of the windows. tz is the local time zone if empty.
+func (l *Local) SetSchedule(schedule, tz string) error {
+	loc := time.Local
+	if tz != "" {
+		var err error
+		if loc, err = time.LoadLocation(tz); err != nil {
+			return err
+		}
+	}
+	var windows []scheduleWindow
+	for _, item := range strings.Split(schedule, ",") {
+		kv := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(kv) < 2 {
+			return fmt.Errorf("bad schedule: %s", item)
+		}
+		mode, ok := parseSelectMode(kv[1])
+		if !ok {
+			return fmt.Errorf("unknown mode in schedule: %s", kv[1])
+		}
+		times := strings.SplitN(kv[0], "-", 2)
+		if len(times) < 2 {
+			return fmt.Errorf("bad schedule window: %s", kv[0])
+		}
+		start, err := parseClock(times[0])
+		if err != nil {
+			return err
+		}
+		end, err := parseClock(times[1])
+		if err != nil {
+			return err
+		}
+		windows = append(windows, scheduleWindow{start: start, end: end, mode: mode})
+	}
+	l.schedule, l.scheduleLoc = windows, loc
+	return nil
+}
+
+// parseClock parse the time of the day like "07:30", returns the minutes.
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("bad time of the day: %s", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// scheduledMode returns the mode at t by the schedule.
+func (l *Local) scheduledMode(t time.Time) modeT {
+	if len(l.schedule) == 0 {
+		return l.selectMode
+	}
+	t = t.In(l.scheduleLoc)
+	m := t.Hour()*60 + t.Minute()
+	for _, w := range l.schedule {
+		if w.contains(m) {
+			return w.mode
+		}
+	}
+	return l.selectMode
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+// connsSetupTimeout count the connections aborted as their setup timed out by
+// the phase in progress.
+var connsSetupTimeout = expvar.NewMap("conns_setup_timeout")
+
+// setupTimeoutError is the error of a connection whose setup timed out.
+type setupTimeoutError struct {
+	phase   string
+	timeout time.Duration
+}
+
+func (e *setupTimeoutError) Error() string {
+	return fmt.Sprintf("setup timeout after %v in %s", e.timeout, e.phase)
+}
+
+func (e *setupTimeoutError) Timeout() bool   { return true }
+func (e *setupTimeoutError) Temporary() bool { return true }
+
+// connSetup bound the setup of a connection, from accepted until the data
+// flows, by the deadline of ctx. The inbound connection is closed when the
+// deadline expires unless the setup is finished, and the phase in progress is
+// reported.
+type connSetup struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	conn    net.Conn
+	timeout time.Duration
+
+	mu       sync.Mutex
+	phase    string
+	finished bool
+	aborted  bool // if the inbound connection is closed by the deadline
+}
+
+// newConnSetup returns the setup of conn bound by l.SetupTimeout, the
+// setup is unbound if it's 0.
+func (l *Local) newConnSetup(conn net.Conn) *connSetup {
+	if l.SetupTimeout <= 0 {
+		return &connSetup{ctx: context.Background(), cancel: func() {}}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), l.SetupTimeout)
+	s := &connSetup{ctx: ctx, cancel: cancel, conn: conn, timeout: l.SetupTimeout}
+	go func() {
+		<-ctx.Done()
+		s.mu.Lock()
+		s.expire()
+		s.mu.Unlock()
+	}()
+	return s
+}
+
+// expire close the inbound connection if the deadline expired before the
+// setup is finished, s.mu must be held.
+func (s *connSetup) expire() {
+	if s.finished || s.aborted || s.ctx.Err() != context.DeadlineExceeded {
+		return
+	}
+	s.aborted = true
+	s.conn.Close()
+}
+
+// enter mark the phase in progress.
+func (s *connSetup) enter(phase string) {
+	s.mu.Lock()
+	s.phase = phase
+	s.mu.Unlock()
+}
+
+// err returns the setupTimeoutError if the connection is aborted by the
+// deadline, otherwise nil.
+func (s *connSetup) err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.aborted {
+		return nil
+	}
+	return &setupTimeoutError{phase: s.phase, timeout: s.timeout}
+}
+
+// finish finish the setup, so the connection isn't closed by the deadline
+// since, returns the setupTimeoutError if it's already aborted.
+func (s *connSetup) finish() error {
+	s.mu.Lock()
+	s.expire()
+	if !s.aborted {
+		s.finished = true
+	}
+	s.mu.Unlock()
+	s.cancel()
+	return s.err()
+}
+
+// abort log and count the connection aborted with the setupTimeoutError
+// err, what describes the connection, returns err.
+func (s *connSetup) abort(what string, err error) error {
+	if e, ok := err.(*setupTimeoutError); ok {
+		connsSetupTimeout.Add(e.phase, 1)
+	}
+	dlog.Warnf("abort %s: %s", what, err.Error())
+	return connError(ErrSetupTimeout, "abort "+what, err)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strings"
+
+	"github.com/jedisct1/dlog"
+)
+
+// SocketSource read the address info from the connections accepted on a TCP
+// or Unix socket, each connection may send many lines of the address info.
+type SocketSource struct {
+	network string
+	addr    string
+	ln      net.Listener
+}
+
+// NewSocketSource returns a SocketSource listening on addr, addr is a TCP
+// address like "127.0.0.1:2235", or a Unix socket path prefixed with "unix:".
+func NewSocketSource(addr string) *SocketSource {
+	if strings.HasPrefix(addr, "unix:") {
+		return &SocketSource{network: "unix", addr: strings.TrimPrefix(addr, "unix:")}
+	}
+	return &SocketSource{network: "tcp", addr: addr}
+}
+
+func (s *SocketSource) Name() string {
+	return s.network + ":" + s.addr
+}
+
+// Listen start listening on the socket.
+func (s *SocketSource) Listen() (err error) {
+	if s.network == "unix" {
+		os.Remove(s.addr)
+	}
+	s.ln, err = net.Listen(s.network, s.addr)
+	if err != nil {
+		return err
+	}
+	if s.network == "unix" {
+		os.Chmod(s.addr, 0666)
+	}
+	return nil
+}
+
+// Run accept the connections and read the address info from them.
+func (s *SocketSource) Run(m *readerMonitor) {
+	if s.ln == nil {
+		if err := s.Listen(); err != nil {
+			dlog.Errorf("net.Listen(%s, %s) err: %s", s.network, s.addr, err.Error())
+			m.setError(err.Error())
+			return
+		}
+	}
+	defer func() {
+		s.ln.Close()
+		s.ln = nil
+	}()
+	dlog.Infof("address info source listening %s...", s.Name())
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			dlog.Errorf("accept err: %s", err.Error())
+			m.setError(err.Error())
+			return
+		}
+		go func() {
+			readProcessAddrInfo(conn, m)
+			conn.Close()
+		}()
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import "net"
+
+// tcpConnOf returns the TCP connection under conn, or nil if it's not a TCP
+// connection, e.g. a Unix socket.
+func tcpConnOf(conn net.Conn) *net.TCPConn {
+	switch c := conn.(type) {
+	case *net.TCPConn:
+		return c
+	case *socks5Conn:
+		return tcpConnOf(c.Conn)
+	case *httpConn:
+		return tcpConnOf(c.Conn)
+	case *flateConn:
+		return tcpConnOf(c.Conn)
+	}
+	return nil
+}
+
+// closeWrite shut down the writing side of conn if it's a TCP connection, so
+// the peer reads EOF.
+func closeWrite(conn net.Conn) {
+	if tc := tcpConnOf(conn); tc != nil {
+		tc.CloseWrite()
+	}
+}
+
+// setNoDelay set TCP_NODELAY of conn, Go enables it for all the TCP
+// connections by default.
+func setNoDelay(conn net.Conn, noDelay bool) {
+	if tc := tcpConnOf(conn); tc != nil {
+		tc.SetNoDelay(noDelay)
+	}
+}
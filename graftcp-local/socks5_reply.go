@@ -0,0 +1,80 @@
+package main
+
+import (
+	"expvar"
+	"strings"
+)
+
+// socks5Replies count the failure replies of the SOCKS5 proxies to the
+// CONNECT requests by reason.
+var socks5Replies = expvar.NewMap("socks5_replies")
+
+// socks5ReplyReasons are the reasons of the reply codes of RFC 1928, as in the
+// errors of the SOCKS5 dialer of x/net.
+var socks5ReplyReasons = []string{
+	"",
+	"general failure",
+	"connection forbidden",
+	"network unreachable",
+	"host unreachable",
+	"connection refused",
+	"TTL expired",
+	"command not supported",
+	"address type not supported",
+}
+
+// socks5ReplyError is the error of a failure reply of the SOCKS5 proxy to the
+// CONNECT request, the proxy reached but failed to connect the destination.
+type socks5ReplyError struct {
+	code byte // 0 if unknown
+	err  error
+}
+
+func (e *socks5ReplyError) Error() string { return e.err.Error() }
+
+// Timeout reports whether the proxy timed out connecting the destination,
+// so the front-ends reply the timeout.
+func (e *socks5ReplyError) Timeout() bool   { return e.code == 6 }
+func (e *socks5ReplyError) Temporary() bool { return e.retryable() }
+
+// retryable reports whether dialing the destination again may succeed, it
+// can't if the destination or the proxy refused it.
+func (e *socks5ReplyError) retryable() bool {
+	switch e.code {
+	case 2, 5, 7, 8:
+		return false
+	}
+	return true
+}
+
+func (e *socks5ReplyError) reason() string {
+	if int(e.code) < len(socks5ReplyReasons) && e.code != 0 {
+		return socks5ReplyReasons[e.code]
+	}
+	return "unknown error"
+}
+
+// parseSocks5Reply returns the socks5ReplyError of err if it's a failure
+// reply of a SOCKS5 proxy, or nil if not.
+func parseSocks5Reply(err error) *socks5ReplyError {
+	if err == nil {
+		return nil
+	}
+	if e, ok := err.(*socks5ReplyError); ok {
+		return e
+	}
+	const sep = " failed to connect: "
+	msg := err.Error()
+	i := strings.LastIndex(msg, sep)
+	if !strings.HasPrefix(msg, "proxy: SOCKS5 proxy at ") || i < 0 {
+		return nil
+	}
+	e := &socks5ReplyError{err: err}
+	reason := msg[i+len(sep):]
+	for code, r := range socks5ReplyReasons {
+		if code > 0 && r == reason {
+			e.code = byte(code)
+		}
+	}
+	return e
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// socks5Conn is a connection to the SOCKS5 front-end.
+type socks5Conn struct {
+	net.Conn
+	host     string // host name requested, empty if an IP address
+	secret   string // password required if not empty
+	passHost bool   // pass the host name requested to the proxies unresolved
+	replied  bool
+}
+
+// ServeSocks5 serve a SOCKS5 front-end on addr for the apps not traced by
+// graftcp, only the CONNECT command is supported, without authentication, or
+// with the username/password authentication if the inbound secret is set.
+func (l *Local) ServeSocks5(addr string) {
+	l.serveFrontend("SOCKS5", addr, func(conn net.Conn) frontendConn {
+		return &socks5Conn{Conn: conn, secret: l.inboundSecret, passHost: l.strictProxy}
+	})
+}
+
+// handshake read the SOCKS5 greeting and the CONNECT request.
+func (sc *socks5Conn) handshake(ctx context.Context) (string, error) {
+	buf := make([]byte, 256)
+	if _, err := io.ReadFull(sc, buf[:2]); err != nil {
+		return "", err
+	}
+	if buf[0] != 5 {
+		return "", fmt.Errorf("bad SOCKS version: %d", buf[0])
+	}
+	methods := buf[:buf[1]]
+	if _, err := io.ReadFull(sc, methods); err != nil {
+		return "", err
+	}
+	method := byte(0) // no authentication
+	if sc.secret != "" {
+		method = 2 // username/password
+	}
+	found := false
+	for _, m := range methods {
+		if m == method {
+			found = true
+		}
+	}
+	if !found {
+		sc.replied = true
+		sc.Write([]byte{5, 0xff})
+		if sc.secret != "" {
+			return "", errBadSecret
+		}
+		return "", errors.New("no acceptable SOCKS5 auth method")
+	}
+	if _, err := sc.Write([]byte{5, method}); err != nil {
+		return "", err
+	}
+	if sc.secret != "" {
+		if err := sc.authenticate(buf); err != nil {
+			return "", err
+		}
+	}
+	if _, err := io.ReadFull(sc, buf[:4]); err != nil {
+		return "", err
+	}
+	if buf[1] != 1 {
+		sc.reply(7) // command not supported
+		return "", fmt.Errorf("unsupported SOCKS5 command: %d", buf[1])
+	}
+	var host string
+	switch buf[3] {
+	case 1, 4:
+		ip := make(net.IP, net.IPv4len)
+		if buf[3] == 4 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(sc, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case 3:
+		if _, err := io.ReadFull(sc, buf[:1]); err != nil {
+			return "", err
+		}
+		name := buf[1 : 1+buf[0]]
+		if _, err := io.ReadFull(sc, name); err != nil {
+			return "", err
+		}
+		var err error
+		if net.ParseIP(string(name)) == nil {
+			sc.host = string(name)
+		}
+		if host, err = resolveHost(ctx, string(name), sc.passHost); err != nil {
+			sc.reply(4) // host unreachable
+			return "", err
+		}
+	default:
+		sc.reply(8) // address type not supported
+		return "", fmt.Errorf("unsupported SOCKS5 address type: %d", buf[3])
+	}
+	if _, err := io.ReadFull(sc, buf[:2]); err != nil {
+		return "", err
+	}
+	port := int(buf[0])<<8 | int(buf[1])
+	return net.JoinHostPort(host, strconv.Itoa(port)), nil
+}
+
+// authenticate read the username/password request of RFC 1929, the password
+// must be the secret, and the username is ignored.
+func (sc *socks5Conn) authenticate(buf []byte) error {
+	if _, err := io.ReadFull(sc, buf[:2]); err != nil {
+		return err
+	}
+	ulen := int(buf[1])
+	if _, err := io.ReadFull(sc, buf[:ulen+1]); err != nil { // the username and the password length
+		return err
+	}
+	password := buf[:buf[ulen]]
+	if _, err := io.ReadFull(sc, password); err != nil {
+		return err
+	}
+	if !secretEqual(string(password), sc.secret) {
+		sc.replied = true
+		sc.Write([]byte{1, 1})
+		return errBadSecret
+	}
+	_, err := sc.Write([]byte{1, 0})
+	return err
+}
+
+func (sc *socks5Conn) reply(rep byte) {
+	if sc.replied {
+		return
+	}
+	sc.replied = true
+	sc.Write([]byte{5, rep, 0, 1, 0, 0, 0, 0, 0, 0})
+}
+
+func (sc *socks5Conn) replyDial(err error) {
+	if err == nil {
+		sc.reply(0)
+		return
+	}
+	switch dialErrorReason(err) {
+	case "rejected":
+		sc.reply(2) // connection not allowed by ruleset
+	case "network unreachable":
+		sc.reply(3)
+	case "host unreachable":
+		sc.reply(4)
+	case "connection refused":
+		sc.reply(5)
+	case "timeout":
+		sc.reply(6) // TTL expired
+	default:
+		sc.reply(1) // general failure
+	}
+}
+
+func (sc *socks5Conn) requestedHost() string {
+	return sc.host
+}
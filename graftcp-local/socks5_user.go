@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/proxy"
+)
+
+// socks5UserVars are the variables of the SOCKS5 username template.
+var socks5UserVars = map[string]func(c *ConnInfo) string{
+	"pid": func(c *ConnInfo) string { return c.Pid },
+	"comm": func(c *ConnInfo) string {
+		comm, _ := procComm(c.Pid)
+		return comm
+	},
+	"uid": func(c *ConnInfo) string {
+		uid, err := c.Uid()
+		if err != nil {
+			return ""
+		}
+		return strconv.FormatUint(uint64(uid), 10)
+	},
+	"dest_ip":   func(c *ConnInfo) string { return c.DestIP.String() },
+	"dest_port": func(c *ConnInfo) string { return strconv.Itoa(int(c.DestPort)) },
+	"host":      func(c *ConnInfo) string { return c.Host },
+	"tag":       func(c *ConnInfo) string { return c.Tag },
+	"session":   func(c *ConnInfo) string { return fmt.Sprintf("%08x", rand.Uint32()) },
+}
+
+// userTemplate is a parsed SOCKS5 username template, the literal texts and
+// the variables alternately, starting with a literal text.
+type userTemplate []string
+
+// parseUserTemplate parse the template with the variables like "{pid}".
+func parseUserTemplate(s string) (userTemplate, error) {
+	var t userTemplate
+	for {
+		i := strings.IndexByte(s, '{')
+		if i < 0 {
+			return append(t, s), nil
+		}
+		j := strings.IndexByte(s[i:], '}')
+		if j < 0 {
+			return nil, fmt.Errorf("unclosed variable in the template: %s", s[i:])
+		}
+		name := s[i+1 : i+j]
+		if _, ok := socks5UserVars[name]; !ok {
+			return nil, fmt.Errorf("unknown variable in the template: {%s}", name)
+		}
+		t = append(t, s[:i], name)
+		s = s[i+j+1:]
+	}
+}
+
+// expand returns the username of t for the connection c.
+func (t userTemplate) expand(c *ConnInfo) string {
+	user := ""
+	for i, s := range t {
+		if i%2 == 0 {
+			user += s
+		} else {
+			user += socks5UserVars[s](c)
+		}
+	}
+	return user
+}
+
+// SetSocks5UserTemplate set the template of the SOCKS5 username evaluated
+// for each connection, e.g. "user-region-{tag}-session-{session}", which
+// is used with the socks5_password to dial via the socks5 proxy. It's not
+// applied to the proxies from the proxy list, which have their own users.
+func (l *Local) SetSocks5UserTemplate(tmpl string) error {
+	t, err := parseUserTemplate(tmpl)
+	if err != nil {
+		return err
+	}
+	l.socks5UserTemplate = t
+	return nil
+}
+
+// socks5UserDialer returns the dialer to dial via the socks5 proxy with the
+// username of the template for the connection c.
+func (l *Local) socks5UserDialer(c *ConnInfo) proxy.Dialer {
+	auth := &proxy.Auth{User: l.socks5UserTemplate.expand(c), Password: l.socks5Password}
+	d, err := proxy.SOCKS5("tcp", l.socks5Addr, auth, l.forwards["socks5"])
+	if err != nil {
+		return l.socks5Dialer
+	}
+	return d
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/jedisct1/dlog"
+)
+
+// watchStatsDump log a snapshot of the stats on SIGUSR1, for a quick look
+// without the control server.
+func (l *Local) watchStatsDump() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1)
+	for range c {
+		for _, line := range l.statsSnapshot() {
+			dlog.Noticef("stats: %s", line)
+		}
+	}
+}
+
+// statsSnapshot returns the lines of the current stats, only the counters
+// are read, atomically or under the locks of the expvar maps.
+func (l *Local) statsSnapshot() []string {
+	var conns, active int64
+	upstreams := l.UpstreamStats()
+	lines := []string{""}
+	for _, name := range upstreamNames {
+		s := upstreams[name]
+		conns += s.Conns
+		active += s.Active
+		if s.Conns > 0 {
+			lines = append(lines, fmt.Sprintf("upstream %s: %d conns, %d active, %d bytes sent, %d bytes received",
+				name, s.Conns, s.Active, s.Sent, s.Received))
+		}
+	}
+	lines[0] = fmt.Sprintf("%d conns, %d active, %d pending, %d bytes sent, %d bytes received, %d address info stored",
+		conns, active, atomic.LoadInt64(&l.pending), atomic.LoadInt64(&uploadMeter.total),
+		atomic.LoadInt64(&downloadMeter.total), atomic.LoadInt64(&pidAddrSize))
+	if s := formatCounts(connsByMode); s != "" {
+		lines = append(lines, "modes: "+s)
+	}
+	if s := formatCounts(connsRejected); s != "" {
+		lines = append(lines, "rejected: "+s)
+	}
+	if s := formatCounts(connsFailed); s != "" {
+		lines = append(lines, "failed: "+s)
+	}
+	return lines
+}
+
+// formatCounts returns the counters of m like "a 1, b 2" sorted by key.
+func formatCounts(m *expvar.Map) string {
+	var counts []string
+	m.Do(func(kv expvar.KeyValue) {
+		counts = append(counts, kv.Key+" "+kv.Value.String())
+	})
+	sort.Strings(counts)
+	return strings.Join(counts, ", ")
+}
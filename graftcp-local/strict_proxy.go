@@ -0,0 +1,25 @@
+package main
+
+// SetStrictProxy never let the connections leak out of the proxies unless
+// they are routed to direct explicitly, e.g. for Tor: the auto mode never
+// falls back to direct, it rejects the connections instead if no proxy is
+// available or the proxies fail, and the proxy front-ends pass the host names
+// requested to the proxies instead of resolving them locally. It overrides
+// direct_fallback_dest.
+func (l *Local) SetStrictProxy() {
+	l.strictProxy = true
+}
+
+// proxyOnly returns chain without direct, which rejects if nothing is left.
+func proxyOnly(chain []modeT) []modeT {
+	var modes []modeT
+	for _, m := range chain {
+		if m != DirectMode {
+			modes = append(modes, m)
+		}
+	}
+	if len(modes) == 0 {
+		return []modeT{RejectMode}
+	}
+	return modes
+}
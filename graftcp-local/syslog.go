@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+
+	"github.com/hashicorp/go-syslog"
+	"github.com/jedisct1/dlog"
+)
+
+// syslogPriorities maps the dlog severity names to the syslog priorities.
+var syslogPriorities = map[string]gsyslog.Priority{
+	"DEBUG":    gsyslog.LOG_DEBUG,
+	"INFO":     gsyslog.LOG_INFO,
+	"NOTICE":   gsyslog.LOG_NOTICE,
+	"WARNING":  gsyslog.LOG_WARNING,
+	"ERROR":    gsyslog.LOG_ERR,
+	"CRITICAL": gsyslog.LOG_CRIT,
+	"FATAL":    gsyslog.LOG_ALERT,
+}
+
+// useSyslog send the logs to the syslog server at addr with facility, the
+// local syslog if addr is empty. addr is "host:port" for UDP, or prefixed by
+// "udp://" or "tcp://". The logs are still written to the log file if set.
+func useSyslog(addr, facility string) error {
+	if facility == "" {
+		facility = "DAEMON"
+	}
+	var logger gsyslog.Syslogger
+	var err error
+	if addr == "" {
+		logger, err = gsyslog.NewLogger(gsyslog.LOG_INFO, facility, "graftcp-local")
+	} else {
+		network := "udp"
+		if i := strings.Index(addr, "://"); i >= 0 {
+			network, addr = addr[:i], addr[i+3:]
+		}
+		logger, err = gsyslog.DialLogger(network, addr, gsyslog.LOG_INFO, facility, "graftcp-local")
+	}
+	if err != nil {
+		return err
+	}
+	// dlog writes the lines to the pipe, then they are sent to the
+	// logger by the severity.
+	r, w, err := os.Pipe()
+	if err != nil {
+		logger.Close()
+		return err
+	}
+	logFile := dlog.GetFileDescriptor()
+	dlog.UseSyslog(false)
+	dlog.SetFileDescriptor(w)
+	go forwardSyslog(bufio.NewReader(r), logger, logFile)
+	return nil
+}
+
+// forwardSyslog send the log lines read from r to logger, and write them to
+// logFile if not nil.
+func forwardSyslog(r *bufio.Reader, logger gsyslog.Syslogger, logFile *os.File) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		if logFile != nil {
+			logFile.WriteString(line)
+		}
+		// the line is like "[2006-01-02 15:04:05] [INFO] message"
+		priority, msg := gsyslog.LOG_INFO, strings.TrimSuffix(line, "\n")
+		if i := strings.Index(msg, "] ["); i >= 0 {
+			if j := strings.Index(msg[i+3:], "] "); j >= 0 {
+				if p, ok := syslogPriorities[msg[i+3:i+3+j]]; ok {
+					priority, msg = p, msg[i+3+j+2:]
+				}
+			}
+		}
+		logger.WriteLevel(priority, []byte(msg))
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// runTest run the test subcommand with args, which reports how the
+// connections to the destinations would be handled with the config, and
+// returns the exit code, 1 if any destination is bad or fails to be dialed.
+//
+//	graftcp-local [flags] test [-dial] [-pid pid] <host:port>...
+func (app *App) runTest(args []string) int {
+	fs := flag.NewFlagSet("test", flag.ExitOnError)
+	dial := fs.Bool("dial", false, "Dial the destinations via the upstreams selected, and report the latency or the error")
+	pid := fs.String("pid", strconv.Itoa(os.Getpid()),
+		"PID of the process the connections are made by for the user and cmdline matchers of the rules")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] test [-dial] [-pid pid] <host:port>...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	l := app.newLocal()
+	if *dial {
+		l.ProbeProxies()
+		l.waitProbes()
+	}
+	code := 0
+	for _, addr := range fs.Args() {
+		if err := l.TestDest(os.Stdout, addr, *pid, *dial); err != nil {
+			fmt.Fprintf(os.Stdout, "  error: %s\n", err.Error())
+			code = 1
+		}
+	}
+	return code
+}
+
+// TestDest write to w how the connection of the process pid to addr would be
+// handled: the rule matched, the mode and the upstreams to dial in order.
+// The connection goes through the same middlewares as the real ones, and
+// it's dialed via the same failover chain if dial, the error is returned if
+// addr is bad or the dial fails.
+func (l *Local) TestDest(w io.Writer, addr, pid string, dial bool) error {
+	fmt.Fprintf(w, "%s\n", addr)
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	ip, err := resolveHost(context.Background(), host, l.strictProxy)
+	if err != nil {
+		return err
+	}
+	info := newConnInfo(pid, "", net.JoinHostPort(ip, port))
+	if ip != host {
+		info.Host = host
+	}
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	mc := l.newConnContext(conn, info, time.Now())
+	fmt.Fprintf(w, "  dest: %s", info.DestAddr)
+	if info.ASN != 0 {
+		fmt.Fprintf(w, ", ASN %d", info.ASN)
+	}
+	if info.PTR != "" {
+		fmt.Fprintf(w, ", PTR %s", info.PTR)
+	} else if info.ptrPending {
+		fmt.Fprintf(w, ", PTR not looked up yet")
+	}
+	fmt.Fprintln(w)
+
+	err = l.connHandler()(mc)
+	if mc.Rule != nil {
+		fmt.Fprintf(w, "  rule: %s\n", mc.Rule.line)
+	} else {
+		fmt.Fprintf(w, "  rule: none\n")
+	}
+	if err != nil {
+		fmt.Fprintf(w, "  rejected: %s\n", err.Error())
+		return nil
+	}
+	if info.DestAddr != net.JoinHostPort(ip, port) {
+		fmt.Fprintf(w, "  rewritten to: %s\n", info.DestAddr)
+	}
+	fmt.Fprintf(w, "  mode: %s, timeout %s, retry %d, upload rate %d, download rate %d\n",
+		mc.Mode, mc.Timeout, mc.Retry, mc.UploadRate, mc.DownloadRate)
+
+	chain := []modeT{mc.Mode}
+	if mc.Mode == AutoSelectMode {
+		chain = l.failoverChain()
+	}
+	var upstreams []string
+	if mc.Dialer != nil {
+		upstreams = append(upstreams, l.namedDialer(mc.Dialer).String()+" (pre-dial hook)")
+	} else {
+		for _, m := range chain {
+			if m == RejectMode {
+				upstreams = append(upstreams, "reject")
+			} else if d := l.proxySelector(m); available(d) {
+				upstreams = append(upstreams, l.namedDialer(d).String())
+			} else {
+				upstreams = append(upstreams, m.String()+" (unavailable)")
+			}
+		}
+	}
+	fmt.Fprintf(w, "  upstreams: %s\n", strings.Join(upstreams, ", "))
+	if !dial {
+		return nil
+	}
+
+	start := time.Now()
+	var destConn net.Conn
+	var dialer *namedDialer
+	if mc.Dialer != nil {
+		dialer = l.namedDialer(mc.Dialer)
+		destConn, err = l.dialUpstream(context.Background(), dialer, dialer, info.DestAddr, mc.Timeout, mc.Retry, true)
+	} else {
+		var d proxy.Dialer
+		destConn, d, err = l.dialChain(context.Background(), chain, info, mc.Timeout, mc.Retry)
+		dialer, _ = d.(*namedDialer)
+	}
+	elapsed := time.Since(start)
+	if err == errFailoverRejected {
+		fmt.Fprintf(w, "  dial: rejected by the failover chain\n")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("dial failed in %s: %s", elapsed, err.Error())
+	}
+	destConn.Close()
+	l.releaseUpstream(dialer.name)
+	fmt.Fprintf(w, "  dial: ok via %s in %s\n", dialer, elapsed)
+	return nil
+}
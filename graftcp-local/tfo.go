@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net"
+)
+
+// fastOpenDialer dial directly, with TCP Fast Open if enabled and asked for.
+// It's the direct dialer and the dialer to the proxies.
+type fastOpenDialer struct {
+	enabled bool
+	tos     int // TOS of the connections, not set if 0
+}
+
+// Dial dial addr without TCP Fast Open.
+func (d *fastOpenDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.dialFrom(network, addr, nil, false)
+}
+
+// dialFrom dial addr from the local address laddr if it's not nil, with TCP
+// Fast Open if fastOpen and it's enabled.
+func (d *fastOpenDialer) dialFrom(network, addr string, laddr net.Addr, fastOpen bool) (net.Conn, error) {
+	fastOpen = fastOpen && d.enabled
+	if !fastOpen && d.tos == 0 {
+		dialer := net.Dialer{LocalAddr: laddr}
+		return dialer.Dial(network, addr)
+	}
+	return dialFastOpen(network, addr, laddr, fastOpen, d.tos)
+}
+
+// SetFastOpen enable TCP Fast Open on dialing the proxies, the data first
+// written is sent in the SYN if the kernel and the proxy support it, or it
+// falls back to the normal connect silently.
+func (l *Local) SetFastOpen(enabled bool) {
+	l.fastOpen.enabled = enabled
+}
+
+// SetFastOpenDirect dial the direct connections with TCP Fast Open too if
+// it's enabled by SetFastOpen. It's off by default, as the SYN is delayed
+// until the first write, and the protocols in which the server speaks first
+// would stall.
+func (l *Local) SetFastOpenDirect(enabled bool) {
+	l.forwards["direct"].fastOpen = enabled
+}
@@ -0,0 +1,40 @@
+// +build go1.11
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+const tcpFastOpenConnect = 30 // TCP_FASTOPEN_CONNECT of Linux 4.11 or later
+
+// dialFastOpen dial addr with TCP_FASTOPEN_CONNECT if fastOpen, the option is
+// ignored if not supported by the kernel, and with the TOS or the traffic
+// class of IPv6 tos if it's not 0.
+func dialFastOpen(network, addr string, laddr net.Addr, fastOpen bool, tos int) (net.Conn, error) {
+	dialer := net.Dialer{
+		LocalAddr: laddr,
+		Control: func(network, address string, c syscall.RawConn) error {
+			var err error
+			cerr := c.Control(func(fd uintptr) {
+				if fastOpen {
+					syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpenConnect, 1)
+				}
+				if tos == 0 {
+					return
+				}
+				if network == "tcp6" {
+					err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tos)
+				} else {
+					err = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TOS, tos)
+				}
+			})
+			if cerr != nil {
+				return cerr
+			}
+			return err
+		},
+	}
+	return dialer.Dial(network, addr)
+}
@@ -0,0 +1,18 @@
+// +build !go1.11
+
+package main
+
+import (
+	"net"
+)
+
+// dialFastOpen dial addr normally, as net.Dialer.Control requires Go 1.11,
+// and set the TOS tos after connected if it's not 0.
+func dialFastOpen(network, addr string, laddr net.Addr, fastOpen bool, tos int) (net.Conn, error) {
+	dialer := net.Dialer{LocalAddr: laddr}
+	conn, err := dialer.Dial(network, addr)
+	if err == nil && tos != 0 {
+		setTos(conn, tos)
+	}
+	return conn, err
+}
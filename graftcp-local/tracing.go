@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+const (
+	tracerQueueSize     = 1024
+	tracerBatchSize     = 128
+	tracerFlushInterval = 5 * time.Second
+	tracerPostTimeout   = 10 * time.Second
+)
+
+// Tracer export the spans of the connections to an OpenTelemetry collector
+// with OTLP/HTTP in JSON encoding. A nil *Tracer is valid and does nothing.
+type Tracer struct {
+	url    string
+	queue  chan *Span
+	client *http.Client
+}
+
+// Span is an OpenTelemetry span. A nil *Span is valid and does nothing.
+type Span struct {
+	tracer   *Tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID []byte
+	name     string
+	start    time.Time
+	end      time.Time
+	attrs    []otlpKeyValue
+	errMsg   string
+}
+
+// NewTracer returns a Tracer exporting the spans to endpoint, e.g.:
+// http://127.0.0.1:4318, the spans are posted to endpoint/v1/traces.
+func NewTracer(endpoint string) *Tracer {
+	t := &Tracer{
+		url:    strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		queue:  make(chan *Span, tracerQueueSize),
+		client: &http.Client{Timeout: tracerPostTimeout},
+	}
+	go t.export()
+	return t
+}
+
+// Start start a span named name, as a child of parent if parent is not nil.
+func (t *Tracer) Start(name string, parent *Span) *Span {
+	if t == nil {
+		return nil
+	}
+	s := &Span{tracer: t, name: name, start: time.Now()}
+	if parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID[:]
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	return s
+}
+
+// SetAttr set the attribute key of s, val is a string or an integer.
+func (s *Span) SetAttr(key string, val interface{}) {
+	if s == nil {
+		return
+	}
+	kv := otlpKeyValue{Key: key}
+	switch v := val.(type) {
+	case int:
+		kv.Value.IntValue = strconv.Itoa(v)
+	case int64:
+		kv.Value.IntValue = strconv.FormatInt(v, 10)
+	case string:
+		kv.Value.StringValue = &v
+	default:
+		str := ""
+		kv.Value.StringValue = &str
+	}
+	s.attrs = append(s.attrs, kv)
+}
+
+// End end s, and mark it failed if err is not nil.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	if err != nil {
+		s.errMsg = err.Error()
+	}
+	select {
+	case s.tracer.queue <- s:
+	default:
+		dlog.Debugf("tracer queue is full, drop span %s", s.name)
+	}
+}
+
+func (t *Tracer) export() {
+	ticker := time.NewTicker(tracerFlushInterval)
+	defer ticker.Stop()
+	var batch []*Span
+	for {
+		select {
+		case s := <-t.queue:
+			batch = append(batch, s)
+			if len(batch) < tracerBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := t.post(batch); err != nil {
+			dlog.Errorf("export %d spans to %s err: %s", len(batch), t.url, err.Error())
+		}
+		batch = nil
+	}
+}
+
+type otlpAnyValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    string  `json:"intValue,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"` // 1: OK, 2: ERROR
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+func (t *Tracer) post(batch []*Span) error {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		o := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			ParentSpanID:      hex.EncodeToString(s.parentID),
+			Name:              s.name,
+			Kind:              1, // SPAN_KIND_INTERNAL
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        s.attrs,
+			Status:            otlpStatus{Code: 1},
+		}
+		if s.errMsg != "" {
+			o.Status = otlpStatus{Code: 2, Message: s.errMsg}
+		}
+		spans = append(spans, o)
+	}
+	serviceName := "graftcp-local"
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []otlpKeyValue{{
+					Key:   "service.name",
+					Value: otlpAnyValue{StringValue: &serviceName},
+				}},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "graftcp-local"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := t.client.Post(t.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
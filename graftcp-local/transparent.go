@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net"
+)
+
+// transparentDialer dial directly from the source IP address of the
+// connection to graftcp-local, so the destination sees the original source.
+type transparentDialer struct {
+	src net.IP
+}
+
+func (d transparentDialer) Dial(network, addr string) (net.Conn, error) {
+	return dialTransparent(network, addr, d.src)
+}
+
+// transparentSource returns the source IP address of c to dial from, or nil
+// if it's a loopback address. The connections of the traced processes are
+// redirected by graftcp to graftcp-local on the loopback, and the address
+// info graftcp sends has no source, so only the connections from the other
+// hosts, e.g. to the front-ends, keep their sources.
+func transparentSource(c *ConnInfo) net.IP {
+	host, _, err := net.SplitHostPort(c.SrcAddr)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() {
+		return nil
+	}
+	return ip
+}
@@ -0,0 +1,37 @@
+// +build go1.11
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+const (
+	solIPv6         = 41
+	ipTransparent   = 19 // IP_TRANSPARENT of Linux
+	ipv6Transparent = 75 // IPV6_TRANSPARENT of Linux
+)
+
+// dialTransparent dial addr from the src IP address with IP_TRANSPARENT, which
+// requires CAP_NET_ADMIN.
+func dialTransparent(network, addr string, src net.IP) (net.Conn, error) {
+	dialer := net.Dialer{
+		LocalAddr: &net.TCPAddr{IP: src},
+		Control: func(network, address string, c syscall.RawConn) error {
+			var err error
+			cerr := c.Control(func(fd uintptr) {
+				if src.To4() != nil {
+					err = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, ipTransparent, 1)
+				} else {
+					err = syscall.SetsockoptInt(int(fd), solIPv6, ipv6Transparent, 1)
+				}
+			})
+			if cerr != nil {
+				return cerr
+			}
+			return err
+		},
+	}
+	return dialer.Dial(network, addr)
+}
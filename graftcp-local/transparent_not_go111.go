@@ -0,0 +1,12 @@
+// +build !go1.11
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+func dialTransparent(network, addr string, src net.IP) (net.Conn, error) {
+	return nil, errors.New("transparent requires Go 1.11 or later")
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestTransparentSource(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"192.0.2.1:40000", "192.0.2.1"},
+		{"[2001:db8::1]:40000", "2001:db8::1"},
+		{"127.0.0.1:40000", "<nil>"}, // traced by graftcp
+		{"[::1]:40000", "<nil>"},
+		{"", "<nil>"},
+	}
+	for _, tt := range tests {
+		c := newConnInfo("42", tt.src, "198.51.100.1:443")
+		if got := transparentSource(c).String(); got != tt.want {
+			t.Errorf("transparentSource(%q) = %s, want %s", tt.src, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sync/atomic"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	"golang.org/x/net/proxy"
+)
+
+// UpstreamStats is the stats of the connections through an upstream during
+// the process lifetime.
+type UpstreamStats struct {
+	Conns    int64 `json:"conns"`    // connections dialed
+	Active   int64 `json:"active"`   // connections not closed yet
+	Sent     int64 `json:"sent"`     // bytes sent to the destinations
+	Received int64 `json:"received"` // bytes received from the destinations
+}
+
+// upstreamNames are the names of the upstreams, "custom" is for the dialers
+// returned by the pre-dial hook.
+var upstreamNames = []string{"socks5", "http_proxy", "direct", "honeypot", "custom"}
+
+func newUpstreamStats() map[string]*UpstreamStats {
+	m := make(map[string]*UpstreamStats)
+	for _, name := range upstreamNames {
+		m[name] = &UpstreamStats{}
+	}
+	return m
+}
+
+// upstreamName returns the name of the upstream of dialer.
+func (l *Local) upstreamName(dialer proxy.Dialer) string {
+	if d, ok := dialer.(*namedDialer); ok {
+		return d.name
+	}
+	switch {
+	case dialer == l.socks5Dialer:
+		return "socks5"
+	case dialer == l.httpProxyDialer:
+		return "http_proxy"
+	case dialer == l.directDialer:
+		return "direct"
+	case l.honeypotDialer != nil && dialer == l.honeypotDialer:
+		return "honeypot"
+	}
+	return "custom"
+}
+
+// UpstreamStats returns the stats of the upstreams.
+func (l *Local) UpstreamStats() map[string]UpstreamStats {
+	m := make(map[string]UpstreamStats)
+	for name, s := range l.upstreams {
+		m[name] = UpstreamStats{
+			Conns:    atomic.LoadInt64(&s.Conns),
+			Active:   atomic.LoadInt64(&s.Active),
+			Sent:     atomic.LoadInt64(&s.Sent),
+			Received: atomic.LoadInt64(&s.Received),
+		}
+	}
+	return m
+}
+
+// Shutdown stop accepting the connections, and wait for the active ones to
+// be closed until timeout.
+func (l *Local) Shutdown(timeout time.Duration) {
+	l.lnMu.Lock()
+	l.closing = true
+	if l.ln != nil {
+		l.ln.Close()
+	}
+	l.lnMu.Unlock()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		var active int64
+		for _, s := range l.upstreams {
+			active += atomic.LoadInt64(&s.Active)
+		}
+		if active == 0 {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// ReportUpstreamStats log the stats of the upstreams, and write them in JSON
+// format to path if it's not empty.
+func (l *Local) ReportUpstreamStats(path string) {
+	stats := l.UpstreamStats()
+	for _, name := range upstreamNames {
+		s := stats[name]
+		dlog.Noticef("upstream %s: %d connections (%d active), %d bytes sent, %d bytes received",
+			name, s.Conns, s.Active, s.Sent, s.Received)
+	}
+	if path == "" {
+		return
+	}
+	data, err := json.MarshalIndent(stats, "", "  ")
+	if err != nil {
+		dlog.Errorf("json.MarshalIndent err: %s", err.Error())
+		return
+	}
+	if err := ioutil.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		dlog.Errorf("write the upstream stats to %s err: %s", path, err.Error())
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	"golang.org/x/net/proxy"
+)
+
+// upstreamMaxWait is the max time for a connection to wait for an upstream
+// at its concurrency limit when there is no other upstream to try.
+const upstreamMaxWait = 10 * time.Second
+
+// upstreamSaturated count the times an upstream is at its concurrency limit
+// when a connection wants it, by upstream name.
+var upstreamSaturated = expvar.NewMap("upstream_saturated")
+
+// SetUpstreamMaxConns limit the concurrent connections of the upstreams by
+// limits like "socks5=10,http_proxy=20". An upstream at its limit is skipped
+// for the next in the failover chain, or waited for up to upstreamMaxWait if
+// it's the last.
+func (l *Local) SetUpstreamMaxConns(limits string) error {
+	slots := make(map[string]chan struct{})
+	for _, kv := range strings.Split(limits, ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("bad upstream_max_conns: %s", kv)
+		}
+		name := strings.TrimSpace(parts[0])
+		if _, ok := l.upstreams[name]; !ok || name == "custom" {
+			return fmt.Errorf("unknown upstream in upstream_max_conns: %s", name)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || n <= 0 {
+			return fmt.Errorf("bad limit of %s in upstream_max_conns: %s", name, parts[1])
+		}
+		slots[name] = make(chan struct{}, n)
+	}
+	l.upstreamSlots = slots
+	return nil
+}
+
+// saturated reports whether the upstream name is at its limit.
+func (l *Local) saturated(name string) bool {
+	s, ok := l.upstreamSlots[name]
+	return ok && len(s) == cap(s)
+}
+
+// acquireUpstream take a slot of the upstream name, and wait for one until
+// ctx is done or upstreamMaxWait if wait, reports whether it's taken. It's
+// always taken if the upstream has no limit.
+func (l *Local) acquireUpstream(ctx context.Context, name string, wait bool) bool {
+	s, ok := l.upstreamSlots[name]
+	if !ok {
+		return true
+	}
+	select {
+	case s <- struct{}{}:
+		return true
+	default:
+	}
+	upstreamSaturated.Add(name, 1)
+	if !wait {
+		return false
+	}
+	t := time.NewTimer(upstreamMaxWait)
+	defer t.Stop()
+	select {
+	case s <- struct{}{}:
+		return true
+	case <-t.C:
+	case <-ctx.Done():
+	}
+	return false
+}
+
+// dialUpstream dial addr via d, which is nd or wraps it, within the limit of
+// the upstream of nd, waiting for a slot as acquireUpstream if wait. It fails
+// with errUpstreamBusy if no slot is taken. The slot is kept if dialed, and
+// must be released by releaseUpstream once the connection is closed.
+func (l *Local) dialUpstream(ctx context.Context, nd *namedDialer, d proxy.Dialer, addr string,
+	timeout time.Duration, retry int, wait bool) (net.Conn, error) {
+	if !l.acquireUpstream(ctx, nd.name, wait) {
+		dlog.Infof("dial %s: the %s upstream is at its limit of the concurrent connections", addr, nd.name)
+		return nil, errUpstreamBusy
+	}
+	conn, err := dialRetry(ctx, d, addr, timeout, retry)
+	if err != nil {
+		l.releaseUpstream(nd.name)
+	}
+	return conn, err
+}
+
+// releaseUpstream release the slot of the upstream name taken.
+func (l *Local) releaseUpstream(name string) {
+	if s, ok := l.upstreamSlots[name]; ok {
+		<-s
+	}
+}
+
+// limitedConn is a connection dialed through an upstream with its slot taken,
+// which is released once the connection is closed.
+type limitedConn struct {
+	net.Conn
+	release func()
+	once    sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestDialUpstreamLimit(t *testing.T) {
+	l := newTestLocal()
+	if err := l.SetUpstreamMaxConns("direct=1"); err != nil {
+		t.Fatal(err)
+	}
+	addr := listenEcho(t)
+	nd := l.namedDialer(l.directDialer)
+	conn, err := l.dialUpstream(context.Background(), nd, nd, addr, 0, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.dialUpstream(context.Background(), nd, nd, addr, 0, 0, false); err != errUpstreamBusy {
+		t.Errorf("dial beyond the limit err: %v, want %v", err, errUpstreamBusy)
+	}
+	conn.Close()
+	l.releaseUpstream(nd.name)
+	conn, err = l.dialUpstream(context.Background(), nd, nd, addr, 0, 0, false)
+	if err != nil {
+		t.Fatalf("dial after released err: %v", err)
+	}
+	conn.Close()
+	l.releaseUpstream(nd.name)
+	// the slot is released if the dial fails
+	if _, err := l.dialUpstream(context.Background(), nd, nd, "127.0.0.1:1", 0, 0, false); err == nil || err == errUpstreamBusy {
+		t.Errorf("dial the closed port err: %v", err)
+	}
+	if l.saturated(nd.name) {
+		t.Error("the slot is kept after the dial failed")
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/jedisct1/dlog"
+	"golang.org/x/net/proxy"
+)
+
+// SetUpstreamNetwork reach the proxies of the upstreams by the networks of
+// spec, like "socks5=tcp4,http_proxy=auto". A proxy address is resolved to
+// an address of its network, tcp, tcp4 or tcp6, or with auto, to the first
+// address resolved accepting the connection.
+func (l *Local) SetUpstreamNetwork(spec string) error {
+	for _, kv := range strings.Split(spec, ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("bad upstream_network: %s", kv)
+		}
+		name, network := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if name != "socks5" && name != "http_proxy" {
+			return fmt.Errorf("unknown upstream in upstream_network: %s", name)
+		}
+		switch network {
+		case "tcp", "tcp4", "tcp6", "auto":
+		default:
+			return fmt.Errorf("unknown network of %s in upstream_network: %s", name, network)
+		}
+		addr, err := l.resolveProxy(name, network)
+		if err != nil {
+			return fmt.Errorf("resolve the %s proxy %s with %s err: %s", name, l.proxyHosts[name], network, err.Error())
+		}
+		if err := l.setProxyAddr(name, addr); err != nil {
+			return err
+		}
+		dlog.Infof("reach the %s proxy %s at %s", name, l.proxyHosts[name], addr)
+	}
+	return nil
+}
+
+// resolveProxy returns the address of the proxy of the upstream name of
+// network.
+func (l *Local) resolveProxy(name, network string) (string, error) {
+	host := l.proxyHosts[name]
+	if network != "auto" {
+		addr, err := net.ResolveTCPAddr(network, host)
+		if err != nil {
+			return "", err
+		}
+		return addr.String(), nil
+	}
+	h, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return "", err
+	}
+	ips, err := net.LookupIP(h)
+	if err != nil {
+		return "", err
+	}
+	err = fmt.Errorf("no address of %s", h)
+	for _, ip := range ips {
+		addr := net.JoinHostPort(ip.String(), port)
+		conn, e := dialTimeout(context.Background(), l.forwards[name], addr, probeTimeout)
+		if e == nil {
+			conn.Close()
+			return addr, nil
+		}
+		dlog.Infof("the %s proxy is not reachable at %s: %s", name, addr, e.Error())
+		err = e
+	}
+	return "", err
+}
+
+// setProxyAddr dial the proxy of the upstream name at addr.
+func (l *Local) setProxyAddr(name, addr string) error {
+	if name == "socks5" {
+		d, err := proxy.SOCKS5("tcp", addr, l.socks5Auth, l.forwards["socks5"])
+		if err != nil {
+			return err
+		}
+		l.socks5Dialer, l.socks5Addr = d, addr
+		return nil
+	}
+	d, err := proxy.FromURL(&url.URL{Scheme: "http", Host: addr}, l.forwards["http_proxy"])
+	if err != nil {
+		return err
+	}
+	l.httpProxyDialer, l.httpProxyAddr = d, addr
+	return nil
+}
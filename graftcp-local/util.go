@@ -9,6 +9,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
 )
 
 func ip2int(ip net.IP) uint32 {
@@ -123,6 +124,23 @@ func splitAddrIPv6(addr string) (ipv6 string, port string, err error) {
 
 // getInode get the inode, localAddrHex format: 0100007F:04D2
 func getInode(localAddrHex, remoteAddrHex string, isTCP6 bool) (inode string) {
+	sockets, err := readProcNetTCP(isTCP6)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	for _, fields := range sockets {
+		if strings.Contains(fields[1] /* local address:port */, localAddrHex) &&
+			strings.Contains(fields[2] /* remote address:port */, remoteAddrHex) {
+			return fields[9] // fields[9] is inode
+		}
+	}
+	return ""
+}
+
+// readProcNetTCP returns the fields of the TCP sockets in /proc/net/tcp, or
+// in /proc/net/tcp6 if isTCP6.
+func readProcNetTCP(isTCP6 bool) ([][]string, error) {
 	var path string
 	if isTCP6 {
 		path = "/proc/net/tcp6"
@@ -131,48 +149,73 @@ func getInode(localAddrHex, remoteAddrHex string, isTCP6 bool) (inode string) {
 	}
 	data, err := ioutil.ReadFile(path)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return nil, err
 	}
 	lines := strings.Split(string(data), "\n")
-	if len(lines) == 0 {
-		return ""
-	}
-
+	var sockets [][]string
 	// skip the first header line
 	for _, line := range lines[1:] {
-		fields := strings.Fields(line)
-		if len(fields) < 10 {
-			continue
-		}
-		if strings.Contains(fields[1] /* local address:port */, localAddrHex) &&
-			strings.Contains(fields[2] /* remote address:port */, remoteAddrHex) {
-			return fields[9] // fields[9] is inode
+		if fields := strings.Fields(line); len(fields) >= 10 {
+			sockets = append(sockets, fields)
 		}
 	}
-	return ""
+	return sockets, nil
 }
 
+// hasIncludeInode reports whether the process pid has the socket inode opened.
 func hasIncludeInode(pid, inode string) bool {
 	pidInt, _ := strconv.Atoi(pid)
 	if pidInt < 1 {
 		return false
 	}
-	fds, _ := filepath.Glob("/proc/" + pid + "/fd/[0-9]*")
-	for _, fd := range fds {
-		link, _ := os.Readlink(fd)
-		if strings.Contains(link, "socket:["+inode+"]") {
+	links := map[string]bool{socketLink(inode): true}
+	found, ok := hasFdLink("/proc/"+pid+"/fd/", links)
+	if ok {
+		return found
+	}
+	// pid may be a thread which is not listed in /proc
+	tids, _ := filepath.Glob("/proc/[0-9]*/task/" + pid + "/fd/")
+	for _, dir := range tids {
+		if found, _ = hasFdLink(dir, links); found {
 			return true
 		}
 	}
-	if len(fds) == 0 {
-		tidsFds, _ := filepath.Glob("/proc/[0-9]*/task/" + pid + "/fd/[0-9]*")
-		for _, fd := range tidsFds {
-			link, _ := os.Readlink(fd)
-			if strings.Contains(link, "socket:["+inode+"]") {
-				return true
-			}
+	return false
+}
+
+// socketLink returns the fd link of the socket inode.
+func socketLink(inode string) string {
+	return "socket:[" + inode + "]"
+}
+
+// hasFdLink reports whether any fd in dir links to one of links, ok is false
+// if dir cannot be read.
+func hasFdLink(dir string, links map[string]bool) (found, ok bool) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return false, false
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil && len(names) == 0 {
+		return false, false
+	}
+	// read the links into one buffer, as os.Readlink allocates for each, the
+	// links longer than any of links are truncated and never match
+	max := 0
+	for link := range links {
+		if len(link) > max {
+			max = len(link)
+		}
+	}
+	buf := make([]byte, max+1)
+	path := []byte(dir)
+	for _, name := range names {
+		path = append(path[:len(dir)], name...)
+		n, err := syscall.Readlink(string(path), buf)
+		if err == nil && n <= max && links[string(buf[:n])] {
+			return true, true
 		}
 	}
-	return false
+	return false, true
 }
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// hasIncludeInodeGlob is hasIncludeInode before scanning each fd directory
+// once, kept to compare with.
+func hasIncludeInodeGlob(pid, inode string) bool {
+	fds, _ := filepath.Glob("/proc/" + pid + "/fd/[0-9]*")
+	for _, fd := range fds {
+		link, _ := os.Readlink(fd)
+		if strings.Contains(link, "socket:["+inode+"]") {
+			return true
+		}
+	}
+	return false
+}
+
+// openFds open n more fds in the process for the scans, and returns the
+// function to close them.
+func openFds(b *testing.B, n int) func() {
+	var files []*os.File
+	closeAll := func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+	for i := 0; i < n; i++ {
+		f, err := os.Open(os.DevNull)
+		if err != nil {
+			closeAll()
+			b.Skipf("open %d fds: %s", n, err)
+		}
+		files = append(files, f)
+	}
+	return closeAll
+}
+
+// benchmarkScan scan the 4k fds of the process for a socket inode it doesn't
+// have, which is the cost for each pid but the one found.
+func benchmarkScan(b *testing.B, has func(pid, inode string) bool) {
+	defer openFds(b, 4096)()
+	pid := strconv.Itoa(os.Getpid())
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if has(pid, "0") {
+			b.Fatal("found the inode 0")
+		}
+	}
+}
+
+func BenchmarkHasIncludeInode(b *testing.B) {
+	benchmarkScan(b, hasIncludeInode)
+}
+
+func BenchmarkHasIncludeInodeGlob(b *testing.B) {
+	benchmarkScan(b, hasIncludeInodeGlob)
+}
+
+func TestHasIncludeInode(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	pid := strconv.Itoa(os.Getpid())
+	fds, _ := filepath.Glob("/proc/" + pid + "/fd/[0-9]*")
+	var inode string
+	for _, fd := range fds {
+		link, _ := os.Readlink(fd)
+		if strings.HasPrefix(link, "socket:[") {
+			inode = strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]")
+			break
+		}
+	}
+	if inode == "" {
+		t.Fatal("no socket opened by the process")
+	}
+	if !hasIncludeInode(pid, inode) {
+		t.Errorf("hasIncludeInode(%s, %s) = false, want true", pid, inode)
+	}
+	if hasIncludeInode(pid, "0") {
+		t.Errorf("hasIncludeInode(%s, 0) = true, want false", pid)
+	}
+	if hasIncludeInode("0", inode) {
+		t.Errorf("hasIncludeInode(0, %s) = true, want false", inode)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	weightDecay = 0.5  // multiply the weight by it on a dial failure
+	weightGain  = 0.2  // move the weight toward 1 by the ratio on a success
+	weightMin   = 0.05 // so a degraded upstream is still tried sometimes
+)
+
+// upstreamWeight is the weight of an upstream in (0, 1] when updated.
+type upstreamWeight struct {
+	weight  float64
+	updated time.Time
+}
+
+// upstreamWeights are the weights of the upstreams to select in the random
+// mode, which decay on the dial failures, and recover on the successes and
+// over time, so the connections shift away from a degraded upstream smoothly.
+type upstreamWeights struct {
+	halfLife time.Duration // of the recovery over time
+
+	mu sync.Mutex
+	m  map[string]upstreamWeight // by upstream name, 1 if absent
+}
+
+// SetWeightRecovery weight the socks5 and the http_proxy selected in the
+// random mode by their dial results, a weight is halved on a failure, and
+// recovers to 1 with the half-life halfLife and on the successes. They are
+// selected evenly if halfLife <= 0.
+func (l *Local) SetWeightRecovery(halfLife time.Duration) {
+	if halfLife <= 0 {
+		l.weights = nil
+		return
+	}
+	l.weights = &upstreamWeights{halfLife: halfLife, m: make(map[string]upstreamWeight)}
+}
+
+// current returns the weight of the upstream name recovered until now,
+// ws.mu must be held.
+func (ws *upstreamWeights) current(name string, now time.Time) float64 {
+	w, ok := ws.m[name]
+	if !ok {
+		return 1
+	}
+	loss := (1 - w.weight) * math.Exp2(-float64(now.Sub(w.updated))/float64(ws.halfLife))
+	return 1 - loss
+}
+
+// update adjust the weight of the upstream name by the dial result.
+func (ws *upstreamWeights) update(name string, ok bool) {
+	if ws == nil {
+		return
+	}
+	now := time.Now()
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	w := ws.current(name, now)
+	if ok {
+		w += (1 - w) * weightGain
+	} else {
+		w = math.Max(w*weightDecay, weightMin)
+	}
+	ws.m[name] = upstreamWeight{weight: w, updated: now}
+}
+
+// pick returns a or b at random by their weights, evenly if ws is nil.
+func (ws *upstreamWeights) pick(r *lockedRand, a, b string) string {
+	if ws == nil {
+		if r.Intn(2) == 0 {
+			return a
+		}
+		return b
+	}
+	now := time.Now()
+	ws.mu.Lock()
+	wa, wb := ws.current(a, now), ws.current(b, now)
+	ws.mu.Unlock()
+	if r.Float64()*(wa+wb) < wa {
+		return a
+	}
+	return b
+}
+
+// snapshot returns the current weights by upstream name.
+func (ws *upstreamWeights) snapshot() map[string]float64 {
+	if ws == nil {
+		return nil
+	}
+	now := time.Now()
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	m := make(map[string]float64)
+	for _, name := range []string{"socks5", "http_proxy"} {
+		m[name] = math.Floor(ws.current(name, now)*1000+0.5) / 1000
+	}
+	return m
+}